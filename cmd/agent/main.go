@@ -3,6 +3,9 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -13,8 +16,15 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/hairutdin/metrics-service/internal/grpcapi"
 	"github.com/hairutdin/metrics-service/internal/middleware"
 	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/proto/metricspb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
 )
 
 type RuntimeMetrics struct {
@@ -133,7 +143,31 @@ func sendMetric(metricType, metricName string, delta *int64, value *float64, ser
 	defer resp.Body.Close()
 }
 
+// randRead fills idempotency keys; tests replace it.
+var randRead = crand.Read
+
+// newIdempotencyKey returns a random key identifying one batch across all
+// of its retries, so the server applies it only once.
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := randRead(b); err != nil {
+		return "", fmt.Errorf("failed to generate idempotency key: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// batchKey returns the idempotency key of a new batch. Without one a retry
+// may be applied twice, which is better than not reporting at all.
+func batchKey() string {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		fmt.Printf("Sending batch without idempotency key: %v\n", err)
+	}
+	return key
+}
+
 func sendMetricsBatch(metrics []models.Metrics, serverAddress string, client *http.Client) error {
+	key := batchKey()
 	operation := func() error {
 		jsonData, err := json.Marshal(metrics)
 		if err != nil {
@@ -158,6 +192,9 @@ func sendMetricsBatch(metrics []models.Metrics, serverAddress string, client *ht
 
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Content-Encoding", "gzip")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
 
 		resp, err := client.Do(req)
 		if err != nil {
@@ -175,10 +212,53 @@ func sendMetricsBatch(metrics []models.Metrics, serverAddress string, client *ht
 	return middleware.RetryOperation(operation)
 }
 
+// newGRPCClient connects to the server's gRPC endpoint. Every call is gzip
+// compressed and, when token is set, authenticated with it.
+func newGRPCClient(address, token string) (metricspb.MetricsServiceClient, *grpc.ClientConn, error) {
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor(grpcgzip.Name)),
+	}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(grpcapi.TokenCredentials(token)))
+	}
+
+	conn, err := grpc.NewClient(address, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return metricspb.NewMetricsServiceClient(conn), conn, nil
+}
+
+func sendMetricsBatchGRPC(metrics []models.Metrics, client metricspb.MetricsServiceClient) error {
+	req := &metricspb.UpdateMetricsRequest{Metrics: make([]*metricspb.Metric, 0, len(metrics))}
+	for _, m := range metrics {
+		req.Metrics = append(req.Metrics, grpcapi.FromModel(m))
+	}
+
+	key := batchKey()
+	operation := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if key != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, grpcapi.IdempotencyKeyMetadata, key)
+		}
+
+		if _, err := client.UpdateMetrics(ctx, req); err != nil {
+			return fmt.Errorf("failed to send metrics batch over gRPC: %w", err)
+		}
+		return nil
+	}
+
+	return middleware.RetryOperation(operation)
+}
+
 func main() {
 	flagReportInterval := flag.Int("r", 10, "Report interval in seconds")
 	flagPollInterval := flag.Int("p", 2, "Poll interval in seconds")
 	flagServerAddress := flag.String("a", "localhost:8080", "server address")
+	flagGRPCAddress := flag.String("g", "", "gRPC server address; sends metrics over gRPC instead of HTTP when set")
+	flagGRPCToken := flag.String("grpc-token", "", "Bearer token for the gRPC server")
 	flag.Parse()
 
 	envReportInterval := os.Getenv("REPORT_INTERVAL")
@@ -210,11 +290,32 @@ func main() {
 		serverAddress = envServerAddress
 	}
 
+	grpcAddress := *flagGRPCAddress
+	if envGRPCAddress := os.Getenv("GRPC_ADDRESS"); envGRPCAddress != "" {
+		grpcAddress = envGRPCAddress
+	}
+
+	grpcToken := *flagGRPCToken
+	if envGRPCToken := os.Getenv("GRPC_AUTH_TOKEN"); envGRPCToken != "" {
+		grpcToken = envGRPCToken
+	}
+
 	if len(flag.Args()) > 0 {
 		fmt.Printf("Error: Unknown flags or arguments: %v\n", flag.Args())
 		os.Exit(1)
 	}
 
+	var grpcClient metricspb.MetricsServiceClient
+	if grpcAddress != "" {
+		client, conn, err := newGRPCClient(grpcAddress, grpcToken)
+		if err != nil {
+			fmt.Printf("Error: Invalid gRPC address %v: %v\n", grpcAddress, err)
+			os.Exit(1)
+		}
+		defer conn.Close()
+		grpcClient = client
+	}
+
 	metrics := &RuntimeMetrics{}
 	go func() {
 		for {
@@ -224,6 +325,7 @@ func main() {
 	}()
 
 	go func() {
+		var schedule metadataSchedule
 		for {
 			metricList := []models.Metrics{
 				{ID: "Alloc", MType: "gauge", Value: &metrics.Alloc},
@@ -257,7 +359,15 @@ func main() {
 				{ID: "RandomValue", MType: "gauge", Value: &metrics.RandomValue},
 			}
 
-			sendMetricsBatch(metricList, serverAddress, http.DefaultClient)
+			now := time.Now()
+			report, described := schedule.prepare(metricList, now)
+			var err error
+			if grpcClient != nil {
+				err = sendMetricsBatchGRPC(report, grpcClient)
+			} else {
+				err = sendMetricsBatch(report, serverAddress, http.DefaultClient)
+			}
+			schedule.report(described, err, now)
 			time.Sleep(time.Duration(reportInterval) * time.Second)
 		}
 	}()
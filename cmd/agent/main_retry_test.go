@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	crand "crypto/rand"
 	"errors"
+	"github.com/hairutdin/metrics-service/internal/grpcapi"
 	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/proto/metricspb"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	"net/http"
 	"testing"
 )
@@ -33,3 +39,83 @@ func TestSendMetricBatch_RetryOnNetworkError(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "temporary network error")
 }
+
+type recordingClient struct {
+	metricspb.MetricsServiceClient
+	requests []*metricspb.UpdateMetricsRequest
+	keys     []string
+}
+
+func (c *recordingClient) UpdateMetrics(ctx context.Context, in *metricspb.UpdateMetricsRequest, opts ...grpc.CallOption) (*metricspb.UpdateMetricsResponse, error) {
+	c.requests = append(c.requests, in)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	c.keys = append(c.keys, md.Get(grpcapi.IdempotencyKeyMetadata)...)
+	return &metricspb.UpdateMetricsResponse{Accepted: int64(len(in.Metrics))}, nil
+}
+
+func TestSendMetricsBatchGRPC(t *testing.T) {
+	client := &recordingClient{}
+	delta := int64(3)
+	metrics := []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: func(v float64) *float64 { return &v }(42.0)},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	}
+
+	err := sendMetricsBatchGRPC(metrics, client)
+	assert.NoError(t, err)
+	assert.Len(t, client.requests, 1)
+	assert.Equal(t, 42.0, client.requests[0].Metrics[0].GetValue())
+	assert.Equal(t, int64(3), client.requests[0].Metrics[1].GetDelta())
+	assert.Len(t, client.keys, 1)
+	assert.NotEmpty(t, client.keys[0])
+
+	err = sendMetricsBatchGRPC(withMetadata(metrics), client)
+	assert.NoError(t, err)
+	assert.Equal(t, "bytes", client.requests[1].Metrics[0].GetMeta().GetUnit())
+}
+
+func TestSendMetricsBatchSetsIdempotencyKey(t *testing.T) {
+	var keys []string
+	client := &http.Client{Transport: &MockTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			keys = append(keys, req.Header.Get("Idempotency-Key"))
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		},
+	}}
+	metrics := []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: func(v float64) *float64 { return &v }(42.0)},
+	}
+
+	assert.NoError(t, sendMetricsBatch(metrics, "localhost:8080", client))
+	assert.NoError(t, sendMetricsBatch(metrics, "localhost:8080", client))
+	assert.Len(t, keys, 2)
+	assert.Len(t, keys[0], 32)
+	assert.NotEqual(t, keys[0], keys[1])
+}
+
+func TestSendMetricsBatchWithoutIdempotencyKey(t *testing.T) {
+	randRead = func([]byte) (int, error) { return 0, errors.New("entropy unavailable") }
+	t.Cleanup(func() { randRead = crand.Read })
+
+	var sent bool
+	var keys []string
+	client := &http.Client{Transport: &MockTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			sent = true
+			keys = append(keys, req.Header.Values("Idempotency-Key")...)
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		},
+	}}
+	metrics := []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: func(v float64) *float64 { return &v }(42.0)},
+	}
+
+	assert.NoError(t, sendMetricsBatch(metrics, "localhost:8080", client))
+	assert.True(t, sent)
+	assert.Empty(t, keys)
+
+	grpcClient := &recordingClient{}
+	assert.NoError(t, sendMetricsBatchGRPC(metrics, grpcClient))
+	assert.Len(t, grpcClient.requests, 1)
+	assert.Empty(t, grpcClient.keys)
+}
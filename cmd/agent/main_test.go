@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/hairutdin/metrics-service/models"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestCollectMetrics(t *testing.T) {
@@ -77,3 +80,45 @@ func TestSendMetric(t *testing.T) {
 
 	sendMetric("gauge", "Alloc", 100.0)
 }
+
+func TestEveryReportedMetricHasMetadata(t *testing.T) {
+	fields := reflect.TypeOf(RuntimeMetrics{})
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Field(i).Name
+		if metricMetadata[name].Description == "" {
+			t.Errorf("Expected a description for %s", name)
+		}
+	}
+
+	described := withMetadata([]models.Metrics{{ID: "Alloc", MType: "gauge"}})
+	if described[0].Meta == nil || described[0].Meta.Unit != "bytes" {
+		t.Errorf("Expected Alloc to be described in bytes, got %+v", described[0].Meta)
+	}
+}
+
+func TestMetadataSchedule(t *testing.T) {
+	metrics := []models.Metrics{{ID: "Alloc", MType: "gauge"}}
+	now := time.Unix(0, 0)
+	var s metadataSchedule
+
+	steps := []struct {
+		after     time.Duration
+		err       error
+		described bool
+	}{
+		{0, errors.New("server down"), true},
+		{time.Second, nil, true},
+		{time.Second, nil, false},
+		{metadataResendInterval, nil, true},
+		{time.Second, errors.New("server restarting"), false},
+		{time.Second, nil, true},
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		report, described := s.prepare(metrics, now)
+		if described != step.described || (report[0].Meta != nil) != step.described {
+			t.Errorf("Step %d: expected described=%v, got %v with meta %+v", i, step.described, described, report[0].Meta)
+		}
+		s.report(described, step.err, now)
+	}
+}
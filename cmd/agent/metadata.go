@@ -0,0 +1,86 @@
+package main
+
+import (
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+// metricMetadata describes every metric the agent reports. Descriptions of
+// the runtime gauges follow the runtime.MemStats documentation.
+var metricMetadata = map[string]models.Metadata{
+	"Alloc":         {Unit: "bytes", Description: "Bytes of allocated heap objects."},
+	"BuckHashSys":   {Unit: "bytes", Description: "Bytes of memory in profiling bucket hash tables."},
+	"Frees":         {Description: "Cumulative count of heap objects freed."},
+	"GCCPUFraction": {Unit: "ratio", Description: "Fraction of this program's available CPU time used by the GC since the program started."},
+	"GCSys":         {Unit: "bytes", Description: "Bytes of memory in garbage collection metadata."},
+	"HeapAlloc":     {Unit: "bytes", Description: "Bytes of allocated heap objects."},
+	"HeapIdle":      {Unit: "bytes", Description: "Bytes in idle (unused) heap spans."},
+	"HeapInuse":     {Unit: "bytes", Description: "Bytes in in-use heap spans."},
+	"HeapObjects":   {Description: "Number of allocated heap objects."},
+	"HeapReleased":  {Unit: "bytes", Description: "Bytes of physical memory returned to the OS."},
+	"HeapSys":       {Unit: "bytes", Description: "Bytes of heap memory obtained from the OS."},
+	"LastGC":        {Unit: "nanoseconds", Description: "Time the last garbage collection finished, as nanoseconds since the Unix epoch."},
+	"Lookups":       {Description: "Number of pointer lookups performed by the runtime."},
+	"MCacheInuse":   {Unit: "bytes", Description: "Bytes of allocated mcache structures."},
+	"MCacheSys":     {Unit: "bytes", Description: "Bytes of memory obtained from the OS for mcache structures."},
+	"MSpanInuse":    {Unit: "bytes", Description: "Bytes of allocated mspan structures."},
+	"MSpanSys":      {Unit: "bytes", Description: "Bytes of memory obtained from the OS for mspan structures."},
+	"Mallocs":       {Description: "Cumulative count of heap objects allocated."},
+	"NextGC":        {Unit: "bytes", Description: "Target heap size of the next GC cycle."},
+	"NumForcedGC":   {Description: "Number of GC cycles that were forced by the application calling the GC function."},
+	"NumGC":         {Description: "Number of completed GC cycles."},
+	"OtherSys":      {Unit: "bytes", Description: "Bytes of memory in miscellaneous off-heap runtime allocations."},
+	"PauseTotalNs":  {Unit: "nanoseconds", Description: "Cumulative nanoseconds in GC stop-the-world pauses since the program started."},
+	"StackInuse":    {Unit: "bytes", Description: "Bytes in stack spans."},
+	"StackSys":      {Unit: "bytes", Description: "Bytes of stack memory obtained from the OS."},
+	"Sys":           {Unit: "bytes", Description: "Total bytes of memory obtained from the OS."},
+	"TotalAlloc":    {Unit: "bytes", Description: "Cumulative bytes allocated for heap objects."},
+	"PollCount":     {Description: "Number of times the agent has polled runtime metrics."},
+	"RandomValue":   {Description: "Random value between 0 and 1, refreshed on every poll."},
+}
+
+// withMetadata returns a copy of metrics with the agent's descriptions
+// attached, for the server to register on ingestion.
+func withMetadata(metrics []models.Metrics) []models.Metrics {
+	described := make([]models.Metrics, len(metrics))
+	for i, m := range metrics {
+		described[i] = m
+		if md, ok := metricMetadata[m.ID]; ok {
+			described[i].Meta = &md
+		}
+	}
+	return described
+}
+
+// metadataResendInterval is how often the agent sends its descriptions again
+// after the server accepted them, so a server that lost its registry gets
+// them back.
+const metadataResendInterval = 10 * time.Minute
+
+// metadataSchedule decides which reports carry the agent's descriptions:
+// every report until one is accepted, then one every
+// metadataResendInterval. A failed report makes the next one carry them
+// again, as the server may have restarted in between.
+type metadataSchedule struct {
+	sentAt time.Time
+}
+
+// prepare returns the metrics to report at now and whether they carry
+// descriptions.
+func (s *metadataSchedule) prepare(metrics []models.Metrics, now time.Time) ([]models.Metrics, bool) {
+	if !s.sentAt.IsZero() && now.Sub(s.sentAt) < metadataResendInterval {
+		return metrics, false
+	}
+	return withMetadata(metrics), true
+}
+
+// report records the outcome of a report prepared at now.
+func (s *metadataSchedule) report(described bool, err error, now time.Time) {
+	switch {
+	case err != nil:
+		s.sentAt = time.Time{}
+	case described:
+		s.sentAt = now
+	}
+}
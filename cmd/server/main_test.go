@@ -1,17 +1,30 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/hairutdin/metrics-service/handlers"
+	"github.com/hairutdin/metrics-service/internal/alerting"
+	"github.com/hairutdin/metrics-service/internal/limits"
 	"github.com/hairutdin/metrics-service/internal/middleware"
+	"github.com/hairutdin/metrics-service/internal/recording"
+	"github.com/hairutdin/metrics-service/internal/relabel"
+	"github.com/hairutdin/metrics-service/internal/stream"
+	"github.com/hairutdin/metrics-service/internal/validation"
 	"github.com/hairutdin/metrics-service/models"
 	"github.com/hairutdin/metrics-service/storage"
 	"github.com/stretchr/testify/assert"
@@ -33,6 +46,10 @@ func testSetupRouter() *chi.Mux {
 	return r
 }
 
+func testRouterConfig() routerConfig {
+	return routerConfig{Validation: validation.DefaultPolicy()}
+}
+
 func TestUpdateMetric(t *testing.T) {
 	router := testSetupRouter()
 	metric := models.Metrics{
@@ -57,7 +74,7 @@ func TestUpdateMetric(t *testing.T) {
 func TestGetValueMetric(t *testing.T) {
 	storage := storage.NewMemStorage()
 	storage.UpdateGauge("test_metric", 12.5)
-	router := setupRouter(storage)
+	router := setupRouter(storage, stream.NewHub(16), testRouterConfig())
 
 	metric := models.Metrics{
 		ID:    "test_metric",
@@ -88,7 +105,7 @@ func TestListMetrics(t *testing.T) {
 	storage := storage.NewMemStorage()
 	storage.UpdateGauge("gauge_metric", 10.5)
 	storage.UpdateCounter("counter_metric", 5)
-	router := setupRouter(storage)
+	router := setupRouter(storage, stream.NewHub(16), testRouterConfig())
 
 	req, err := http.NewRequest("GET", "/", nil)
 	assert.NoError(t, err)
@@ -97,8 +114,10 @@ func TestListMetrics(t *testing.T) {
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "Expected status 200 OK")
-	assert.Contains(t, rr.Body.String(), "gauge_metric: gauge: 10.500000")
-	assert.Contains(t, rr.Body.String(), "counter_metric: counter: 5")
+	assert.Contains(t, rr.Body.String(), "<td>gauge_metric</td>")
+	assert.Contains(t, rr.Body.String(), `<td class="value" title="10.5">10.5</td>`)
+	assert.Contains(t, rr.Body.String(), "<td>counter_metric</td>")
+	assert.Contains(t, rr.Body.String(), `<td class="value" title="5">5</td>`)
 }
 
 func TestPingHandler(t *testing.T) {
@@ -142,3 +161,399 @@ func TestGzipCompression(t *testing.T) {
 	expectedBody := `{"message": "compressed response"}`
 	assert.Equal(t, expectedBody, string(body))
 }
+
+func TestPushgatewayAPI(t *testing.T) {
+	storage := storage.NewMemStorage()
+	router := setupRouter(storage, stream.NewHub(16), testRouterConfig())
+
+	req, err := http.NewRequest("PUT", "/metrics/job/nightly/instance/host1", bytes.NewBufferString("# TYPE processed counter\nprocessed 5\n"))
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `processed{instance="host1",job="nightly"} 5`)
+
+	req, err = http.NewRequest("DELETE", "/metrics/job/nightly/instance/host1", nil)
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	metrics, _ := storage.Snapshot()
+	assert.Empty(t, metrics)
+}
+
+func TestAdminAPI(t *testing.T) {
+	storage := storage.NewMemStorage()
+	storage.UpdateGauge("Alloc", 1)
+	storage.UpdateGauge("tmp_a", 2)
+	storage.UpdateGauge("tmp_b", 3)
+	storage.UpdateCounter("PollCount", 9)
+	router := setupRouter(storage, stream.NewHub(16), routerConfig{AdminToken: "secret", Validation: validation.DefaultPolicy()})
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("DELETE", "/api/v1/admin/metrics/gauge/Alloc", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do("DELETE", "/api/v1/admin/metrics/gauge/Alloc", "wrong", "").Code)
+
+	rr := do("POST", "/api/v1/admin/metrics/delete", "secret", `{"glob":"tmp_*"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"deleted":[{"id":"tmp_a","type":"gauge"},{"id":"tmp_b","type":"gauge"}],"count":2}`, rr.Body.String())
+
+	assert.Equal(t, http.StatusNoContent, do("POST", "/api/v1/admin/counters/PollCount/reset", "secret", "").Code)
+	assert.Equal(t, int64(0), storage.Counters()["PollCount"])
+
+	assert.Equal(t, http.StatusNoContent, do("POST", "/api/v1/admin/metrics/gauge/Alloc/rename", "secret", `{"name":"AllocBytes"}`).Code)
+	assert.Equal(t, float64(1), storage.Gauges()["AllocBytes"])
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/v1/admin/metrics/gauge/AllocBytes", "secret", "").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/api/v1/admin/metrics/gauge/AllocBytes", "secret", "").Code)
+
+	disabled := setupRouter(storage, stream.NewHub(16), testRouterConfig())
+	req, _ := http.NewRequest("POST", "/api/v1/admin/counters/PollCount/reset", nil)
+	rr = httptest.NewRecorder()
+	disabled.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestMetadataAPI(t *testing.T) {
+	storage := storage.NewMemStorage()
+	storage.UpdateGauge("HeapInuse", 2048)
+	router := setupRouter(storage, stream.NewHub(16), testRouterConfig())
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("PUT", "/api/v1/metadata/gauge/HeapInuse", `{"unit":"bytes","description":"Bytes in in-use heap spans.","owner":"runtime"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.StatusBadRequest, do("PUT", "/api/v1/metadata/histogram/HeapInuse", `{}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("PUT", "/api/v1/metadata/gauge/"+url.PathEscape(`HeapInuse{host="a"}`), `{}`).Code)
+
+	rr = do("POST", "/update/", `{"id":"PollCount","type":"counter","delta":1,"meta":{"description":"Number of polls."}}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = do("GET", "/api/v1/metadata?type=counter", "")
+	assert.JSONEq(t, `[{"name":"PollCount","type":"counter","description":"Number of polls."}]`, rr.Body.String())
+
+	rr = do("GET", "/api/v1/metrics?type=gauge", "")
+	assert.Contains(t, rr.Body.String(), `"meta":{"unit":"bytes","description":"Bytes in in-use heap spans.","owner":"runtime"}`)
+
+	rr = do("GET", "/metrics", "")
+	assert.Contains(t, rr.Body.String(), "# HELP HeapInuse Bytes in in-use heap spans.\n# TYPE HeapInuse gauge\n# UNIT HeapInuse bytes\n")
+
+	rr = do("GET", "/", "")
+	assert.Contains(t, rr.Body.String(), `<small class="description">Bytes in in-use heap spans.</small>`)
+	assert.Contains(t, rr.Body.String(), `2.0 KiB`)
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/v1/metadata/gauge/HeapInuse", "").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/v1/metadata/gauge/HeapInuse", "").Code)
+}
+
+func TestStreamEndpoint(t *testing.T) {
+	storage := storage.NewMemStorage()
+	hub := stream.NewHub(16)
+	server := httptest.NewServer(setupRouter(storage, hub, testRouterConfig()))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/v1/stream?type=gauge")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	body, err := json.Marshal([]models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: func(d int64) *int64 { return &d }(1)},
+		{ID: "Alloc", MType: "gauge", Value: func(v float64) *float64 { return &v }(3.5), Timestamp: func(ts int64) *int64 { return &ts }(1000)},
+	})
+	assert.NoError(t, err)
+	update, err := http.Post(server.URL+"/updates/", "application/json", bytes.NewBuffer(body))
+	assert.NoError(t, err)
+	update.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		if line != "\n" {
+			lines = append(lines, line)
+		}
+	}
+	assert.Equal(t, "event: update\n", lines[0])
+	assert.Equal(t, "data: {\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":3.5,\"timestamp\":1000}\n", lines[1])
+}
+
+func TestLimitsAPI(t *testing.T) {
+	storage := storage.NewMemStorage()
+	cfg := testRouterConfig()
+	cfg.Limiter = limits.NewLimiter(storage, limits.Config{MaxSeries: 1, Action: limits.ActionDrop})
+	router := setupRouter(storage, stream.NewHub(16), cfg)
+
+	req, err := http.NewRequest("POST", "/updates/", bytes.NewBufferString(`[{"id":"Alloc","type":"gauge","value":1},{"id":"Sys","type":"gauge","value":1}]`))
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	req, err = http.NewRequest("GET", "/api/v1/limits", nil)
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"max_series":1,"max_new_series_per_minute":0,"action":"drop","series":1,
+		"rejected":{"name":0,"rate_limit":0,"series_limit":1}}`, rr.Body.String())
+}
+
+func TestRelabelRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relabel.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"rules":[
+		{"action":"strip_prefix","prefix":"legacy_"},
+		{"action":"drop","match":"debug_.*"},
+		{"action":"set_label","match":"rows","label":"team","value":"data"}
+	]}`), 0o644))
+	engine, err := relabel.Load(path)
+	assert.NoError(t, err)
+
+	storage := storage.NewMemStorage()
+	cfg := testRouterConfig()
+	cfg.Relabel = engine
+	router := setupRouter(storage, stream.NewHub(16), cfg)
+
+	do := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/updates/", "", `[{"id":"debug_x","type":"gauge","value":1},{"id":"legacy_Alloc","type":"gauge","value":2},{"id":"legacy_Sys","type":"gauge"}]`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"accepted":1,"dropped":1,"rejected":[
+		{"index":2,"id":"Sys","type":"gauge","reason":"metric value is required: gauge needs \"value\""}
+	]}`, rr.Body.String())
+	assert.Equal(t, 2.0, storage.Gauges()["Alloc"])
+
+	rr = do("POST", "/update/", "", `{"id":"legacy_PollCount","type":"counter","delta":3}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int64(3), storage.Counters()["PollCount"])
+
+	rr = do("POST", "/updates/", "application/x-ndjson", "{\"id\":\"debug_y\",\"type\":\"gauge\",\"value\":1}\n{\"id\":\"legacy_Heap\",\"type\":\"gauge\",\"value\":5}\n")
+	assert.JSONEq(t, `{"accepted":1,"dropped":1,"rejected":[]}`, rr.Body.String())
+	assert.Equal(t, 5.0, storage.Gauges()["Heap"])
+
+	rr = do("PUT", "/metrics/job/backup", "", "rows 10\n")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	_, err = storage.GetMetric("gauge", `rows{job="backup",team="data"}`)
+	assert.NoError(t, err)
+
+	rr = do("POST", "/api/v1/relabel/dry-run", "", `[{"id":"legacy_debug_z","type":"gauge","value":1}]`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[{"input":{"id":"legacy_debug_z","type":"gauge","value":1},"output":null,"steps":[
+		{"rule":0,"action":"strip_prefix","id":"debug_z","type":"gauge"},
+		{"rule":1,"action":"drop","id":"debug_z","type":"gauge"}
+	]}]`, rr.Body.String())
+	_, err = storage.GetMetric("gauge", "legacy_debug_z")
+	assert.Error(t, err)
+
+	rr = do("GET", "/api/v1/relabel/rules", "", "")
+	assert.Contains(t, rr.Body.String(), `{"action":"drop","match":"debug_.*"}`)
+}
+
+func TestAlertsAPI(t *testing.T) {
+	storage := storage.NewMemStorage()
+	storage.UpdateGauge("HeapAlloc", 2e9)
+	path := filepath.Join(t.TempDir(), "alerts.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"rules":[{"name":"HighHeap","metric":"HeapAlloc","op":">","threshold":1e9}]}`), 0o644))
+	alertConfig, err := alerting.LoadConfig(path)
+	assert.NoError(t, err)
+	manager := alerting.NewManager(storage, alertConfig)
+	manager.Evaluate()
+
+	cfg := testRouterConfig()
+	cfg.Alerts = manager
+	cfg.AdminToken = "secret"
+	router := setupRouter(storage, stream.NewHub(16), cfg)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("GET", "/api/v1/alerts", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var status alerting.Status
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Len(t, status.Alerts, 1)
+	assert.Equal(t, alerting.StateFiring, status.Alerts[0].State)
+	assert.Equal(t, "HeapAlloc", status.Alerts[0].Series)
+
+	// Adding and removing silences needs the admin token.
+	req := httptest.NewRequest("POST", "/api/v1/silences", bytes.NewBufferString(`{"matchers":{"alertname":"HighHeap"}}`))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = do("POST", "/api/v1/silences", `{"matchers":{"alertname":"HighHeap"},"ends_at":"2999-01-01T00:00:00Z","comment":"known leak"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var silence alerting.Silence
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &silence))
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/v1/silences", `{"matchers":{}}`).Code)
+
+	rr = do("GET", "/api/v1/silences", "")
+	assert.Contains(t, rr.Body.String(), `"comment":"known leak"`)
+	req = httptest.NewRequest("DELETE", "/api/v1/silences/"+silence.ID, nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/v1/silences/"+silence.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/api/v1/silences/"+silence.ID, "").Code)
+}
+
+func TestQueryAPI(t *testing.T) {
+	storage := storage.NewMemStorage()
+	storage.UpdateGauge(`HeapAlloc{host="a"}`, 30)
+	storage.UpdateGauge(`HeapAlloc{host="b"}`, 50)
+	router := setupRouter(storage, stream.NewHub(16), testRouterConfig())
+
+	get := func(q string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/api/v1/query?query="+url.QueryEscape(q), nil)
+		assert.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get(`sum(HeapAlloc) / 1024`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"result_type":"vector","result":[{"metric":{},"value":0.078125}]}`, rr.Body.String())
+
+	rr = get(`max(HeapAlloc) by (host) - 10`)
+	assert.JSONEq(t, `{"result_type":"vector","result":[
+		{"metric":{"host":"a"},"value":20},{"metric":{"host":"b"},"value":40}]}`, rr.Body.String())
+
+	rr = get(`2 * 3`)
+	assert.JSONEq(t, `{"result_type":"scalar","result":6}`, rr.Body.String())
+
+	rr = get(`sum(HeapAlloc`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "parse error")
+	assert.Equal(t, http.StatusBadRequest, get("").Code)
+}
+
+func TestRecordingRulesAPI(t *testing.T) {
+	storage := storage.NewMemStorage()
+	storage.UpdateGauge(`HeapAlloc{host="a"}`, 1)
+	storage.UpdateGauge(`HeapAlloc{host="b"}`, 2)
+	path := filepath.Join(t.TempDir(), "rules.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"rules":[{"record":"cluster:heap_alloc:sum","expr":"sum(HeapAlloc)"}]}`), 0o644))
+	recordingConfig, err := recording.LoadConfig(path)
+	assert.NoError(t, err)
+	manager := recording.NewManager(storage, recordingConfig)
+	manager.Evaluate()
+
+	cfg := testRouterConfig()
+	cfg.Recording = manager
+	router := setupRouter(storage, stream.NewHub(16), cfg)
+
+	req, err := http.NewRequest("GET", "/api/v1/recording/rules", nil)
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var status []recording.RuleStatus
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Len(t, status, 1)
+	assert.Equal(t, "cluster:heap_alloc:sum", status[0].Record)
+	assert.Equal(t, recording.HealthOK, status[0].Health)
+	assert.Equal(t, 1, status[0].Series)
+
+	req, err = http.NewRequest("GET", "/api/v1/query?query=cluster:heap_alloc:sum", nil)
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.JSONEq(t, `{"result_type":"vector","result":[{"metric":{"__name__":"cluster:heap_alloc:sum"},"value":3}]}`, rr.Body.String())
+}
+
+func TestRangeAPI(t *testing.T) {
+	policy, err := storage.ParseRetentionPolicy("raw=1h,1m=1d")
+	assert.NoError(t, err)
+	storage := storage.NewMemStorage()
+	now := time.Now()
+	start := now.Truncate(time.Minute)
+	for _, p := range []struct {
+		at    time.Time
+		value float64
+	}{
+		{start.Add(-90 * time.Minute), 10},
+		{start.Add(-90*time.Minute + 10*time.Second), 20},
+		{start.Add(-10 * time.Minute), 30},
+	} {
+		ts, value := p.at.UnixMilli(), p.value
+		assert.NoError(t, storage.UpdateMetricsBatch([]models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value, Timestamp: &ts}}))
+	}
+	_, err = storage.Compact(policy, now)
+	assert.NoError(t, err)
+
+	cfg := testRouterConfig()
+	cfg.Retention = policy
+	router := setupRouter(storage, stream.NewHub(16), cfg)
+	from := strconv.FormatInt(now.Add(-2*time.Hour).UnixMilli(), 10)
+
+	req, err := http.NewRequest("GET", "/api/v1/range?type=gauge&id=Alloc&from="+from, nil)
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"id":"Alloc","type":"gauge","resolution":"1m","points":[
+		{"t":%d,"min":10,"max":20,"avg":15,"count":2},
+		{"t":%d,"min":30,"max":30,"avg":30,"count":1}]}`,
+		start.Add(-90*time.Minute).UnixMilli(), start.Add(-10*time.Minute).UnixMilli()), rr.Body.String())
+
+	req, err = http.NewRequest("GET", "/api/v1/range?type=gauge&id=Alloc&resolution=raw&from="+from, nil)
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.JSONEq(t, fmt.Sprintf(`{"id":"Alloc","type":"gauge","resolution":"raw","points":[
+		{"t":%d,"min":30,"max":30,"avg":30,"count":1}]}`, start.Add(-10*time.Minute).UnixMilli()), rr.Body.String(),
+		"raw samples older than their retention are gone")
+
+	for _, query := range []string{
+		"type=gauge&id=Alloc&resolution=5m",
+		"type=summary&id=Alloc",
+		"type=gauge",
+		"type=gauge&id=Alloc&from=yesterday",
+	} {
+		req, err := http.NewRequest("GET", "/api/v1/range?"+query, nil)
+		assert.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
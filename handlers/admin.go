@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+)
+
+type deletePatternRequest struct {
+	Type  string `json:"type,omitempty"`
+	Glob  string `json:"glob,omitempty"`
+	Regex string `json:"regex,omitempty"`
+}
+
+type deletePatternResponse struct {
+	Deleted []models.Metrics `json:"deleted"`
+	Count   int              `json:"count"`
+}
+
+type renameRequest struct {
+	Name string `json:"name"`
+}
+
+// HandleAdminDelete handles DELETE /api/v1/admin/metrics/{type}/{name}.
+func (h *MetricsHandler) HandleAdminDelete(w http.ResponseWriter, r *http.Request) {
+	metricType, name, ok := metricPath(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.storage.DeleteMetric(metricType, name)
+	if errors.Is(err, storage.ErrMetricNotFound) {
+		http.Error(w, "Metric not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete metric", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAdminDeletePattern handles POST /api/v1/admin/metrics/delete. The
+// body selects metrics by either a shell glob or a regular expression over
+// the whole ID, optionally restricted to one type.
+func (h *MetricsHandler) HandleAdminDeletePattern(w http.ResponseWriter, r *http.Request) {
+	var req deletePatternRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	if req.Type != "" && req.Type != "gauge" && req.Type != "counter" {
+		http.Error(w, "Invalid metric type", http.StatusBadRequest)
+		return
+	}
+
+	var pattern string
+	switch {
+	case req.Glob != "" && req.Regex == "":
+		pattern = globToRegex(req.Glob)
+	case req.Regex != "" && req.Glob == "":
+		pattern = "^(?:" + req.Regex + ")$"
+	default:
+		http.Error(w, "Exactly one of glob and regex is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		http.Error(w, "Invalid pattern: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := h.storage.DeleteMatching(req.Type, pattern)
+	if err != nil {
+		http.Error(w, "Failed to delete metrics", http.StatusInternalServerError)
+		return
+	}
+	if deleted == nil {
+		deleted = []models.Metrics{}
+	}
+
+	body, _ := json.Marshal(deletePatternResponse{Deleted: deleted, Count: len(deleted)})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// HandleAdminResetCounter handles POST /api/v1/admin/counters/{name}/reset.
+func (h *MetricsHandler) HandleAdminResetCounter(w http.ResponseWriter, r *http.Request) {
+	name, err := urlParam(r, "name")
+	if err != nil {
+		http.Error(w, "Invalid metric name", http.StatusBadRequest)
+		return
+	}
+
+	err = h.storage.ResetCounter(name)
+	if errors.Is(err, storage.ErrMetricNotFound) {
+		http.Error(w, "Metric not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reset counter", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAdminRename handles POST /api/v1/admin/metrics/{type}/{name}/rename
+// with a {"name": "<new name>"} body.
+func (h *MetricsHandler) HandleAdminRename(w http.ResponseWriter, r *http.Request) {
+	metricType, name, ok := metricPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req renameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, "New name is required", http.StatusBadRequest)
+		return
+	}
+
+	err := h.storage.RenameMetric(metricType, name, req.Name)
+	switch {
+	case errors.Is(err, storage.ErrMetricNotFound):
+		http.Error(w, "Metric not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrMetricExists):
+		http.Error(w, "Target metric already exists", http.StatusConflict)
+	case err != nil:
+		http.Error(w, "Failed to rename metric", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// metricPath reads the {type} and {name} URL parameters, writing a 400
+// response if they are invalid.
+func metricPath(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	metricType := chi.URLParam(r, "type")
+	if metricType != "gauge" && metricType != "counter" {
+		http.Error(w, "Invalid metric type", http.StatusBadRequest)
+		return "", "", false
+	}
+	name, err := urlParam(r, "name")
+	if err != nil || name == "" {
+		http.Error(w, "Invalid metric name", http.StatusBadRequest)
+		return "", "", false
+	}
+	return metricType, name, true
+}
+
+// urlParam returns a decoded URL parameter. chi matches against the escaped
+// path when the request has one, so labelled IDs may arrive percent-encoded.
+func urlParam(r *http.Request, key string) (string, error) {
+	value := chi.URLParam(r, key)
+	if r.URL.RawPath == "" {
+		return value, nil
+	}
+	return url.PathUnescape(value)
+}
+
+// globToRegex translates a shell glob (*, ? and [...] classes) into an
+// anchored regular expression.
+func globToRegex(glob string) string {
+	runes := []rune(glob)
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := -1
+			for j := i + 1; j < len(runes); j++ {
+				if runes[j] == ']' {
+					end = j
+					break
+				}
+			}
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := string(runes[i+1 : end])
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
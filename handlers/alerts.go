@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hairutdin/metrics-service/internal/alerting"
+)
+
+// SetAlertManager exposes the state and silences of an alert manager.
+func (h *MetricsHandler) SetAlertManager(m *alerting.Manager) {
+	h.alerts = m
+}
+
+// HandleAlerts handles GET /api/v1/alerts with the alerting rules and the
+// pending, firing and recently resolved alerts.
+func (h *MetricsHandler) HandleAlerts(w http.ResponseWriter, r *http.Request) {
+	if h.alerts == nil {
+		writeJSON(w, http.StatusOK, alerting.Status{Alerts: []alerting.Alert{}, Rules: []alerting.Rule{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, h.alerts.Status())
+}
+
+// HandleListSilences handles GET /api/v1/silences.
+func (h *MetricsHandler) HandleListSilences(w http.ResponseWriter, r *http.Request) {
+	if h.alerts == nil {
+		writeJSON(w, http.StatusOK, []alerting.Silence{})
+		return
+	}
+	writeJSON(w, http.StatusOK, h.alerts.Silences())
+}
+
+// HandleAddSilence handles POST /api/v1/silences and answers with the
+// created silence.
+func (h *MetricsHandler) HandleAddSilence(w http.ResponseWriter, r *http.Request) {
+	if h.alerts == nil {
+		http.Error(w, "Alerting is not configured", http.StatusNotFound)
+		return
+	}
+
+	var s alerting.Silence
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	s, err := h.alerts.AddSilence(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, s)
+}
+
+// HandleDeleteSilence handles DELETE /api/v1/silences/{id}.
+func (h *MetricsHandler) HandleDeleteSilence(w http.ResponseWriter, r *http.Request) {
+	if h.alerts == nil {
+		http.Error(w, "Alerting is not configured", http.StatusNotFound)
+		return
+	}
+
+	err := h.alerts.DeleteSilence(chi.URLParam(r, "id"))
+	if errors.Is(err, alerting.ErrSilenceNotFound) {
+		http.Error(w, "Silence not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete silence", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+//go:embed templates/dashboard.html
+var dashboardHTML string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+// RecentValues supplies the last few values of a series for the dashboard's
+// sparklines. stream.Hub implements it when KeepRecent is enabled.
+type RecentValues interface {
+	Recent(metricType, id string) []float64
+}
+
+// byteGauges are the runtime.MemStats fields the agent reports that are
+// measured in bytes.
+var byteGauges = map[string]bool{
+	"Alloc": true, "TotalAlloc": true, "Sys": true,
+	"HeapAlloc": true, "HeapSys": true, "HeapIdle": true, "HeapInuse": true, "HeapReleased": true,
+	"StackInuse": true, "StackSys": true, "MSpanInuse": true, "MSpanSys": true,
+	"MCacheInuse": true, "MCacheSys": true, "BuckHashSys": true, "GCSys": true, "OtherSys": true,
+	"NextGC": true, "TotalMemory": true, "FreeMemory": true,
+}
+
+const (
+	sparklineWidth  = 100
+	sparklineHeight = 20
+)
+
+type dashboardData struct {
+	Query   string
+	Sort    string
+	Order   string
+	Refresh int
+	Total   int
+	Groups  []dashboardGroup
+}
+
+type dashboardGroup struct {
+	Type string
+	Rows []dashboardRow
+}
+
+type dashboardRow struct {
+	ID          string
+	Type        string
+	Value       string
+	Raw         string
+	Bytes       bool
+	Sparkline   string // SVG polyline points, empty without recent values
+	Unit        string
+	Description string
+	Stale       bool
+}
+
+// SetRecentValues enables sparklines on the dashboard.
+func (h *MetricsHandler) SetRecentValues(r RecentValues) {
+	h.recent = r
+}
+
+// HandleListMetrics handles GET requests to the HTML dashboard listing all
+// known metrics grouped by type. Query parameters: q (case-insensitive
+// substring filter), sort (name or value), order (asc or desc) and refresh
+// (reload interval in seconds for browsers without server-sent events).
+func (h *MetricsHandler) HandleListMetrics(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	data := dashboardData{
+		Query: params.Get("q"),
+		Sort:  params.Get("sort"),
+		Order: params.Get("order"),
+	}
+	if data.Sort != "value" {
+		data.Sort = "name"
+	}
+	if data.Order != "desc" {
+		data.Order = "asc"
+	}
+	if refresh, err := strconv.Atoi(params.Get("refresh")); err == nil && refresh > 0 {
+		data.Refresh = refresh
+	}
+
+	metrics, err := h.storage.Snapshot()
+	if err != nil {
+		http.Error(w, "Failed to load metrics", http.StatusInternalServerError)
+		return
+	}
+	h.attachMetadata(metrics)
+	h.markStale(metrics)
+
+	query := strings.ToLower(data.Query)
+	groups := map[string][]models.Metrics{}
+	for _, m := range metrics {
+		if query != "" && !strings.Contains(strings.ToLower(m.ID), query) {
+			continue
+		}
+		groups[m.MType] = append(groups[m.MType], m)
+		data.Total++
+	}
+
+	for _, mtype := range []string{"gauge", "counter"} {
+		group := groups[mtype]
+		if len(group) == 0 {
+			continue
+		}
+		sortDashboard(group, data.Sort, data.Order == "desc")
+
+		rows := make([]dashboardRow, 0, len(group))
+		for _, m := range group {
+			rows = append(rows, h.dashboardRow(m))
+		}
+		data.Groups = append(data.Groups, dashboardGroup{Type: mtype, Rows: rows})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		fmt.Printf("Error rendering dashboard: %v\n", err)
+	}
+}
+
+func (h *MetricsHandler) dashboardRow(m models.Metrics) dashboardRow {
+	row := dashboardRow{ID: m.ID, Type: m.MType, Stale: m.Stale}
+	if m.Meta != nil {
+		row.Unit = m.Meta.Unit
+		row.Description = m.Meta.Description
+	}
+	switch {
+	case m.Value != nil:
+		row.Raw = strconv.FormatFloat(*m.Value, 'f', -1, 64)
+		row.Value = row.Raw
+		if row.Unit == "bytes" || isByteMetric(m.ID) {
+			row.Bytes = true
+			row.Value = humanBytes(*m.Value)
+		}
+	case m.Delta != nil:
+		row.Raw = strconv.FormatInt(*m.Delta, 10)
+		row.Value = row.Raw
+	}
+	if h.recent != nil {
+		row.Sparkline = sparklinePoints(h.recent.Recent(m.MType, m.ID))
+	}
+	return row
+}
+
+func sortDashboard(metrics []models.Metrics, by string, desc bool) {
+	sort.SliceStable(metrics, func(i, j int) bool {
+		a, b := metrics[i], metrics[j]
+		if desc {
+			a, b = b, a
+		}
+		if by == "value" {
+			av, bv := sortValue(a), sortValue(b)
+			if av != bv {
+				return av < bv
+			}
+		}
+		return a.ID < b.ID
+	})
+}
+
+func sortValue(m models.Metrics) float64 {
+	if m.Delta != nil {
+		return float64(*m.Delta)
+	}
+	if m.Value != nil && !math.IsNaN(*m.Value) {
+		return *m.Value
+	}
+	return math.Inf(-1)
+}
+
+func isByteMetric(id string) bool {
+	name, _, err := models.ParseSeriesID(id)
+	if err != nil {
+		name = id
+	}
+	return byteGauges[name] || strings.HasSuffix(name, "_bytes") || strings.HasSuffix(name, "Bytes")
+}
+
+// humanBytes formats a byte count with binary units, e.g. 1536 -> "1.5 KiB".
+func humanBytes(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	abs := math.Abs(v)
+	i := 0
+	for abs >= 1024 && i < len(units)-1 {
+		abs /= 1024
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return strconv.FormatFloat(v, 'f', -1, 64) + " B"
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64) + " " + units[i]
+}
+
+// sparklinePoints scales values into the sparkline box and returns them as
+// an SVG polyline points list. Fewer than two values draw nothing.
+func sparklinePoints(values []float64) string {
+	var finite []float64
+	for _, v := range values {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			finite = append(finite, v)
+		}
+	}
+	if len(finite) < 2 {
+		return ""
+	}
+
+	lo, hi := finite[0], finite[0]
+	for _, v := range finite {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+
+	points := make([]string, len(finite))
+	step := float64(sparklineWidth) / float64(len(finite)-1)
+	for i, v := range finite {
+		y := float64(sparklineHeight) / 2
+		if hi > lo {
+			y = sparklineHeight - (v-lo)/(hi-lo)*sparklineHeight
+		}
+		points[i] = strconv.FormatFloat(float64(i)*step, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64)
+	}
+	return strings.Join(points, " ")
+}
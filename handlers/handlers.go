@@ -2,20 +2,64 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/hairutdin/metrics-service/internal/alerting"
+	"github.com/hairutdin/metrics-service/internal/limits"
+	"github.com/hairutdin/metrics-service/internal/otlp"
+	"github.com/hairutdin/metrics-service/internal/pushgateway"
+	"github.com/hairutdin/metrics-service/internal/recording"
+	"github.com/hairutdin/metrics-service/internal/relabel"
+	"github.com/hairutdin/metrics-service/internal/validation"
 	"github.com/hairutdin/metrics-service/models"
 	"github.com/hairutdin/metrics-service/storage"
 )
 
 type MetricsHandler struct {
-	storage storage.MetricsStorage
+	storage         storage.MetricsStorage
+	otlp            *otlp.Converter
+	push            *pushgateway.Service
+	recent          RecentValues
+	validation      validation.Policy
+	idempotencyTTL  time.Duration
+	ndjsonChunkSize int
+	staleAfter      time.Duration
+	limiter         *limits.Limiter
+	relabel         *relabel.Engine
+	alerts          *alerting.Manager
+	recording       *recording.Manager
+	retention       storage.RetentionPolicy
 }
 
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// maxIdempotencyKeyLength keeps keys from becoming a storage burden.
+	maxIdempotencyKeyLength = 255
+)
+
 func NewMetricsHandler(s storage.MetricsStorage) *MetricsHandler {
-	return &MetricsHandler{storage: s}
+	return &MetricsHandler{
+		storage:         s,
+		otlp:            otlp.NewConverter(s),
+		push:            pushgateway.NewService(s),
+		validation:      validation.DefaultPolicy(),
+		idempotencyTTL:  storage.DefaultIdempotencyTTL,
+		ndjsonChunkSize: DefaultNDJSONChunkSize,
+		retention:       storage.DefaultRetentionPolicy(),
+	}
+}
+
+// SetIdempotencyTTL sets how long batch idempotency keys are remembered.
+func (h *MetricsHandler) SetIdempotencyTTL(ttl time.Duration) {
+	h.idempotencyTTL = ttl
+}
+
+// SetValidationPolicy replaces the default policy applied to updates.
+func (h *MetricsHandler) SetValidationPolicy(p validation.Policy) {
+	h.validation = p
+	h.push.SetValidationPolicy(p)
 }
 
 // HandleUpdateJSON handles POST requests to update metrics in JSON format
@@ -27,39 +71,172 @@ func (h *MetricsHandler) HandleUpdateJSON(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	metric, keep := h.relabel.Apply(metric)
+	if !keep {
+		return
+	}
+
+	if err := h.validation.Check(metric); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d, err := h.limit(r, []models.Metrics{metric})
+	if err != nil {
+		http.Error(w, "Failed to update metric", http.StatusInternalServerError)
+		return
+	}
+	if len(d.Admitted) == 0 {
+		status := http.StatusBadRequest
+		if d.OverLimit() {
+			status = http.StatusTooManyRequests
+			setRetryAfter(w, d)
+		}
+		http.Error(w, d.Reason(), status)
+		return
+	}
+
+	// Only the batch path carries timestamps and inline metadata; storage
+	// needs the former to keep an older sample from overwriting a newer
+	// gauge.
+	if metric.Timestamp != nil || metric.Meta != nil {
+		if err := h.storage.UpdateMetricsBatch([]models.Metrics{metric}); err != nil {
+			http.Error(w, "Failed to update metric", http.StatusInternalServerError)
+		}
+		return
+	}
+
 	switch metric.MType {
 	case "gauge":
-		if metric.Value == nil {
-			http.Error(w, "Gauge value is required", http.StatusBadRequest)
-			return
-		}
 		h.storage.UpdateGauge(metric.ID, *metric.Value)
 	case "counter":
-		if metric.Delta == nil {
-			http.Error(w, "Invalid metric type", http.StatusBadRequest)
-			return
-		}
-	default:
-		http.Error(w, "Invalid metric type", http.StatusBadRequest)
-		return
+		h.storage.UpdateCounter(metric.ID, *metric.Delta)
 	}
 }
 
+type batchUpdateResponse struct {
+	Accepted int                    `json:"accepted"`
+	Rejected []validation.Rejection `json:"rejected"`
+	// Dropped counts metrics discarded by relabel rules.
+	Dropped int `json:"dropped,omitempty"`
+	// Error describes why a streamed batch stopped early.
+	Error string `json:"error,omitempty"`
+}
+
+// HandleBatchUpdate applies the valid items of a batch and reports the
+// rejected ones with their reasons. The response is 200 when anything was
+// applied and 422 when nothing was, which under a strict policy (or with
+// ?strict=true) happens as soon as one item is invalid.
+//
+// A batch sent with an Idempotency-Key header is applied at most once per
+// key; replays get the same response with an Idempotent-Replayed header.
+// Bodies of type application/x-ndjson are streamed, see handleNDJSONBatch.
 func (h *MetricsHandler) HandleBatchUpdate(w http.ResponseWriter, r *http.Request) {
 	var metricsList []models.Metrics
 
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, "Idempotency key too long", http.StatusBadRequest)
+		return
+	}
+
+	policy := h.validation
+	if strict := r.URL.Query().Get("strict"); strict != "" {
+		v, err := strconv.ParseBool(strict)
+		if err != nil {
+			http.Error(w, "Invalid strict parameter", http.StatusBadRequest)
+			return
+		}
+		policy.Strict = v
+	}
+
+	if isNDJSON(r.Header.Get("Content-Type")) {
+		h.handleNDJSONBatch(w, r, policy, key)
+		return
+	}
+
 	if err := json.NewDecoder(r.Body).Decode(&metricsList); err != nil {
 		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
 		return
 	}
 
-	err := h.storage.UpdateMetricsBatch(metricsList)
+	relabeled, origins := h.relabelAll(metricsList)
+	dropped := len(metricsList) - len(relabeled)
+	accepted, rejected := policy.Split(relabeled)
+
+	// Split keeps the order of accepted metrics, so their positions in the
+	// request are those of the relabeled metrics it did not reject.
+	positions := make([]int, 0, len(accepted))
+	for i, next := 0, 0; i < len(relabeled) && len(positions) < len(accepted); i++ {
+		if next < len(rejected) && rejected[next].Index == i {
+			next++
+			continue
+		}
+		positions = append(positions, origins[i])
+	}
+	for i := range rejected {
+		rejected[i].Index = origins[rejected[i].Index]
+	}
+
+	d, err := h.limit(r, accepted)
 	if err != nil {
 		http.Error(w, "Failed to update metrics", http.StatusInternalServerError)
 		return
 	}
+	accepted = d.Admitted
+	rejected = append(rejected, limitRejections(d, func(i int) validation.Rejection {
+		return validation.Rejection{Index: positions[i]}
+	})...)
+	sortRejections(rejected)
+	if d.Throttled {
+		setRetryAfter(w, d)
+		writeBatchResponse(w, http.StatusTooManyRequests, batchUpdateResponse{
+			Rejected: rejected, Dropped: dropped, Error: "series limits exceeded, nothing was stored",
+		})
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
+	if len(accepted) > 0 {
+		replayed, err := h.applyBatch(key, accepted)
+		if err != nil {
+			http.Error(w, "Failed to update metrics", http.StatusInternalServerError)
+			return
+		}
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+	}
+
+	status := http.StatusOK
+	switch {
+	case len(accepted) > 0 || len(rejected) == 0:
+	case d.OverLimit():
+		status = http.StatusTooManyRequests
+		setRetryAfter(w, d)
+	default:
+		status = http.StatusUnprocessableEntity
+	}
+	writeBatchResponse(w, status, batchUpdateResponse{Accepted: len(accepted), Rejected: rejected, Dropped: dropped})
+}
+
+// applyBatch stores metrics, at most once per key when key is set, and
+// reports whether the batch had already been applied before.
+func (h *MetricsHandler) applyBatch(key string, metrics []models.Metrics) (bool, error) {
+	if key == "" {
+		return false, h.storage.UpdateMetricsBatch(metrics)
+	}
+	applied, err := h.storage.UpdateMetricsBatchOnce(key, metrics, h.idempotencyTTL)
+	return err == nil && !applied, err
+}
+
+func writeBatchResponse(w http.ResponseWriter, status int, resp batchUpdateResponse) {
+	if resp.Rejected == nil {
+		resp.Rejected = []validation.Rejection{}
+	}
+	response, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
 }
 
 func (h *MetricsHandler) HandleGetValueJSON(w http.ResponseWriter, r *http.Request) {
@@ -99,19 +276,58 @@ func (h *MetricsHandler) HandleGetValueJSON(w http.ResponseWriter, r *http.Reque
 	w.Write(response)
 }
 
-// HandleListMetrics handles GET requests to list all known metrics in HTML format.
-func (h *MetricsHandler) HandleListMetrics(w http.ResponseWriter, r *http.Request) {
-	metrics := h.storage.GetAllMetrics()
+type valuesResponse struct {
+	Metrics []models.Metrics `json:"metrics"`
+	Missing []models.Metrics `json:"missing"`
+}
 
-	w.Header().Set("Content-Type", "text/html")
-	html := "<html><body><h1>Metrics</h1><ul>"
-	for name, value := range metrics {
-		html += fmt.Sprintf("<li>%s: %v</li>", name, value)
+// HandleGetValuesJSON handles POST /values/ with an array of {id, type}
+// pairs and returns the values of those that exist plus the ones missing,
+// using a single storage lookup.
+func (h *MetricsHandler) HandleGetValuesJSON(w http.ResponseWriter, r *http.Request) {
+	var keys []models.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
 	}
-	html += "</ul></body></html>"
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(html))
+	type key struct{ id, mtype string }
+	seen := make(map[key]bool, len(keys))
+	unique := make([]models.Metrics, 0, len(keys))
+	for _, k := range keys {
+		if k.MType != "gauge" && k.MType != "counter" {
+			http.Error(w, "Invalid metric type", http.StatusBadRequest)
+			return
+		}
+		if seen[key{k.ID, k.MType}] {
+			continue
+		}
+		seen[key{k.ID, k.MType}] = true
+		unique = append(unique, models.Metrics{ID: k.ID, MType: k.MType})
+	}
+
+	found, err := h.storage.GetMetrics(unique)
+	if err != nil {
+		http.Error(w, "Failed to get metrics", http.StatusInternalServerError)
+		return
+	}
+
+	h.markStale(found)
+	resp := valuesResponse{Metrics: found, Missing: []models.Metrics{}}
+	if resp.Metrics == nil {
+		resp.Metrics = []models.Metrics{}
+	}
+	hit := make(map[key]bool, len(found))
+	for _, m := range found {
+		hit[key{m.ID, m.MType}] = true
+	}
+	for _, k := range unique {
+		if !hit[key{k.ID, k.MType}] {
+			resp.Missing = append(resp.Missing, k)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
 }
 
 type PingDBFunc func() error
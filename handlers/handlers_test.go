@@ -4,14 +4,28 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/golang/snappy"
+	"github.com/hairutdin/metrics-service/internal/limits"
+	"github.com/hairutdin/metrics-service/internal/relabel"
+	"github.com/hairutdin/metrics-service/internal/remotewrite"
+	"github.com/hairutdin/metrics-service/internal/validation"
 	"github.com/hairutdin/metrics-service/models"
 	"github.com/hairutdin/metrics-service/storage"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 func TestPingHandlerSuccess(t *testing.T) {
@@ -86,7 +100,7 @@ func TestHandleUpdateJSON(t *testing.T) {
 		t.Errorf("Expected status %v, got %v", http.StatusOK, status)
 	}
 
-	if val, ok := memStorage.Gauges["test_metric"]; !ok || val != 10.5 {
+	if val, ok := memStorage.Gauges()["test_metric"]; !ok || val != 10.5 {
 		t.Errorf("Expected gauge value 10.5, got %v", val)
 	}
 }
@@ -138,23 +152,58 @@ func TestHandleListMetrics(t *testing.T) {
 	metricsHandler := NewMetricsHandler(memStorage)
 
 	memStorage.UpdateGauge("test_gauge", 5.0)
+	memStorage.UpdateGauge("HeapAlloc", 3*1024*1024)
+	memStorage.UpdateGauge("<script>alert(1)</script>", 1)
 	memStorage.UpdateCounter("test_counter", 15)
 
-	req, err := http.NewRequest("GET", "/metrics", nil)
+	req, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 	rr := httptest.NewRecorder()
 	metricsHandler.HandleListMetrics(rr, req)
 
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("Expected status %v, got %v", http.StatusOK, status)
-	}
+	assert.Equal(t, http.StatusOK, rr.Code)
+	body := rr.Body.String()
+	assert.NotContains(t, body, "<script>alert(1)</script>")
+	assert.Contains(t, body, "&lt;script&gt;alert(1)&lt;/script&gt;")
+	assert.Contains(t, body, `<td class="value" title="3145728">3.0 MiB</td>`)
+	assert.Contains(t, body, `<td class="value" title="15">15</td>`)
+	assert.Less(t, strings.Index(body, "<h2>gauge</h2>"), strings.Index(body, "test_gauge"))
+	assert.Less(t, strings.Index(body, "test_gauge"), strings.Index(body, "<h2>counter</h2>"))
+	assert.Less(t, strings.Index(body, "<h2>counter</h2>"), strings.Index(body, "test_counter"))
+}
 
-	expected := "<html><body><h1>Metrics</h1><ul><li>test_gauge: gauge: 5.000000</li><li>test_counter: counter: 15</li></ul></body></html>"
-	if rr.Body.String() != expected {
-		t.Errorf("Expected body %v, got %v", expected, rr.Body.String())
-	}
+type fakeRecent map[string][]float64
+
+func (f fakeRecent) Recent(metricType, id string) []float64 {
+	return f[metricType+"/"+id]
+}
+
+func TestHandleListMetricsSearchSortSparkline(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	metricsHandler := NewMetricsHandler(memStorage)
+	metricsHandler.SetRecentValues(fakeRecent{"gauge/HeapIdle": {1, 3, 2}})
+
+	memStorage.UpdateGauge("HeapIdle", 2)
+	memStorage.UpdateGauge("HeapInuse", 9)
+	memStorage.UpdateGauge("Alloc", 5)
+
+	req := httptest.NewRequest("GET", "/?q=heap&sort=value&order=desc", nil)
+	rr := httptest.NewRecorder()
+	metricsHandler.HandleListMetrics(rr, req)
+
+	body := rr.Body.String()
+	assert.NotContains(t, body, "<td>Alloc</td>")
+	assert.Less(t, strings.Index(body, "<td>HeapInuse</td>"), strings.Index(body, "<td>HeapIdle</td>"))
+	assert.Contains(t, body, `<polyline points="0.0,20.0 50.0,0.0 100.0,10.0"/>`)
+	assert.Contains(t, body, `var pageQuery = "heap"`, "live updates only reload for metrics matching the query")
+}
+
+func TestHumanBytes(t *testing.T) {
+	assert.Equal(t, "512 B", humanBytes(512))
+	assert.Equal(t, "1.5 KiB", humanBytes(1536))
+	assert.Equal(t, "2.0 GiB", humanBytes(2*1024*1024*1024))
 }
 
 func TestUpdateMetricsBatchHandler(t *testing.T) {
@@ -186,3 +235,586 @@ func TestUpdateMetricsBatchHandler(t *testing.T) {
 	assert.Equal(t, "52.500000", gaugeValue)
 	assert.Equal(t, "20", counterValue)
 }
+
+func TestHandleOTLPMetricsJSON(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+
+	body := `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[
+		{"name":"queue.depth","gauge":{"dataPoints":[{"asDouble":4.5}]}},
+		{"name":"jobs.done","sum":{"isMonotonic":true,"aggregationTemporality":1,"dataPoints":[{"asInt":"7"}]}}
+	]}]}]}`
+
+	req, err := http.NewRequest("POST", "/v1/metrics", bytes.NewBufferString(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler.HandleOTLPMetrics(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	gaugeValue, _ := memStorage.GetMetric("gauge", "queue_depth")
+	counterValue, _ := memStorage.GetMetric("counter", "jobs_done")
+	assert.Equal(t, "4.500000", gaugeValue)
+	assert.Equal(t, "7", counterValue)
+}
+
+func TestHandleOTLPMetricsRejectsNonFinite(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+
+	body := `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[
+		{"name":"ratio","gauge":{"dataPoints":[{"asDouble":"Infinity"}]}},
+		{"name":"queue.depth","gauge":{"dataPoints":[{"asDouble":4.5}]}}
+	]}]}]}`
+
+	req, err := http.NewRequest("POST", "/v1/metrics", bytes.NewBufferString(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler.HandleOTLPMetrics(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"rejectedDataPoints":"1"`)
+	_, err = memStorage.GetMetric("gauge", "ratio")
+	assert.Error(t, err)
+	gaugeValue, _ := memStorage.GetMetric("gauge", "queue_depth")
+	assert.Equal(t, "4.500000", gaugeValue)
+}
+
+func TestHandleRemoteWriteRequiresSnappy(t *testing.T) {
+	handler := NewMetricsHandler(storage.NewMemStorage())
+
+	req, err := http.NewRequest("POST", "/api/v1/write", bytes.NewBufferString("payload"))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	rr := httptest.NewRecorder()
+	handler.HandleRemoteWrite(rr, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+
+	req.Header.Set("Content-Encoding", "snappy")
+	rr = httptest.NewRecorder()
+	handler.HandleRemoteWrite(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestHandleListMetricsJSON(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+	memStorage.UpdateGauge("b_gauge", 2)
+	memStorage.UpdateGauge("a_gauge", 1)
+	memStorage.UpdateCounter("c_counter", 3)
+
+	req, err := http.NewRequest("GET", "/api/v1/metrics?type=gauge&limit=1", nil)
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	handler.HandleListMetricsJSON(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp struct {
+		Metrics    []models.Metrics `json:"metrics"`
+		Total      int              `json:"total"`
+		NextCursor string           `json:"next_cursor"`
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, 2, resp.Total)
+	assert.Len(t, resp.Metrics, 1)
+	assert.Equal(t, "a_gauge", resp.Metrics[0].ID)
+	assert.NotEmpty(t, resp.NextCursor)
+
+	req, err = http.NewRequest("GET", "/api/v1/metrics?sort=weight", nil)
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	handler.HandleListMetricsJSON(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestListNonFiniteGauges(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+	memStorage.UpdateGauge("ratio", math.NaN())
+	memStorage.UpdateGauge("ceiling", math.Inf(1))
+
+	rr := httptest.NewRecorder()
+	handler.HandleListMetricsJSON(rr, httptest.NewRequest("GET", "/api/v1/metrics", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp struct {
+		Metrics []models.Metrics `json:"metrics"`
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	if assert.Len(t, resp.Metrics, 2) {
+		assert.Equal(t, math.Inf(1), *resp.Metrics[0].Value)
+		assert.True(t, math.IsNaN(*resp.Metrics[1].Value))
+	}
+
+}
+
+func TestGlobToRegex(t *testing.T) {
+	cases := map[string]string{
+		"Heap*":    `^Heap.*$`,
+		"gc?.rate": `^gc.\.rate$`,
+		"[!a]x":    `^[^a]x$`,
+		"a[b":      `^a\[b$`,
+	}
+	for glob, expected := range cases {
+		assert.Equal(t, expected, globToRegex(glob), glob)
+	}
+}
+
+func TestHandleGetValuesJSON(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+	value, delta, ts := 1.5, int64(3), int64(1000)
+	memStorage.UpdateMetricsBatch([]models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value, Timestamp: &ts},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Timestamp: &ts},
+	})
+
+	body := `[{"id":"PollCount","type":"counter"},{"id":"Alloc","type":"gauge"},{"id":"Alloc","type":"gauge"},{"id":"Missing","type":"gauge"}]`
+	req := httptest.NewRequest("POST", "/values/", bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	handler.HandleGetValuesJSON(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{
+		"metrics": [{"id":"PollCount","type":"counter","delta":3,"timestamp":1000},{"id":"Alloc","type":"gauge","value":1.5,"timestamp":1000}],
+		"missing": [{"id":"Missing","type":"gauge"}]
+	}`, rr.Body.String())
+
+	req = httptest.NewRequest("POST", "/values/", bytes.NewBufferString(`[{"id":"Alloc","type":"histogram"}]`))
+	rr = httptest.NewRecorder()
+	handler.HandleGetValuesJSON(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Values JSON numbers cannot hold are encoded as strings.
+	memStorage.UpdateGauge("Ratio", math.Inf(1))
+	req = httptest.NewRequest("POST", "/values/", bytes.NewBufferString(`[{"id":"Ratio","type":"gauge"}]`))
+	rr = httptest.NewRecorder()
+	handler.HandleGetValuesJSON(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"value":"+Inf"`)
+}
+
+func TestHandleBatchUpdatePartialFailure(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+
+	body := `[{"id":"Alloc","type":"gauge","value":1},{"id":"Sys","type":"gauge"},{"id":"PollCount","type":"counter","delta":2},{"id":"","type":"gauge","value":1}]`
+	req := httptest.NewRequest("POST", "/updates/", bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	handler.HandleBatchUpdate(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"accepted":2,"rejected":[
+		{"index":1,"id":"Sys","type":"gauge","reason":"metric value is required: gauge needs \"value\""},
+		{"index":3,"id":"","type":"gauge","reason":"metric id is required"}
+	]}`, rr.Body.String())
+	assert.Equal(t, 1.0, memStorage.Gauges()["Alloc"])
+	assert.Equal(t, int64(2), memStorage.Counters()["PollCount"])
+
+	req = httptest.NewRequest("POST", "/updates/?strict=true", bytes.NewBufferString(body))
+	rr = httptest.NewRecorder()
+	handler.HandleBatchUpdate(rr, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"accepted":0`)
+	assert.Equal(t, int64(2), memStorage.Counters()["PollCount"])
+}
+
+func TestHandleBatchUpdateTimestamps(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+	now := time.UnixMilli(1_700_000_000_000)
+	handler.SetValidationPolicy(validation.Policy{MaxAge: time.Hour, MaxFuture: time.Minute, Now: func() time.Time { return now }})
+
+	ms := func(d time.Duration) int64 { return now.Add(d).UnixMilli() }
+	body := fmt.Sprintf(`[
+		{"id":"Alloc","type":"gauge","value":2,"timestamp":%d},
+		{"id":"Alloc","type":"gauge","value":1,"timestamp":%d},
+		{"id":"Sys","type":"gauge","value":1,"timestamp":%d},
+		{"id":"Sys","type":"gauge","value":1,"timestamp":%d}
+	]`, ms(-time.Minute), ms(-2*time.Minute), ms(-2*time.Hour), ms(time.Hour))
+	req := httptest.NewRequest("POST", "/updates/", bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	handler.HandleBatchUpdate(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"accepted":2`)
+	assert.Contains(t, rr.Body.String(), "metric timestamp is too old")
+	assert.Contains(t, rr.Body.String(), "metric timestamp is too far in the future")
+	assert.Equal(t, 2.0, memStorage.Gauges()["Alloc"], "older sample must not replace a newer one")
+	_, exists := memStorage.Gauges()["Sys"]
+	assert.False(t, exists)
+
+	req = httptest.NewRequest("POST", "/update/", bytes.NewBufferString(
+		fmt.Sprintf(`{"id":"Alloc","type":"gauge","value":3,"timestamp":%d}`, ms(-30*time.Minute))))
+	rr = httptest.NewRecorder()
+	handler.HandleUpdateJSON(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 2.0, memStorage.Gauges()["Alloc"])
+}
+
+func TestFutureTimestampDoesNotFreezeGauge(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+
+	send := func(value float64, ts time.Time) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/update/", bytes.NewBufferString(
+			fmt.Sprintf(`{"id":"Alloc","type":"gauge","value":%g,"timestamp":%d}`, value, ts.UnixMilli())))
+		rr := httptest.NewRecorder()
+		handler.HandleUpdateJSON(rr, req)
+		return rr
+	}
+
+	// The default policy bounds the skew, so a far-future sample is
+	// rejected rather than stored ahead of every current one.
+	rr := send(1, time.Now().Add(24*time.Hour))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "too far in the future")
+
+	rr = send(2, time.Now())
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 2.0, memStorage.Gauges()["Alloc"])
+	rr = send(3, time.Now().Add(time.Second))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 3.0, memStorage.Gauges()["Alloc"], "later current samples keep applying")
+}
+
+func TestStaleGauges(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+	handler.SetStaleAfter(time.Minute)
+
+	old, value := time.Now().Add(-time.Hour).UnixMilli(), 1.0
+	memStorage.UpdateMetricsBatch([]models.Metrics{{ID: "Frozen", MType: "gauge", Value: &value, Timestamp: &old}})
+	memStorage.UpdateGauge("Alive", 2)
+
+	rr := httptest.NewRecorder()
+	handler.HandleListMetricsJSON(rr, httptest.NewRequest("GET", "/api/v1/metrics", nil))
+	var list listMetricsResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	assert.Len(t, list.Metrics, 2)
+	assert.Equal(t, "Alive", list.Metrics[0].ID)
+	assert.False(t, list.Metrics[0].Stale)
+	assert.True(t, list.Metrics[1].Stale)
+
+	rr = httptest.NewRecorder()
+	handler.HandleExposition(rr, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rr.Body.String(), "Alive 2")
+	assert.NotContains(t, rr.Body.String(), "Frozen")
+
+	rr = httptest.NewRecorder()
+	handler.HandleListMetrics(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Contains(t, rr.Body.String(), `<tr data-id="Frozen" data-type="gauge" class="stale">`)
+}
+
+func TestHandleBatchUpdateIdempotencyKey(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+	body := `[{"id":"PollCount","type":"counter","delta":5}]`
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/updates/", bytes.NewBufferString(body))
+		req.Header.Set(IdempotencyKeyHeader, "batch-1")
+		rr := httptest.NewRecorder()
+		handler.HandleBatchUpdate(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"accepted":1,"rejected":[]}`, rr.Body.String())
+		assert.Equal(t, i == 1, rr.Header().Get("Idempotent-Replayed") == "true")
+	}
+	assert.Equal(t, int64(5), memStorage.Counters()["PollCount"])
+
+	req := httptest.NewRequest("POST", "/updates/", bytes.NewBufferString(body))
+	req.Header.Set(IdempotencyKeyHeader, "batch-2")
+	rr := httptest.NewRecorder()
+	handler.HandleBatchUpdate(rr, req)
+	assert.Equal(t, int64(10), memStorage.Counters()["PollCount"])
+}
+
+type countingStorage struct {
+	storage.MetricsStorage
+	batches [][]models.Metrics
+}
+
+func (s *countingStorage) UpdateMetricsBatch(metrics []models.Metrics) error {
+	s.batches = append(s.batches, append([]models.Metrics(nil), metrics...))
+	return s.MetricsStorage.UpdateMetricsBatch(metrics)
+}
+
+func TestHandleBatchUpdateNDJSON(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	counting := &countingStorage{MetricsStorage: memStorage}
+	handler := NewMetricsHandler(counting)
+	handler.SetNDJSONChunkSize(2)
+
+	body := `{"id":"PollCount","type":"counter","delta":1}
+{"id":"PollCount","type":"counter","delta":2}
+
+{"id":"Alloc","type":"gauge"}
+{"id":"Alloc","type":"gauge","value":7}
+{"id":"Sys","type":"gauge","value":1}
+`
+	req := httptest.NewRequest("POST", "/updates/", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	handler.HandleBatchUpdate(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"accepted":4,"rejected":[
+		{"index":2,"line":4,"id":"Alloc","type":"gauge","reason":"metric value is required: gauge needs \"value\""}
+	]}`, rr.Body.String())
+	// Chunks are cut every two non-blank lines, whatever is kept of them.
+	assert.Len(t, counting.batches, 3)
+	assert.Equal(t, int64(3), memStorage.Counters()["PollCount"])
+	assert.Equal(t, 7.0, memStorage.Gauges()["Alloc"])
+
+	req = httptest.NewRequest("POST", "/updates/", bytes.NewBufferString("{\"id\":\"A\",\"type\":\"gauge\",\"value\":1}\n{oops\n{\"id\":\"B\",\"type\":\"gauge\",\"value\":1}\n"))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rr = httptest.NewRecorder()
+	handler.HandleBatchUpdate(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"accepted":1`)
+	assert.Contains(t, rr.Body.String(), `line 2: invalid JSON`)
+	assert.Equal(t, 1.0, memStorage.Gauges()["A"])
+	_, stored := memStorage.Gauges()["B"]
+	assert.False(t, stored)
+}
+
+// failingStorage fails the idempotent batch update after ok calls.
+type failingStorage struct {
+	storage.MetricsStorage
+	ok int
+}
+
+func (s *failingStorage) UpdateMetricsBatchOnce(key string, metrics []models.Metrics, ttl time.Duration) (bool, error) {
+	if s.ok == 0 {
+		return false, errors.New("connection lost")
+	}
+	s.ok--
+	return s.MetricsStorage.UpdateMetricsBatchOnce(key, metrics, ttl)
+}
+
+func TestNDJSONRetryAfterRelabelReload(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	failing := &failingStorage{MetricsStorage: memStorage, ok: 1}
+	handler := NewMetricsHandler(failing)
+	handler.SetNDJSONChunkSize(2)
+
+	body := `{"id":"PollCount","type":"counter","delta":1}
+{"id":"tmp_probe","type":"gauge","value":1}
+{"id":"PollCount","type":"counter","delta":1}
+{"id":"PollCount","type":"counter","delta":1}
+`
+	send := func() int {
+		req := httptest.NewRequest("POST", "/updates/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set(IdempotencyKeyHeader, "stream-1")
+		rr := httptest.NewRecorder()
+		handler.HandleBatchUpdate(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, send())
+	assert.Equal(t, int64(1), memStorage.Counters()["PollCount"])
+
+	// The retry comes after a rule dropping tmp_probe was loaded, which
+	// changes what each chunk keeps but not the lines it covers.
+	path := filepath.Join(t.TempDir(), "relabel.json")
+	if err := os.WriteFile(path, []byte(`{"rules":[{"action":"drop","match":"tmp_.*"}]}`), 0o644); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+	e, err := relabel.Load(path)
+	if err != nil {
+		t.Fatalf("failed to load rules: %v", err)
+	}
+	handler.SetRelabeler(e)
+	failing.ok = -1
+
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, int64(3), memStorage.Counters()["PollCount"])
+}
+
+func TestHandleBatchUpdateLimits(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	memStorage.UpdateGauge("Alloc", 1)
+	handler := NewMetricsHandler(memStorage)
+	handler.SetLimiter(limits.NewLimiter(memStorage, limits.Config{MaxNewSeriesPerMinute: 1}))
+
+	body := `[{"id":"Alloc","type":"gauge","value":2},{"id":"req_1","type":"gauge","value":1},{"id":"req_2","type":"gauge","value":1}]`
+	req := httptest.NewRequest("POST", "/updates/", bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	handler.HandleBatchUpdate(rr, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Body.String(), `"accepted":0`)
+	assert.Equal(t, 1.0, memStorage.Gauges()["Alloc"])
+
+	handler.SetLimiter(limits.NewLimiter(memStorage, limits.Config{MaxNewSeriesPerMinute: 1, Action: limits.ActionDrop}))
+	req = httptest.NewRequest("POST", "/updates/", bytes.NewBufferString(body))
+	rr = httptest.NewRecorder()
+	handler.HandleBatchUpdate(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"accepted":2,"rejected":[
+		{"index":2,"id":"req_2","type":"gauge","reason":"client may create at most 1 new series per minute"}
+	]}`, rr.Body.String())
+	assert.Equal(t, 2.0, memStorage.Gauges()["Alloc"])
+	_, stored := memStorage.Gauges()["req_2"]
+	assert.False(t, stored)
+
+	req = httptest.NewRequest("POST", "/updates/", bytes.NewBufferString("{\"id\":\"req_3\",\"type\":\"gauge\",\"value\":1}\n"))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rr = httptest.NewRecorder()
+	handler.HandleBatchUpdate(rr, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"line":1`)
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	rr = httptest.NewRecorder()
+	handler.HandleExposition(rr, req)
+	assert.Contains(t, rr.Body.String(), `metrics_service_rejected_series_total{reason="rate_limit"} 2`)
+}
+
+func TestHandleRates(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+	now := time.Now()
+	at := func(d time.Duration) *int64 { v := now.Add(d).UnixMilli(); return &v }
+	delta := func(v int64) *int64 { return &v }
+	memStorage.UpdateMetricsBatch([]models.Metrics{
+		{ID: `requests_total{host="a"}`, MType: "counter", Delta: delta(100), Timestamp: at(-40 * time.Second)},
+		{ID: `requests_total{host="a"}`, MType: "counter", Delta: delta(20), Timestamp: at(-20 * time.Second)},
+		{ID: `requests_total{host="a"}`, MType: "counter", Delta: delta(40), Timestamp: at(-10 * time.Second)},
+		{ID: "PollCount", MType: "counter", Delta: delta(1), Timestamp: at(-time.Second)},
+	})
+
+	get := func(target string, handle http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		rr := httptest.NewRecorder()
+		handle(rr, req)
+		return rr
+	}
+
+	rr := get("/api/v1/rates?window=30s&prefix=requests", handler.HandleRates)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp ratesResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, "rate", resp.Func)
+	assert.Equal(t, "30s", resp.Window)
+	assert.Len(t, resp.Results, 1)
+	assert.Equal(t, 2, resp.Results[0].Samples)
+	assert.InDelta(t, 4.0, *resp.Results[0].Value, 1e-9)
+
+	rr = get("/api/v1/rates?func=increase&window=1m&id=PollCount&id="+url.QueryEscape(`requests_total{host="a"}`), handler.HandleRates)
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Len(t, resp.Results, 2)
+	assert.Nil(t, resp.Results[0].Value, "one sample is not enough")
+	assert.Equal(t, 60.0, *resp.Results[1].Value)
+
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/rates?func=deriv", handler.HandleRates).Code)
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/rates?window=-1m", handler.HandleRates).Code)
+
+	rr = get("/api/v1/metrics?rate=1m", handler.HandleListMetricsJSON)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var list listMetricsResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	assert.Equal(t, 2, list.Total)
+	assert.Len(t, list.Metrics, 3)
+	assert.Equal(t, `requests_total:rate1m{host="a"}`, list.Metrics[2].ID)
+	assert.Equal(t, "gauge", list.Metrics[2].MType)
+	assert.InDelta(t, 2.0, *list.Metrics[2].Value, 1e-9)
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/metrics?rate=soon", handler.HandleListMetricsJSON).Code)
+}
+
+// remoteWriteRequest builds a snappy-compressed WriteRequest with one
+// sample per series.
+func remoteWriteRequest(t *testing.T, samples map[string]float64) *http.Request {
+	var body []byte
+	for name, value := range samples {
+		var label, sample, series []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, "__name__")
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(time.Now().UnixMilli()))
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+		body = protowire.AppendTag(body, 1, protowire.BytesType)
+		body = protowire.AppendBytes(body, series)
+	}
+
+	req, err := http.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappy.Encode(nil, body)))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	return req
+}
+
+func TestHandleRemoteWriteDropsNonFinite(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+
+	rr := httptest.NewRecorder()
+	handler.HandleRemoteWrite(rr, remoteWriteRequest(t, map[string]float64{"up": 1, "ratio": math.Inf(1)}))
+
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	value, _ := memStorage.GetMetric("gauge", "up")
+	assert.Equal(t, "1.000000", value)
+	_, err := memStorage.GetMetric("gauge", "ratio")
+	assert.Error(t, err)
+}
+
+func TestHandleRemoteWriteTooLarge(t *testing.T) {
+	handler := NewMetricsHandler(storage.NewMemStorage())
+
+	req := remoteWriteRequest(t, map[string]float64{"up": 1})
+	req.Body = io.NopCloser(io.MultiReader(req.Body, bytes.NewReader(make([]byte, remotewrite.MaxDecodedSize))))
+	req.ContentLength = -1
+
+	rr := httptest.NewRecorder()
+	handler.HandleRemoteWrite(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestHandlePushLimits(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(memStorage)
+	handler.SetLimiter(limits.NewLimiter(memStorage, limits.Config{MaxNewSeriesPerMinute: 2}))
+	r := chi.NewRouter()
+	r.Put("/metrics/*", handler.HandlePush)
+
+	push := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/metrics/job/backup", bytes.NewBufferString("a 1\nb 1\n"))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Two series plus the push time series are one too many.
+	rr := push()
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	metrics, _ := memStorage.Snapshot()
+	assert.Empty(t, metrics)
+
+	handler.SetLimiter(limits.NewLimiter(memStorage, limits.Config{MaxNewSeriesPerMinute: 2, Action: limits.ActionDrop}))
+	rr = push()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	metrics, _ = memStorage.Snapshot()
+	assert.Len(t, metrics, 2)
+}
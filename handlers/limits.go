@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/hairutdin/metrics-service/internal/limits"
+	"github.com/hairutdin/metrics-service/internal/validation"
+	"github.com/hairutdin/metrics-service/models"
+)
+
+// SetLimiter enables cardinality limits on every ingestion endpoint.
+func (h *MetricsHandler) SetLimiter(l *limits.Limiter) {
+	h.limiter = l
+	h.push.SetLimiter(l)
+}
+
+// limit runs metrics sent with r through the limiter. Without one every
+// metric is admitted.
+func (h *MetricsHandler) limit(r *http.Request, metrics []models.Metrics) (limits.Decision, error) {
+	if h.limiter == nil {
+		return limits.Decision{Admitted: metrics}, nil
+	}
+	return h.limiter.Admit(limits.ClientID(r.RemoteAddr), metrics)
+}
+
+// limitRejections turns the limiter's rejections into batch rejections;
+// at returns the rejection template (index and line) for a position in
+// the metrics passed to limit.
+func limitRejections(d limits.Decision, at func(int) validation.Rejection) []validation.Rejection {
+	rejected := make([]validation.Rejection, 0, len(d.Rejected))
+	for _, rej := range d.Rejected {
+		r := at(rej.Index)
+		r.ID, r.Type, r.Reason = rej.Metric.ID, rej.Metric.MType, rej.Reason
+		rejected = append(rejected, r)
+	}
+	return rejected
+}
+
+func sortRejections(rejected []validation.Rejection) {
+	sort.SliceStable(rejected, func(i, j int) bool { return rejected[i].Index < rejected[j].Index })
+}
+
+// setRetryAfter tells a rate-limited client when its window reopens.
+func setRetryAfter(w http.ResponseWriter, d limits.Decision) {
+	if d.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.RetryAfter.Seconds()))))
+	}
+}
+
+// HandleLimits handles GET /api/v1/limits with the configured limits, the
+// current number of series and how many series each limit has rejected.
+func (h *MetricsHandler) HandleLimits(w http.ResponseWriter, r *http.Request) {
+	if h.limiter == nil {
+		count, err := h.storage.CountSeries()
+		if err != nil {
+			http.Error(w, "Failed to load limits", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, limits.Stats{Action: limits.ActionReject, Series: count, Rejected: map[string]int64{}})
+		return
+	}
+	stats, err := h.limiter.Stats()
+	if err != nil {
+		http.Error(w, "Failed to load limits", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
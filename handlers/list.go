@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+)
+
+type listMetricsResponse struct {
+	Metrics    []models.Metrics `json:"metrics"`
+	Total      int              `json:"total"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// HandleListMetricsJSON handles GET /api/v1/metrics. Supported query
+// parameters: type, prefix, regex, sort (name or value), order (asc or
+// desc), limit and cursor (next_cursor of the previous page). With rate set
+// to a window such as 5m, every counter on the page is followed by a derived
+// gauge holding its per-second rate; derived gauges are not counted in
+// total.
+func (h *MetricsHandler) HandleListMetricsJSON(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := storage.ListQuery{
+		Type:   params.Get("type"),
+		Prefix: params.Get("prefix"),
+		Regex:  params.Get("regex"),
+		SortBy: params.Get("sort"),
+		Cursor: params.Get("cursor"),
+	}
+
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		http.Error(w, "Invalid order", http.StatusBadRequest)
+		return
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		query.Limit = n
+	}
+
+	var rateWindow time.Duration
+	if window := params.Get("rate"); window != "" {
+		var err error
+		if rateWindow, err = parseRateWindow(window); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := h.storage.ListMetrics(query)
+	if errors.Is(err, storage.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to list metrics", http.StatusInternalServerError)
+		return
+	}
+
+	if rateWindow > 0 {
+		result.Metrics, err = h.appendRates(result.Metrics, rateWindow)
+		if err != nil {
+			http.Error(w, "Failed to compute rates", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.attachMetadata(result.Metrics)
+	h.markStale(result.Metrics)
+	resp := listMetricsResponse{
+		Metrics:    result.Metrics,
+		Total:      result.Total,
+		NextCursor: result.NextCursor,
+	}
+	if resp.Metrics == nil {
+		resp.Metrics = []models.Metrics{}
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Failed to encode metrics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+)
+
+// HandlePutMetadata handles PUT /api/v1/metadata/{type}/{name} and replaces
+// the unit, description and owner registered for a metric name.
+func (h *MetricsHandler) HandlePutMetadata(w http.ResponseWriter, r *http.Request) {
+	metricType, name, ok := metadataPath(w, r)
+	if !ok {
+		return
+	}
+
+	var md models.Metadata
+	if err := json.NewDecoder(r.Body).Decode(&md); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storage.SetMetadata(metricType, name, md); err != nil {
+		http.Error(w, "Failed to set metadata", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, models.MetricMetadata{Name: name, Type: metricType, Metadata: md})
+}
+
+// HandleGetMetadata handles GET /api/v1/metadata/{type}/{name}.
+func (h *MetricsHandler) HandleGetMetadata(w http.ResponseWriter, r *http.Request) {
+	metricType, name, ok := metadataPath(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := h.storage.ListMetadata()
+	if err != nil {
+		http.Error(w, "Failed to load metadata", http.StatusInternalServerError)
+		return
+	}
+	for _, md := range list {
+		if md.Name == name && md.Type == metricType {
+			writeJSON(w, http.StatusOK, md)
+			return
+		}
+	}
+	http.Error(w, "Metadata not found", http.StatusNotFound)
+}
+
+// HandleDeleteMetadata handles DELETE /api/v1/metadata/{type}/{name}.
+func (h *MetricsHandler) HandleDeleteMetadata(w http.ResponseWriter, r *http.Request) {
+	metricType, name, ok := metadataPath(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.storage.DeleteMetadata(metricType, name)
+	if errors.Is(err, storage.ErrMetricNotFound) {
+		http.Error(w, "Metadata not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete metadata", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleListMetadata handles GET /api/v1/metadata, optionally filtered by
+// ?type=.
+func (h *MetricsHandler) HandleListMetadata(w http.ResponseWriter, r *http.Request) {
+	metricType := r.URL.Query().Get("type")
+	if metricType != "" && metricType != "gauge" && metricType != "counter" {
+		http.Error(w, "Invalid metric type", http.StatusBadRequest)
+		return
+	}
+
+	list, err := h.storage.ListMetadata()
+	if err != nil {
+		http.Error(w, "Failed to load metadata", http.StatusInternalServerError)
+		return
+	}
+	filtered := make([]models.MetricMetadata, 0, len(list))
+	for _, md := range list {
+		if metricType == "" || md.Type == metricType {
+			filtered = append(filtered, md)
+		}
+	}
+	writeJSON(w, http.StatusOK, filtered)
+}
+
+// metadataPath is metricPath for registry entries, which are keyed by the
+// metric name without labels.
+func metadataPath(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	metricType, name, ok := metricPath(w, r)
+	if ok && models.MetadataName(name) != name {
+		http.Error(w, "Metadata is registered per metric name, without labels", http.StatusBadRequest)
+		return "", "", false
+	}
+	return metricType, name, ok
+}
+
+// attachMetadata fills in Meta from the registry for every metric that has
+// an entry. Metrics are still rendered without it if the registry cannot be
+// read.
+func (h *MetricsHandler) attachMetadata(metrics []models.Metrics) {
+	list, err := h.storage.ListMetadata()
+	if err != nil || len(list) == 0 {
+		return
+	}
+
+	type key struct{ mtype, name string }
+	registry := make(map[key]*models.Metadata, len(list))
+	for i := range list {
+		registry[key{list[i].Type, list[i].Name}] = &list[i].Metadata
+	}
+	for i := range metrics {
+		if md, ok := registry[key{metrics[i].MType, models.MetadataName(metrics[i].ID)}]; ok {
+			metrics[i].Meta = md
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
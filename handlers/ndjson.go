@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/hairutdin/metrics-service/internal/limits"
+	"github.com/hairutdin/metrics-service/internal/validation"
+	"github.com/hairutdin/metrics-service/models"
+)
+
+const (
+	DefaultNDJSONChunkSize = 1000
+	// maxNDJSONLineSize bounds the memory a single line may take.
+	maxNDJSONLineSize = 1 << 20
+)
+
+// SetNDJSONChunkSize sets how many streamed lines are stored together.
+func (h *MetricsHandler) SetNDJSONChunkSize(n int) {
+	if n > 0 {
+		h.ndjsonChunkSize = n
+	}
+}
+
+func isNDJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/x-ndjson" || mediaType == "application/ndjson")
+}
+
+// handleNDJSONBatch streams one metric per line and stores them in chunks,
+// each chunk being one storage batch (one transaction in PostgreSQL), so
+// memory use does not grow with the request size. A chunk holds the metrics
+// kept from a fixed number of non-blank input lines. Chunks stored before a
+// problem is found stay applied; the response reports how many metrics
+// were accepted and, on a malformed line, its number. Under a strict policy
+// the first invalid metric stops the stream and its chunk is discarded.
+//
+// With an idempotency key each chunk is deduplicated under the key and the
+// range of input lines it covers, so a retried stream skips the chunks that
+// got through even if relabel rules, validation or limits changed since.
+func (h *MetricsHandler) handleNDJSONBatch(w http.ResponseWriter, r *http.Request, policy validation.Policy, key string) {
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxNDJSONLineSize)
+
+	var resp batchUpdateResponse
+	chunk := make([]models.Metrics, 0, h.ndjsonChunkSize)
+	// chunkAt holds the index and line of every metric in chunk.
+	chunkAt := make([]validation.Rejection, 0, h.ndjsonChunkSize)
+	// The chunk covers the input lines from firstLine to lastLine, records
+	// of them not blank.
+	firstLine, lastLine, records := 0, 0, 0
+	replayed := false
+	var limited limits.Decision
+
+	respond := func(status int) {
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+		sortRejections(resp.Rejected)
+		writeBatchResponse(w, status, resp)
+	}
+
+	// flush stores the chunk and reports false if the limiter refused it,
+	// in which case the response has been written.
+	flush := func() (bool, error) {
+		if len(chunk) == 0 {
+			records = 0
+			return true, nil
+		}
+		d, err := h.limit(r, chunk)
+		if err != nil {
+			return false, err
+		}
+		resp.Rejected = append(resp.Rejected, limitRejections(d, func(i int) validation.Rejection { return chunkAt[i] })...)
+		if d.OverLimit() {
+			limited = d
+		}
+		if d.Throttled {
+			setRetryAfter(w, d)
+			resp.Error = fmt.Sprintf("line %d: series limits exceeded, the rest of the stream was not stored", chunkAt[0].Line)
+			respond(http.StatusTooManyRequests)
+			return false, nil
+		}
+
+		if len(d.Admitted) > 0 {
+			chunkKey := ""
+			if key != "" {
+				chunkKey = key + "#" + strconv.Itoa(firstLine) + "-" + strconv.Itoa(lastLine)
+			}
+			wasReplayed, err := h.applyBatch(chunkKey, d.Admitted)
+			if err != nil {
+				return false, err
+			}
+			replayed = replayed || wasReplayed
+			resp.Accepted += len(d.Admitted)
+		}
+		chunk, chunkAt, records = chunk[:0], chunkAt[:0], 0
+		return true, nil
+	}
+	// store flushes the chunk and reports whether to carry on, answering
+	// the request itself otherwise.
+	store := func() bool {
+		ok, err := flush()
+		if err != nil {
+			http.Error(w, "Failed to update metrics", http.StatusInternalServerError)
+		}
+		return ok
+	}
+
+	line, index := 0, 0
+	for scanner.Scan() {
+		line++
+		raw := scanner.Bytes()
+		if isBlank(raw) {
+			continue
+		}
+		if records == 0 {
+			firstLine = line
+		}
+		lastLine = line
+		records++
+
+		var m models.Metrics
+		if err := json.Unmarshal(raw, &m); err != nil {
+			if !store() {
+				return
+			}
+			resp.Error = fmt.Sprintf("line %d: invalid JSON: %v", line, err)
+			respond(http.StatusBadRequest)
+			return
+		}
+
+		m, keep := h.relabel.Apply(m)
+		switch err := policy.Check(m); {
+		case !keep:
+			resp.Dropped++
+		case err != nil:
+			resp.Rejected = append(resp.Rejected, validation.Rejection{
+				Index: index, Line: line, ID: m.ID, Type: m.MType, Reason: err.Error(),
+			})
+			if policy.Strict {
+				resp.Error = fmt.Sprintf("line %d: %v", line, err)
+				respond(http.StatusUnprocessableEntity)
+				return
+			}
+		default:
+			chunk = append(chunk, m)
+			chunkAt = append(chunkAt, validation.Rejection{Index: index, Line: line})
+		}
+		index++
+		if records >= h.ndjsonChunkSize && !store() {
+			return
+		}
+	}
+
+	if !store() {
+		return
+	}
+	if err := scanner.Err(); err != nil {
+		resp.Error = fmt.Sprintf("line %d: %v", line+1, err)
+		respond(http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	switch {
+	case resp.Accepted > 0 || len(resp.Rejected) == 0:
+	case limited.OverLimit():
+		status = http.StatusTooManyRequests
+		setRetryAfter(w, limited)
+	default:
+		status = http.StatusUnprocessableEntity
+	}
+	respond(status)
+}
+
+func isBlank(b []byte) bool {
+	for _, c := range b {
+		if c != ' ' && c != '\t' && c != '\r' {
+			return false
+		}
+	}
+	return true
+}
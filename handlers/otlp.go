@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/hairutdin/metrics-service/internal/limits"
+	"github.com/hairutdin/metrics-service/internal/otlp"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// errThrottled stops an OTLP export the limiter throttled.
+var errThrottled = errors.New("throttled")
+
+// HandleOTLPMetrics handles OTLP/HTTP metric exports (POST /v1/metrics) in
+// either the binary protobuf or the JSON encoding and answers in the same
+// encoding as the request.
+func (h *MetricsHandler) HandleOTLPMetrics(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var isJSON bool
+	switch mediaType {
+	case "application/x-protobuf", "application/protobuf":
+	case "application/json":
+		isJSON = true
+	default:
+		http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var req colmetricspb.ExportMetricsServiceRequest
+	if isJSON {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, &req)
+	} else {
+		err = proto.Unmarshal(body, &req)
+	}
+	if err != nil {
+		http.Error(w, "Invalid OTLP payload", http.StatusBadRequest)
+		return
+	}
+
+	// Invalid points are reported as a partial success, never failing the
+	// whole export.
+	policy := h.validation
+	policy.Strict = false
+
+	var d limits.Decision
+	result, err := h.otlp.Export(&req, func(result *otlp.Result) error {
+		metrics, _ := h.relabelAll(result.Metrics)
+		metrics, rejected := policy.Split(metrics)
+		for _, rej := range rejected {
+			result.Rejected++
+			result.Errors = append(result.Errors, rej.ID+": "+rej.Reason)
+		}
+
+		var err error
+		if d, err = h.limit(r, metrics); err != nil {
+			return err
+		}
+		if d.Throttled {
+			return errThrottled
+		}
+		for _, rej := range d.Rejected {
+			result.Rejected++
+			result.Errors = append(result.Errors, rej.Metric.ID+": "+rej.Reason)
+		}
+		result.Metrics = d.Admitted
+
+		if len(result.Metrics) == 0 {
+			return nil
+		}
+		return h.storage.UpdateMetricsBatch(result.Metrics)
+	})
+	if d.Throttled {
+		// 429 with Retry-After is the OTLP/HTTP signal to back off.
+		setRetryAfter(w, d)
+		http.Error(w, d.Reason(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		// 503 tells OTLP exporters the export may be retried, which is
+		// safe because the converter has not advanced its cumulative state.
+		http.Error(w, "Failed to update metrics", http.StatusServiceUnavailable)
+		return
+	}
+
+	resp := &colmetricspb.ExportMetricsServiceResponse{}
+	if result.Rejected > 0 {
+		resp.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: result.Rejected,
+			ErrorMessage:       strings.Join(result.Errors, "; "),
+		}
+	}
+
+	var out []byte
+	if isJSON {
+		out, err = protojson.Marshal(resp)
+	} else {
+		out, err = proto.Marshal(resp)
+	}
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hairutdin/metrics-service/internal/limits"
+	"github.com/hairutdin/metrics-service/internal/promtext"
+	"github.com/hairutdin/metrics-service/internal/pushgateway"
+)
+
+// HandlePush handles Pushgateway pushes to /metrics/job/{job}{/label/value}.
+// PUT replaces the whole group, POST only the pushed metric families.
+func (h *MetricsHandler) HandlePush(w http.ResponseWriter, r *http.Request) {
+	grouping, err := parseGroupingKey(chi.URLParam(r, "*"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || mediaType != "text/plain" {
+			http.Error(w, "Only the text exposition format is supported", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	families, err := promtext.Parse(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid metrics: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	err = h.push.Push(limits.ClientID(r.RemoteAddr), grouping, families, r.Method == http.MethodPut)
+	if errors.Is(err, pushgateway.ErrTimestampNotAllowed) || errors.Is(err, pushgateway.ErrInvalidMetric) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var limitErr *pushgateway.LimitError
+	if errors.As(err, &limitErr) {
+		status := http.StatusBadRequest
+		if limitErr.Decision.OverLimit() {
+			status = http.StatusTooManyRequests
+			setRetryAfter(w, limitErr.Decision)
+		}
+		http.Error(w, limitErr.Error(), status)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to store metrics", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandlePushDelete deletes every metric of a Pushgateway group.
+func (h *MetricsHandler) HandlePushDelete(w http.ResponseWriter, r *http.Request) {
+	grouping, err := parseGroupingKey(chi.URLParam(r, "*"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.push.Delete(grouping); err != nil {
+		http.Error(w, "Failed to delete metrics", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandleExposition serves all stored metrics in the Prometheus text format.
+func (h *MetricsHandler) HandleExposition(w http.ResponseWriter, r *http.Request) {
+	metrics, err := h.storage.Snapshot()
+	if err != nil {
+		http.Error(w, "Failed to load metrics", http.StatusInternalServerError)
+		return
+	}
+	metrics = h.withoutStale(metrics)
+	h.attachMetadata(metrics)
+	if h.limiter != nil {
+		metrics = append(metrics, h.limiter.Metrics()...)
+	}
+
+	w.Header().Set("Content-Type", promtext.ContentType)
+	w.WriteHeader(http.StatusOK)
+	promtext.Write(w, metrics)
+}
+
+// parseGroupingKey parses the path after /metrics/ into grouping labels. The
+// first pair must be the job; a label name suffixed with @base64 carries a
+// base64url encoded value, which allows values containing slashes.
+func parseGroupingKey(path string) (map[string]string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("grouping key must consist of label name/value pairs")
+	}
+
+	grouping := make(map[string]string, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		name, value := parts[i], parts[i+1]
+		if base, ok := strings.CutSuffix(name, "@base64"); ok {
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value for label %q", base)
+			}
+			name, value = base, string(decoded)
+		}
+		if i == 0 && name != "job" {
+			return nil, fmt.Errorf("grouping key must start with job")
+		}
+		if name == "job" && value == "" {
+			return nil, fmt.Errorf("job name must not be empty")
+		}
+		grouping[name] = value
+	}
+	return grouping, nil
+}
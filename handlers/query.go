@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/hairutdin/metrics-service/internal/query"
+)
+
+type queryResponse struct {
+	ResultType string      `json:"result_type"`
+	Result     query.Value `json:"result"`
+}
+
+// HandleQuery handles GET /api/v1/query?query=<expression> and evaluates
+// the expression against the current metrics and their history.
+func (h *MetricsHandler) HandleQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("query")
+	if q == "" {
+		http.Error(w, "Missing query", http.StatusBadRequest)
+		return
+	}
+
+	v, err := query.NewEngine(h.storage).Query(q)
+	if errors.Is(err, query.ErrStorage) {
+		http.Error(w, "Failed to evaluate query", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, queryResponse{ResultType: v.Type(), Result: v})
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hairutdin/metrics-service/storage"
+)
+
+// DefaultRangeWindow is how far back range queries without a from parameter
+// go.
+const DefaultRangeWindow = time.Hour
+
+// rangePoint is one bucket of a range query. Raw samples are points with a
+// count of one.
+type rangePoint struct {
+	Timestamp int64   `json:"t"`
+	Min       float64 `json:"min"`
+	Max       float64 `json:"max"`
+	Avg       float64 `json:"avg"`
+	Count     int64   `json:"count"`
+}
+
+type rangeResponse struct {
+	ID         string       `json:"id"`
+	Type       string       `json:"type"`
+	Resolution string       `json:"resolution"`
+	Points     []rangePoint `json:"points"`
+}
+
+// SetRetentionPolicy sets the resolutions range queries can choose from.
+func (h *MetricsHandler) SetRetentionPolicy(p storage.RetentionPolicy) {
+	h.retention = p
+}
+
+// HandleRange handles GET /api/v1/range. Query parameters: type and id of
+// the series, from and to as RFC 3339 times or Unix milliseconds, and
+// resolution, either a level of the retention policy such as raw or 1m, or
+// auto, the default, for the finest level that still covers from.
+func (h *MetricsHandler) HandleRange(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	mtype, id := params.Get("type"), params.Get("id")
+	if mtype != "gauge" && mtype != "counter" {
+		http.Error(w, "Invalid metric type", http.StatusBadRequest)
+		return
+	}
+	if id == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	to, err := parseRangeTime(params.Get("to"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseRangeTime(params.Get("from"), to.Add(-DefaultRangeWindow))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from.After(to) {
+		http.Error(w, "from is after to", http.StatusBadRequest)
+		return
+	}
+
+	policy := h.retention
+	if policy == nil {
+		policy = storage.DefaultRetentionPolicy()
+	}
+	resolution := policy.Pick(from, now)
+	if name := params.Get("resolution"); name != "" && name != "auto" {
+		var ok bool
+		if resolution, ok = policy.Lookup(name); !ok {
+			http.Error(w, fmt.Sprintf("Unknown resolution %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rollups, err := storage.QueryRange(h.storage, resolution, mtype, id, from, to)
+	if err != nil {
+		http.Error(w, "Failed to read history", http.StatusInternalServerError)
+		return
+	}
+	resp := rangeResponse{ID: id, Type: mtype, Resolution: resolution.Name(), Points: make([]rangePoint, len(rollups))}
+	for i, r := range rollups {
+		resp.Points[i] = rangePoint{Timestamp: r.Timestamp, Min: r.Min, Max: r.Max, Avg: r.Avg(), Count: r.Count}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseRangeTime reads an RFC 3339 time or Unix milliseconds, returning
+// fallback for an empty string.
+func parseRangeTime(s string, fallback time.Time) (time.Time, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hairutdin/metrics-service/internal/rate"
+	"github.com/hairutdin/metrics-service/models"
+)
+
+// DefaultRateWindow is the window of rate computations that do not name
+// one.
+const DefaultRateWindow = 5 * time.Minute
+
+// rateResult is the value of a rate function for one counter. Value is null
+// when the window holds fewer than two samples.
+type rateResult struct {
+	ID      string   `json:"id"`
+	Value   *float64 `json:"value"`
+	Samples int      `json:"samples"`
+}
+
+type ratesResponse struct {
+	Func    string       `json:"func"`
+	Window  string       `json:"window"`
+	Results []rateResult `json:"results"`
+}
+
+// HandleRates handles GET /api/v1/rates. Query parameters: func (rate, the
+// default, irate or increase), window (a duration such as 5m) and the
+// counters to compute it for, either as repeated id parameters or as a
+// prefix. Without either, every counter is included.
+func (h *MetricsHandler) HandleRates(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	name := params.Get("func")
+	if name == "" {
+		name = "rate"
+	}
+	f, err := rate.Lookup(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	window, err := parseRateWindow(params.Get("window"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ids := params["id"]
+	if len(ids) == 0 {
+		metrics, err := h.storage.Snapshot()
+		if err != nil {
+			http.Error(w, "Failed to read metrics", http.StatusInternalServerError)
+			return
+		}
+		prefix := params.Get("prefix")
+		for _, m := range metrics {
+			if m.MType == "counter" && strings.HasPrefix(m.ID, prefix) {
+				ids = append(ids, m.ID)
+			}
+		}
+	}
+
+	now := time.Now()
+	resp := ratesResponse{Func: name, Window: compactDuration(window), Results: make([]rateResult, 0, len(ids))}
+	for _, id := range ids {
+		samples, err := h.storage.History("counter", id, now.Add(-window), now)
+		if err != nil {
+			http.Error(w, "Failed to read history", http.StatusInternalServerError)
+			return
+		}
+		result := rateResult{ID: id, Samples: len(samples)}
+		if v, ok := f(samples); ok {
+			result.Value = &v
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// appendRates adds a derived gauge with the per-second rate over window for
+// every counter among metrics, e.g. PollCount:rate5m. Counters with too
+// little history in the window get none.
+func (h *MetricsHandler) appendRates(metrics []models.Metrics, window time.Duration) ([]models.Metrics, error) {
+	now := time.Now()
+	suffix := ":rate" + compactDuration(window)
+	derived := metrics
+	for _, m := range metrics {
+		if m.MType != "counter" {
+			continue
+		}
+		samples, err := h.storage.History("counter", m.ID, now.Add(-window), now)
+		if err != nil {
+			return nil, err
+		}
+		v, ok := rate.Rate(samples)
+		if !ok {
+			continue
+		}
+		name, labels, err := models.ParseSeriesID(m.ID)
+		if err != nil {
+			continue
+		}
+		ts := samples[len(samples)-1].Timestamp
+		derived = append(derived, models.Metrics{
+			ID:        models.SeriesID(name+suffix, labels),
+			MType:     "gauge",
+			Value:     &v,
+			Timestamp: &ts,
+		})
+	}
+	return derived, nil
+}
+
+func parseRateWindow(s string) (time.Duration, error) {
+	if s == "" {
+		return DefaultRateWindow, nil
+	}
+	window, err := time.ParseDuration(s)
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("invalid window %q", s)
+	}
+	return window, nil
+}
+
+// compactDuration formats d without trailing zero units: 5m rather than
+// 5m0s.
+func compactDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/hairutdin/metrics-service/internal/recording"
+)
+
+// SetRecordingRules exposes the health of the recording rules of m.
+func (h *MetricsHandler) SetRecordingRules(m *recording.Manager) {
+	h.recording = m
+}
+
+// HandleRecordingRules handles GET /api/v1/recording/rules with every
+// recording rule and the outcome of its last evaluation.
+func (h *MetricsHandler) HandleRecordingRules(w http.ResponseWriter, r *http.Request) {
+	if h.recording == nil {
+		writeJSON(w, http.StatusOK, []recording.RuleStatus{})
+		return
+	}
+	writeJSON(w, http.StatusOK, h.recording.Status())
+}
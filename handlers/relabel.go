@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/hairutdin/metrics-service/internal/relabel"
+	"github.com/hairutdin/metrics-service/models"
+)
+
+// SetRelabeler rewrites metrics with e's rules on every ingestion endpoint
+// before they are validated and stored.
+func (h *MetricsHandler) SetRelabeler(e *relabel.Engine) {
+	h.relabel = e
+	h.push.SetRelabeler(e)
+	h.otlp.SetRelabeler(e)
+}
+
+// relabelAll rewrites metrics and returns the ones kept together with their
+// positions in metrics.
+func (h *MetricsHandler) relabelAll(metrics []models.Metrics) ([]models.Metrics, []int) {
+	kept := make([]models.Metrics, 0, len(metrics))
+	positions := make([]int, 0, len(metrics))
+	for i, m := range metrics {
+		if m, ok := h.relabel.Apply(m); ok {
+			kept = append(kept, m)
+			positions = append(positions, i)
+		}
+	}
+	return kept, positions
+}
+
+// HandleRelabelRules handles GET /api/v1/relabel/rules with the rules in
+// effect and when they were loaded.
+func (h *MetricsHandler) HandleRelabelRules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.relabel.Status())
+}
+
+// HandleRelabelDryRun handles POST /api/v1/relabel/dry-run with an array of
+// metrics and shows how each would be rewritten, without storing anything.
+func (h *MetricsHandler) HandleRelabelDryRun(w http.ResponseWriter, r *http.Request) {
+	var metrics []models.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	rules := h.relabel.Rules()
+	traces := make([]relabel.Trace, 0, len(metrics))
+	for _, m := range metrics {
+		traces = append(traces, rules.Explain(m))
+	}
+	writeJSON(w, http.StatusOK, traces)
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/hairutdin/metrics-service/internal/remotewrite"
+)
+
+// HandleRemoteWrite handles Prometheus remote_write 1.0 requests. Following
+// the spec, malformed requests get a 4xx so Prometheus drops them, storage
+// failures get a 5xx so it retries, and success is acknowledged with 204.
+func (h *MetricsHandler) HandleRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Encoding") != "snappy" {
+		http.Error(w, "Content-Encoding must be snappy", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-protobuf" ||
+		(params["proto"] != "" && params["proto"] != "prometheus.WriteRequest") {
+		http.Error(w, "Only remote_write 1.0 protobuf requests are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// An oversized request must not look malformed: a 413 is explicit
+	// about why Prometheus has to drop it.
+	if r.ContentLength > remotewrite.MaxDecodedSize {
+		http.Error(w, remotewrite.ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, remotewrite.MaxDecodedSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > remotewrite.MaxDecodedSize {
+		http.Error(w, remotewrite.ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	series, err := remotewrite.Decode(body)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, remotewrite.ErrTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	metrics, _ := remotewrite.ToMetrics(series)
+	metrics, _ = h.relabelAll(metrics)
+	// Samples the validation policy rejects, such as ±Inf, are dropped like
+	// series without a name; failing the request would make Prometheus drop
+	// the valid samples along with them.
+	policy := h.validation
+	policy.Strict = false
+	metrics, _ = policy.Split(metrics)
+	d, err := h.limit(r, metrics)
+	if err != nil {
+		http.Error(w, "Failed to update metrics", http.StatusInternalServerError)
+		return
+	}
+	if d.Throttled {
+		// Prometheus retries a 429 after Retry-After; series dropped under
+		// the drop and sample actions are not retried.
+		setRetryAfter(w, d)
+		http.Error(w, d.Reason(), http.StatusTooManyRequests)
+		return
+	}
+	metrics = d.Admitted
+
+	if len(metrics) > 0 {
+		if err := h.storage.UpdateMetricsBatch(metrics); err != nil {
+			http.Error(w, "Failed to update metrics", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+// SetStaleAfter sets how long a gauge may go without updates before reads
+// flag it as stale; 0 disables the check.
+func (h *MetricsHandler) SetStaleAfter(ttl time.Duration) {
+	h.staleAfter = ttl
+}
+
+// markStale flags gauges last updated more than staleAfter ago.
+func (h *MetricsHandler) markStale(metrics []models.Metrics) {
+	if h.staleAfter <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-h.staleAfter).UnixMilli()
+	for i := range metrics {
+		m := &metrics[i]
+		m.Stale = m.MType == "gauge" && m.Timestamp != nil && *m.Timestamp < cutoff
+	}
+}
+
+// withoutStale drops stale gauges. The exposition leaves them out so that
+// scrapers mark the series stale instead of recording a frozen value.
+func (h *MetricsHandler) withoutStale(metrics []models.Metrics) []models.Metrics {
+	h.markStale(metrics)
+	fresh := metrics[:0]
+	for _, m := range metrics {
+		if !m.Stale {
+			fresh = append(fresh, m)
+		}
+	}
+	return fresh
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hairutdin/metrics-service/internal/stream"
+)
+
+var streamKeepAlive = 15 * time.Second
+
+// StreamHandler serves metric changes as server-sent events. The optional
+// prefix and type query parameters narrow the stream down; each event is
+// named after its kind (update or delete) and carries the metric as JSON.
+func StreamHandler(hub *stream.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		filter := stream.Filter{
+			Prefix: r.URL.Query().Get("prefix"),
+			Type:   r.URL.Query().Get("type"),
+		}
+		if filter.Type != "" && filter.Type != "gauge" && filter.Type != "counter" {
+			http.Error(w, "Invalid metric type", http.StatusBadRequest)
+			return
+		}
+
+		sub := hub.Subscribe(filter)
+		defer hub.Unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(streamKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case event, ok := <-sub.Events():
+				if !ok {
+					if hub.Dropped(sub) {
+						fmt.Fprint(w, "event: error\ndata: {\"error\":\"subscriber too slow, disconnected\"}\n\n")
+						flusher.Flush()
+					}
+					return
+				}
+				data, err := json.Marshal(event.Metric)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Kind, data)
+				flusher.Flush()
+			}
+		}
+	}
+}
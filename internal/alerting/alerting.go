@@ -0,0 +1,223 @@
+// Package alerting evaluates threshold rules against stored metrics, tracks
+// the state of the alerts they raise and notifies webhooks when alerts fire
+// or resolve.
+package alerting
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+)
+
+// Alert states.
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// resolvedRetention is how long resolved alerts stay listed.
+const resolvedRetention = 15 * time.Minute
+
+// Alert is one series that meets, or recently met, a rule's condition.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Series      string            `json:"series"`
+	State       string            `json:"state"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Value       float64           `json:"value"`
+	ActiveAt    time.Time         `json:"active_at"`
+	FiredAt     *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolved_at,omitempty"`
+	Silenced    bool              `json:"silenced"`
+
+	// notified is set once the alert's current state has been sent.
+	notified bool
+}
+
+type alertKey struct{ rule, series string }
+
+// Manager evaluates the rules of a Config.
+type Manager struct {
+	cfg     *Config
+	storage storage.MetricsStorage
+	client  *http.Client
+	now     func() time.Time
+
+	mu       sync.Mutex
+	alerts   map[alertKey]*Alert
+	groups   map[string]time.Time // group key -> last notification
+	silences map[string]Silence
+	lastEval time.Time
+	evalErr  string
+
+	deliveries sync.WaitGroup
+}
+
+func NewManager(s storage.MetricsStorage, cfg *Config) *Manager {
+	return &Manager{
+		cfg:      cfg,
+		storage:  s,
+		client:   &http.Client{},
+		now:      time.Now,
+		alerts:   make(map[alertKey]*Alert),
+		groups:   make(map[string]time.Time),
+		silences: make(map[string]Silence),
+	}
+}
+
+// Run evaluates the rules every interval until stop is closed.
+func (m *Manager) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.Evaluate()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Evaluate runs every rule once against the current metrics, updates the
+// alerts and sends the notifications that are due. Deliveries run in the
+// background; Wait blocks until they are done.
+func (m *Manager) Evaluate() {
+	metrics, err := m.storage.Snapshot()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.lastEval = now
+	if err != nil {
+		// Keep the alerts as they are rather than resolve everything
+		// because storage is briefly unavailable.
+		m.evalErr = err.Error()
+		return
+	}
+	m.evalErr = ""
+
+	seen := make(map[alertKey]bool)
+	for i := range m.cfg.Rules {
+		rule := &m.cfg.Rules[i]
+		compare := comparators[rule.Op]
+		for _, metric := range metrics {
+			if metric.MType != rule.Type {
+				continue
+			}
+			seriesLabels, ok := rule.matches(metric.ID)
+			if !ok {
+				continue
+			}
+			value := metricValue(metric)
+			if !compare(value, rule.Threshold) {
+				continue
+			}
+
+			key := alertKey{rule.Name, metric.ID}
+			seen[key] = true
+			m.activate(rule, key, seriesLabels, value, now)
+		}
+	}
+
+	for key, a := range m.alerts {
+		if seen[key] {
+			continue
+		}
+		switch a.State {
+		case StatePending:
+			delete(m.alerts, key)
+		case StateFiring:
+			resolvedAt := now
+			a.State, a.ResolvedAt, a.notified = StateResolved, &resolvedAt, false
+		case StateResolved:
+			if (a.notified || a.Silenced) && now.Sub(*a.ResolvedAt) >= resolvedRetention {
+				delete(m.alerts, key)
+			}
+		}
+	}
+
+	for _, a := range m.alerts {
+		a.Silenced = m.silenced(a.Labels, now)
+	}
+	m.notify(now)
+}
+
+// activate records that the alert for key meets its rule's condition. It
+// must be called with mu held.
+func (m *Manager) activate(rule *Rule, key alertKey, seriesLabels map[string]string, value float64, now time.Time) {
+	a := m.alerts[key]
+	if a == nil || a.State == StateResolved {
+		labels := make(map[string]string, len(seriesLabels)+len(rule.Labels)+1)
+		for k, v := range seriesLabels {
+			labels[k] = v
+		}
+		for k, v := range rule.Labels {
+			labels[k] = v
+		}
+		labels["alertname"] = rule.Name
+		a = &Alert{Rule: rule.Name, Series: key.series, State: StatePending, Labels: labels, ActiveAt: now}
+		m.alerts[key] = a
+	}
+
+	a.Value = value
+	a.Annotations = rule.annotate(value, a.Labels)
+	if a.State == StatePending && now.Sub(a.ActiveAt) >= time.Duration(rule.For) {
+		firedAt := now
+		a.State, a.FiredAt, a.notified = StateFiring, &firedAt, false
+	}
+}
+
+func metricValue(m models.Metrics) float64 {
+	if m.Delta != nil {
+		return float64(*m.Delta)
+	}
+	if m.Value != nil {
+		return *m.Value
+	}
+	return 0
+}
+
+// Status is a snapshot of the alerting state.
+type Status struct {
+	LastEvaluation *time.Time `json:"last_evaluation,omitempty"`
+	// Error is set when the last evaluation could not read the metrics.
+	Error  string  `json:"error,omitempty"`
+	Alerts []Alert `json:"alerts"`
+	Rules  []Rule  `json:"rules"`
+}
+
+// Status returns the rules and the alerts, sorted by rule and series.
+func (m *Manager) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := Status{Error: m.evalErr, Alerts: make([]Alert, 0, len(m.alerts)), Rules: m.cfg.Rules}
+	if !m.lastEval.IsZero() {
+		lastEval := m.lastEval
+		status.LastEvaluation = &lastEval
+	}
+	for _, a := range m.alerts {
+		status.Alerts = append(status.Alerts, *a)
+	}
+	sort.Slice(status.Alerts, func(i, j int) bool {
+		if status.Alerts[i].Rule != status.Alerts[j].Rule {
+			return status.Alerts[i].Rule < status.Alerts[j].Rule
+		}
+		return status.Alerts[i].Series < status.Alerts[j].Series
+	})
+	return status
+}
+
+// Wait blocks until every notification sent so far has been delivered or
+// has run out of retries.
+func (m *Manager) Wait() {
+	m.deliveries.Wait()
+}
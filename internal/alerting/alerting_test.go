@@ -0,0 +1,183 @@
+package alerting
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hairutdin/metrics-service/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// receiver records the notifications POSTed to it, failing the first
+// failures requests.
+type receiver struct {
+	mu            sync.Mutex
+	failures      int
+	notifications []Notification
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.failures > 0 {
+		rc.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var n Notification
+	json.NewDecoder(r.Body).Decode(&n)
+	rc.notifications = append(rc.notifications, n)
+}
+
+func (rc *receiver) take() []Notification {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	n := rc.notifications
+	rc.notifications = nil
+	return n
+}
+
+func newTestManager(t *testing.T, s storage.MetricsStorage, rc *receiver, rules ...Rule) (*Manager, *time.Time) {
+	server := httptest.NewServer(rc)
+	t.Cleanup(server.Close)
+
+	retries := 2
+	cfg := &Config{
+		Rules:        rules,
+		Webhooks:     []Webhook{{URL: server.URL}},
+		Retries:      &retries,
+		RetryBackoff: Duration(time.Millisecond),
+	}
+	if err := cfg.prepare(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	m := NewManager(s, cfg)
+	m.now = func() time.Time { return now }
+	return m, &now
+}
+
+func TestAlertLifecycle(t *testing.T) {
+	s := storage.NewMemStorage()
+	s.UpdateGauge(`HeapAlloc{host="a"}`, 2e9)
+	s.UpdateGauge(`HeapAlloc{host="b"}`, 3e9)
+	s.UpdateGauge(`HeapAlloc{host="c"}`, 1)
+	rc := &receiver{failures: 1}
+	m, now := newTestManager(t, s, rc, Rule{
+		Name: "HighHeap", Metric: "HeapAlloc", Op: ">", Threshold: 1e9, For: Duration(time.Minute),
+		Labels:      map[string]string{"severity": "page"},
+		Annotations: map[string]string{"summary": "heap on {{.Labels.host}} is {{.Value}}"},
+	})
+
+	m.Evaluate()
+	m.Wait()
+	status := m.Status()
+	assert.Len(t, status.Alerts, 2)
+	assert.Equal(t, StatePending, status.Alerts[0].State)
+	assert.Empty(t, rc.take())
+
+	*now = now.Add(time.Minute)
+	m.Evaluate()
+	m.Wait()
+	status = m.Status()
+	assert.Equal(t, StateFiring, status.Alerts[0].State)
+	assert.Equal(t, "heap on a is 2e+09", status.Alerts[0].Annotations["summary"])
+
+	// One notification for the group despite the failed first attempt.
+	sent := rc.take()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, StateFiring, sent[0].Status)
+	assert.Equal(t, map[string]string{"alertname": "HighHeap"}, sent[0].GroupLabels)
+	assert.Len(t, sent[0].Alerts, 2)
+	assert.Equal(t, map[string]string{"alertname": "HighHeap", "host": "a", "severity": "page"}, sent[0].Alerts[0].Labels)
+
+	// Nothing changed, nothing is sent until the repeat interval.
+	*now = now.Add(time.Minute)
+	m.Evaluate()
+	m.Wait()
+	assert.Empty(t, rc.take())
+
+	s.UpdateGauge(`HeapAlloc{host="a"}`, 1)
+	*now = now.Add(time.Minute)
+	m.Evaluate()
+	m.Wait()
+	sent = rc.take()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, StateFiring, sent[0].Status, "the group still fires")
+	assert.Equal(t, StateResolved, sent[0].Alerts[0].Status)
+	assert.NotNil(t, sent[0].Alerts[0].EndsAt)
+
+	*now = now.Add(DefaultRepeatInterval)
+	m.Evaluate()
+	m.Wait()
+	sent = rc.take()
+	assert.Len(t, sent, 1)
+	assert.Len(t, sent[0].Alerts, 1)
+	assert.Len(t, m.Status().Alerts, 1, "resolved alerts are forgotten after a while")
+}
+
+func TestSilences(t *testing.T) {
+	s := storage.NewMemStorage()
+	s.UpdateCounter("Errors", 5)
+	rc := &receiver{}
+	m, now := newTestManager(t, s, rc, Rule{Name: "Errors", Metric: "Errors", Type: "counter", Op: ">=", Threshold: 5})
+
+	_, err := m.AddSilence(Silence{Matchers: map[string]string{"alertname": "Errors"}})
+	assert.Error(t, err, "a silence needs an end")
+	silence, err := m.AddSilence(Silence{Matchers: map[string]string{"alertname": "Errors"}, EndsAt: now.Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, silence.ID)
+
+	m.Evaluate()
+	m.Wait()
+	assert.Empty(t, rc.take())
+	assert.True(t, m.Status().Alerts[0].Silenced)
+	assert.Len(t, m.Silences(), 1)
+
+	assert.NoError(t, m.DeleteSilence(silence.ID))
+	assert.ErrorIs(t, m.DeleteSilence(silence.ID), ErrSilenceNotFound)
+	m.Evaluate()
+	m.Wait()
+	assert.Len(t, rc.take(), 1)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "alerts.json")
+	os.WriteFile(path, []byte(`{
+		"rules": [{"name": "HighHeap", "metric": "HeapAlloc{host=\"a\"}", "op": ">", "threshold": 1e9, "for": "5m"}],
+		"webhooks": [{"url": "http://localhost:9093/hook"}]
+	}`), 0o644)
+
+	cfg, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, Duration(5*time.Minute), cfg.Rules[0].For)
+	assert.Equal(t, "gauge", cfg.Rules[0].Type)
+	assert.Equal(t, []string{"alertname"}, cfg.GroupBy)
+	assert.Equal(t, DefaultRetries, *cfg.Retries)
+
+	labels, ok := cfg.Rules[0].matches(`HeapAlloc{host="a",region="eu"}`)
+	assert.True(t, ok)
+	assert.Equal(t, "eu", labels["region"])
+	_, ok = cfg.Rules[0].matches(`HeapAlloc{host="b"}`)
+	assert.False(t, ok)
+
+	for _, bad := range []string{
+		`{"rules": [{"name": "x", "metric": "m", "op": "~"}]}`,
+		`{"rules": [{"name": "x", "metric": "m", "op": ">", "for": 5}]}`,
+		`{"rules": [{"metric": "m", "op": ">"}]}`,
+		`{"webhooks": [{"url": "localhost"}]}`,
+		`{"webhooks": [{"url": "http://localhost/hook"}], "retries": -1}`,
+	} {
+		os.WriteFile(path, []byte(bad), 0o644)
+		_, err := LoadConfig(path)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,231 @@
+package alerting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+const (
+	DefaultRepeatInterval = 4 * time.Hour
+	DefaultRetries        = 3
+	DefaultRetryBackoff   = time.Second
+	DefaultWebhookTimeout = 10 * time.Second
+	// MaxRetryBackoff caps the doubling wait between delivery attempts.
+	MaxRetryBackoff = 5 * time.Minute
+)
+
+// Duration is a time.Duration written as a Go duration string ("5m") in
+// the configuration file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Rule raises an alert for every series of Metric whose value compares to
+// Threshold with Op for at least For.
+type Rule struct {
+	Name string `json:"name"`
+	// Metric is a metric name, optionally followed by labels that the
+	// series must carry, e.g. HeapAlloc{host="web1"}.
+	Metric    string   `json:"metric"`
+	Type      string   `json:"type,omitempty"` // "gauge" (default) or "counter"
+	Op        string   `json:"op"`             // >, >=, <, <=, == or !=
+	Threshold float64  `json:"threshold"`
+	For       Duration `json:"for,omitempty"`
+	// Labels are added to the alert's labels.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Annotations are text/template strings with .Value and .Labels.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	name        string
+	matchLabels map[string]string
+	annotations map[string]*template.Template
+}
+
+// Webhook is a notification receiver.
+type Webhook struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Timeout Duration          `json:"timeout,omitempty"`
+}
+
+// Config is the layout of the alerting configuration file.
+type Config struct {
+	Rules    []Rule    `json:"rules"`
+	Webhooks []Webhook `json:"webhooks"`
+	// GroupBy lists the labels whose values put alerts into the same
+	// notification; it defaults to alertname.
+	GroupBy []string `json:"group_by,omitempty"`
+	// RepeatInterval is how often a group that is still firing is
+	// notified again.
+	RepeatInterval Duration `json:"repeat_interval,omitempty"`
+	// Retries is how many times a failed delivery is retried, waiting
+	// RetryBackoff, then twice as long, and so on up to MaxRetryBackoff.
+	Retries      *int     `json:"retries,omitempty"`
+	RetryBackoff Duration `json:"retry_backoff,omitempty"`
+}
+
+// LoadConfig reads and checks the configuration file in path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid alerting config: %w", err)
+	}
+	if err := cfg.prepare(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// prepare validates the configuration and fills in defaults.
+func (cfg *Config) prepare() error {
+	names := make(map[string]bool, len(cfg.Rules))
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if err := r.prepare(); err != nil {
+			return fmt.Errorf("rule %d (%s): %w", i, r.Name, err)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule %d: duplicate name %q", i, r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	for i, w := range cfg.Webhooks {
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %d: invalid url %q", i, w.URL)
+		}
+		if w.Timeout <= 0 {
+			cfg.Webhooks[i].Timeout = Duration(DefaultWebhookTimeout)
+		}
+	}
+
+	if len(cfg.GroupBy) == 0 {
+		cfg.GroupBy = []string{"alertname"}
+	}
+	if cfg.RepeatInterval <= 0 {
+		cfg.RepeatInterval = Duration(DefaultRepeatInterval)
+	}
+	if cfg.Retries == nil {
+		retries := DefaultRetries
+		cfg.Retries = &retries
+	}
+	if *cfg.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = Duration(DefaultRetryBackoff)
+	}
+	return nil
+}
+
+func (r *Rule) prepare() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	name, labels, err := models.ParseSeriesID(r.Metric)
+	if err != nil || name == "" {
+		return fmt.Errorf("invalid metric %q", r.Metric)
+	}
+	r.name, r.matchLabels = name, labels
+
+	switch r.Type {
+	case "":
+		r.Type = "gauge"
+	case "gauge", "counter":
+	default:
+		return fmt.Errorf("type must be gauge or counter")
+	}
+	if _, ok := comparators[r.Op]; !ok {
+		return fmt.Errorf("unknown op %q", r.Op)
+	}
+	if r.For < 0 {
+		return fmt.Errorf("for must not be negative")
+	}
+
+	r.annotations = make(map[string]*template.Template, len(r.Annotations))
+	for k, text := range r.Annotations {
+		tmpl, err := template.New(k).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return fmt.Errorf("annotation %s: %w", k, err)
+		}
+		r.annotations[k] = tmpl
+	}
+	return nil
+}
+
+var comparators = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// matches reports whether the series id belongs to the rule and returns
+// its labels.
+func (r *Rule) matches(id string) (map[string]string, bool) {
+	name, labels, err := models.ParseSeriesID(id)
+	if err != nil || name != r.name {
+		return nil, false
+	}
+	for k, v := range r.matchLabels {
+		if labels[k] != v {
+			return nil, false
+		}
+	}
+	return labels, true
+}
+
+// annotate renders the rule's annotations for one alert. A template that
+// fails to execute is left as written.
+func (r *Rule) annotate(value float64, labels map[string]string) map[string]string {
+	if len(r.annotations) == 0 {
+		return nil
+	}
+	data := struct {
+		Value  float64
+		Labels map[string]string
+	}{value, labels}
+
+	out := make(map[string]string, len(r.annotations))
+	for k, tmpl := range r.annotations {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			out[k] = r.Annotations[k]
+			continue
+		}
+		out[k] = b.String()
+	}
+	return out
+}
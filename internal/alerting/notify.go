@@ -0,0 +1,167 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+// Notification is the JSON body POSTed to webhooks, modelled on the
+// Alertmanager webhook payload. Status is firing while any alert of the
+// group fires.
+type Notification struct {
+	Version     string            `json:"version"`
+	Status      string            `json:"status"`
+	GroupKey    string            `json:"groupKey"`
+	GroupLabels map[string]string `json:"groupLabels"`
+	Alerts      []NotifiedAlert   `json:"alerts"`
+}
+
+type NotifiedAlert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Value       float64           `json:"value"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      *time.Time        `json:"endsAt,omitempty"`
+}
+
+// notify sends one notification per group that has alerts whose state has
+// not been sent yet, or that still fires after the repeat interval.
+// Silenced alerts are left out. It must be called with mu held.
+func (m *Manager) notify(now time.Time) {
+	groups := make(map[string][]*Alert)
+	for _, a := range m.alerts {
+		if a.Silenced || a.State == StatePending || (a.State == StateResolved && a.notified) {
+			continue
+		}
+		key := m.groupKey(a.Labels)
+		groups[key] = append(groups[key], a)
+	}
+
+	for key, alerts := range groups {
+		due, firing := false, false
+		for _, a := range alerts {
+			due = due || !a.notified
+			firing = firing || a.State == StateFiring
+		}
+		last, sent := m.groups[key]
+		if !due && firing && (!sent || now.Sub(last) >= time.Duration(m.cfg.RepeatInterval)) {
+			due = true
+		}
+		if !due {
+			continue
+		}
+
+		sort.Slice(alerts, func(i, j int) bool {
+			if alerts[i].Rule != alerts[j].Rule {
+				return alerts[i].Rule < alerts[j].Rule
+			}
+			return alerts[i].Series < alerts[j].Series
+		})
+		n := Notification{Version: "1", Status: StateResolved, GroupKey: key, GroupLabels: m.groupLabels(alerts[0].Labels)}
+		for _, a := range alerts {
+			if a.State == StateFiring {
+				n.Status = StateFiring
+			}
+			n.Alerts = append(n.Alerts, NotifiedAlert{
+				Status:      a.State,
+				Labels:      a.Labels,
+				Annotations: a.Annotations,
+				Value:       a.Value,
+				StartsAt:    *a.FiredAt,
+				EndsAt:      a.ResolvedAt,
+			})
+			a.notified = true
+		}
+
+		if firing {
+			m.groups[key] = now
+		} else {
+			delete(m.groups, key)
+		}
+		m.send(n)
+	}
+}
+
+func (m *Manager) groupLabels(labels map[string]string) map[string]string {
+	group := make(map[string]string, len(m.cfg.GroupBy))
+	for _, name := range m.cfg.GroupBy {
+		if v, ok := labels[name]; ok {
+			group[name] = v
+		}
+	}
+	return group
+}
+
+func (m *Manager) groupKey(labels map[string]string) string {
+	return models.SeriesID("", m.groupLabels(labels))
+}
+
+// send delivers n to every webhook in the background.
+func (m *Manager) send(n Notification) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		log.Printf("Failed to encode alert notification: %v", err)
+		return
+	}
+	for _, w := range m.cfg.Webhooks {
+		m.deliveries.Add(1)
+		go func(w Webhook) {
+			defer m.deliveries.Done()
+			if err := m.deliver(w, body); err != nil {
+				log.Printf("Failed to notify %s of %s: %v", w.URL, n.GroupKey, err)
+			}
+		}(w)
+	}
+}
+
+// deliver POSTs body to w, retrying failed attempts with exponential
+// backoff capped at MaxRetryBackoff.
+func (m *Manager) deliver(w Webhook, body []byte) error {
+	backoff := time.Duration(m.cfg.RetryBackoff)
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = m.post(w, body); err == nil {
+			return nil
+		}
+		if attempt == *m.cfg.Retries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+		time.Sleep(backoff)
+		if backoff < MaxRetryBackoff {
+			backoff = min(2*backoff, MaxRetryBackoff)
+		}
+	}
+}
+
+func (m *Manager) post(w Webhook, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(w.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package alerting
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrSilenceNotFound = errors.New("silence not found")
+
+// Silence mutes notifications for alerts whose labels include all of
+// Matchers between StartsAt and EndsAt. Silenced alerts are still
+// evaluated and listed.
+type Silence struct {
+	ID        string            `json:"id"`
+	Matchers  map[string]string `json:"matchers"`
+	StartsAt  time.Time         `json:"starts_at"`
+	EndsAt    time.Time         `json:"ends_at"`
+	Comment   string            `json:"comment,omitempty"`
+	CreatedBy string            `json:"created_by,omitempty"`
+}
+
+func (s Silence) active(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+func (s Silence) matches(labels map[string]string) bool {
+	for k, v := range s.Matchers {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// AddSilence stores s under a new ID, starting now when StartsAt is not
+// set, and returns it.
+func (m *Manager) AddSilence(s Silence) (Silence, error) {
+	if len(s.Matchers) == 0 {
+		return Silence{}, fmt.Errorf("a silence needs at least one matcher")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return Silence{}, fmt.Errorf("ends_at must be after starts_at")
+	}
+	if !s.EndsAt.After(now) {
+		return Silence{}, fmt.Errorf("ends_at must be in the future")
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return Silence{}, err
+	}
+	s.ID = hex.EncodeToString(b)
+	m.silences[s.ID] = s
+	for _, a := range m.alerts {
+		a.Silenced = m.silenced(a.Labels, now)
+	}
+	return s, nil
+}
+
+// DeleteSilence expires a silence; alerts it muted are notified on the next
+// evaluation if their state has changed meanwhile.
+func (m *Manager) DeleteSilence(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.silences[id]; !ok {
+		return ErrSilenceNotFound
+	}
+	delete(m.silences, id)
+	return nil
+}
+
+// Silences returns the silences that have not ended, sorted by end time.
+func (m *Manager) Silences() []Silence {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	silences := make([]Silence, 0, len(m.silences))
+	for id, s := range m.silences {
+		if !now.Before(s.EndsAt) {
+			delete(m.silences, id)
+			continue
+		}
+		silences = append(silences, s)
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		if !silences[i].EndsAt.Equal(silences[j].EndsAt) {
+			return silences[i].EndsAt.Before(silences[j].EndsAt)
+		}
+		return silences[i].ID < silences[j].ID
+	})
+	return silences
+}
+
+// silenced must be called with mu held.
+func (m *Manager) silenced(labels map[string]string, now time.Time) bool {
+	for _, s := range m.silences {
+		if s.active(now) && s.matches(labels) {
+			return true
+		}
+	}
+	return false
+}
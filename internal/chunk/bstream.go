@@ -0,0 +1,61 @@
+package chunk
+
+import "io"
+
+// bstream is an append-only stream of bits, filled from the most
+// significant bit of each byte.
+type bstream struct {
+	data []byte
+	// free is the number of unused bits in the last byte.
+	free int
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if bit {
+		b.writeBits(1, 1)
+	} else {
+		b.writeBits(0, 1)
+	}
+}
+
+// writeBits writes the low n bits of u, most significant first.
+func (b *bstream) writeBits(u uint64, n int) {
+	for n > 0 {
+		if b.free == 0 {
+			b.data = append(b.data, 0)
+			b.free = 8
+		}
+		k := min(b.free, n)
+		bits := byte(u>>(n-k)) & (1<<k - 1)
+		b.data[len(b.data)-1] |= bits << (b.free - k)
+		b.free -= k
+		n -= k
+	}
+}
+
+// breader reads the bits written to a bstream.
+type breader struct {
+	data []byte
+	pos  int
+}
+
+func (r *breader) readBit() (bool, error) {
+	bit, err := r.readBits(1)
+	return bit == 1, err
+}
+
+func (r *breader) readBits(n int) (uint64, error) {
+	var u uint64
+	for n > 0 {
+		if r.pos>>3 >= len(r.data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		avail := 8 - r.pos&7
+		k := min(avail, n)
+		bits := (r.data[r.pos>>3] >> (avail - k)) & (1<<k - 1)
+		u = u<<k | uint64(bits)
+		r.pos += k
+		n -= k
+	}
+	return u, nil
+}
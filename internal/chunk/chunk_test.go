@@ -0,0 +1,150 @@
+package chunk
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// agentSamples imitates an agent reporting every 10 seconds with some jitter:
+// a gauge wandering around a value with two decimals when counter is false,
+// otherwise the running total of a counter.
+func agentSamples(n int, counter bool) []sample {
+	rng := rand.New(rand.NewSource(1))
+	samples := make([]sample, n)
+	t, v := int64(1_700_000_000_000), 1000.0
+	for i := range samples {
+		t += 10_000 + rng.Int63n(50) - 25
+		if counter {
+			v += float64(rng.Intn(10))
+		} else {
+			v = math.Round((v+rng.Float64()*10-5)*100) / 100
+		}
+		samples[i] = sample{t, v}
+	}
+	return samples
+}
+
+func collect(it interface {
+	Next() bool
+	At() (int64, float64)
+}) []sample {
+	var samples []sample
+	for it.Next() {
+		t, v := it.At()
+		samples = append(samples, sample{t, v})
+	}
+	return samples
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	cases := map[string][]sample{
+		"gauge":   agentSamples(SamplesPerChunk, false),
+		"counter": agentSamples(SamplesPerChunk, true),
+		"special": {
+			{0, 0}, {1, math.Inf(1)}, {2, math.Inf(-1)}, {3, -0.0}, {4, math.MaxFloat64},
+			{5, math.SmallestNonzeroFloat64}, {6, 1}, {7, 1}, {8, -1},
+		},
+		"irregular": {
+			{-5, 1}, {1 << 40, 2}, {1<<40 + 1, 3}, {1<<40 + 1_000_000, 4}, {1<<40 + 1_000_001, 5},
+			{1<<40 + 1_000_001, 6}, {1<<40 + 999_000, 7}, {math.MaxInt64, 8}, {math.MinInt64, 9},
+		},
+	}
+	for name, samples := range cases {
+		var a Appender
+		for _, s := range samples {
+			a.Append(s.t, s.v)
+		}
+		c := a.Seal()
+		assert.Equal(t, len(samples), c.Count(), name)
+		assert.Equal(t, samples[0].t, c.MinTime(), name)
+		assert.Equal(t, samples[len(samples)-1].t, c.MaxTime(), name)
+
+		it := c.Iterator()
+		assert.Equal(t, samples, collect(it), name)
+		assert.NoError(t, it.Err(), name)
+	}
+
+	var a Appender
+	a.Append(1, math.NaN())
+	a.Append(2, 1)
+	it := a.Seal().Iterator()
+	assert.True(t, it.Next())
+	_, v := it.At()
+	assert.True(t, math.IsNaN(v))
+
+	it = newIterator([]byte{1, 2, 3}, 2)
+	assert.False(t, it.Next())
+	assert.Error(t, it.Err(), "truncated data")
+}
+
+func TestSeries(t *testing.T) {
+	var s Series
+	samples := agentSamples(3*SamplesPerChunk+10, false)
+	for _, sample := range samples {
+		s.Append(sample.t, sample.v)
+	}
+	assert.Equal(t, len(samples), s.Len())
+	assert.Len(t, s.sealed, 3)
+	assert.Equal(t, samples, collect(s.Iterator(math.MinInt64, math.MaxInt64)))
+
+	from, to := samples[100].t, samples[250].t
+	assert.Equal(t, samples[100:251], collect(s.Iterator(from, to)))
+	assert.Equal(t, samples[len(samples)-1:], collect(s.Iterator(samples[len(samples)-1].t, math.MaxInt64)))
+	assert.Empty(t, collect(s.Iterator(to+1, to+2)))
+
+	last := samples[len(samples)-1]
+	s.Append(last.t-1, 42)
+	got := collect(s.Iterator(last.t, last.t))
+	assert.Equal(t, []sample{{last.t, 42}}, got, "an older sample replaces the last value")
+	assert.Equal(t, len(samples), s.Len())
+
+	assert.Equal(t, 130, s.DropBefore(samples[130].t))
+	assert.Len(t, s.sealed, 2)
+	assert.Equal(t, samples[130], collect(s.Iterator(math.MinInt64, math.MaxInt64))[0])
+	assert.Equal(t, len(samples)-130, s.Len())
+
+	assert.Equal(t, len(samples)-130, s.DropBefore(math.MaxInt64))
+	assert.Equal(t, 0, s.Len())
+	assert.Empty(t, collect(s.Iterator(math.MinInt64, math.MaxInt64)))
+
+	s.Append(1, 1)
+	s.Append(2, 2)
+	assert.Equal(t, 1, s.DropBefore(2), "the head chunk is re-encoded")
+	assert.Equal(t, []sample{{2, 2}}, collect(s.Iterator(0, 10)))
+}
+
+func benchmarkAppend(b *testing.B, counter bool) {
+	samples := agentSamples(10*SamplesPerChunk, counter)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var s Series
+	for i := 0; i < b.N; i++ {
+		s = Series{}
+		for _, sample := range samples {
+			s.Append(sample.t, sample.v)
+		}
+	}
+	b.ReportMetric(float64(s.Size())/float64(s.Len()), "bytes/sample")
+}
+
+func BenchmarkAppendGauge(b *testing.B)   { benchmarkAppend(b, false) }
+func BenchmarkAppendCounter(b *testing.B) { benchmarkAppend(b, true) }
+
+func BenchmarkIterate(b *testing.B) {
+	var s Series
+	samples := agentSamples(10*SamplesPerChunk, false)
+	for _, sample := range samples {
+		s.Append(sample.t, sample.v)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := s.Iterator(math.MinInt64, math.MaxInt64)
+		for it.Next() {
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(samples)), "ns/sample")
+}
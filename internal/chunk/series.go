@@ -0,0 +1,186 @@
+package chunk
+
+// SamplesPerChunk is how many samples the head chunk takes before it is
+// sealed.
+const SamplesPerChunk = 120
+
+// Series is the history of one series: sealed chunks, the head chunk they
+// were sealed from, and the newest sample, which is kept uncompressed until
+// a newer one arrives so that it can still be replaced.
+type Series struct {
+	sealed []*Chunk
+	head   Appender
+
+	last    sample
+	hasLast bool
+}
+
+type sample struct {
+	t int64
+	v float64
+}
+
+// Append adds a sample to the series. Samples never go back in time: a
+// sample that is not newer than the last one replaces its value.
+func (s *Series) Append(t int64, v float64) {
+	if s.hasLast && t <= s.last.t {
+		s.last.v = v
+		return
+	}
+	if s.hasLast {
+		s.head.Append(s.last.t, s.last.v)
+		if s.head.Count() >= SamplesPerChunk {
+			s.sealed = append(s.sealed, s.head.Seal())
+			s.head = Appender{}
+		}
+	}
+	s.last, s.hasLast = sample{t, v}, true
+}
+
+// Len returns the number of samples in the series.
+func (s *Series) Len() int {
+	n := s.head.Count()
+	for _, c := range s.sealed {
+		n += c.Count()
+	}
+	if s.hasLast {
+		n++
+	}
+	return n
+}
+
+// Size returns the number of bytes the samples of the series take.
+func (s *Series) Size() int {
+	n := s.head.Size()
+	for _, c := range s.sealed {
+		n += c.Size()
+	}
+	if s.hasLast {
+		n += 16
+	}
+	return n
+}
+
+// Iterator returns an iterator over the samples with timestamps in
+// [mint, maxt], oldest first. It is invalidated by changes to the series.
+func (s *Series) Iterator(mint, maxt int64) *SeriesIterator {
+	it := &SeriesIterator{series: s, mint: mint, maxt: maxt}
+	for it.next < len(s.sealed) && s.sealed[it.next].MaxTime() < mint {
+		it.next++
+	}
+	return it
+}
+
+// DropBefore deletes the samples older than t and returns how many it
+// deleted. A chunk that holds samples on both sides of t is re-encoded.
+func (s *Series) DropBefore(t int64) int {
+	dropped := 0
+	expired := 0
+	for expired < len(s.sealed) && s.sealed[expired].MaxTime() < t {
+		dropped += s.sealed[expired].Count()
+		expired++
+	}
+	if expired > 0 {
+		s.sealed = append([]*Chunk(nil), s.sealed[expired:]...)
+	}
+	if len(s.sealed) > 0 {
+		if s.sealed[0].MinTime() < t {
+			head, n := keepFrom(s.sealed[0].Iterator(), t)
+			s.sealed[0] = head.Seal()
+			dropped += n
+		}
+		return dropped
+	}
+
+	if s.head.Count() > 0 && s.head.minT < t {
+		head, n := keepFrom(s.head.Iterator(), t)
+		s.head = head
+		dropped += n
+	}
+	if s.hasLast && s.last.t < t {
+		s.hasLast = false
+		dropped++
+	}
+	return dropped
+}
+
+// keepFrom re-encodes the samples of it from t on and returns them with
+// the number of samples left out.
+func keepFrom(it *Iterator, t int64) (Appender, int) {
+	var a Appender
+	dropped := 0
+	for it.Next() {
+		ts, v := it.At()
+		if ts < t {
+			dropped++
+			continue
+		}
+		a.Append(ts, v)
+	}
+	return a, dropped
+}
+
+// SeriesIterator walks the samples of a Series within a time range.
+type SeriesIterator struct {
+	series     *Series
+	mint, maxt int64
+	// next is the index of the next sealed chunk, then len(sealed) for the
+	// head chunk and len(sealed)+1 for the last sample.
+	next int
+	cur  *Iterator
+	t    int64
+	v    float64
+	err  error
+	done bool
+}
+
+// Next advances to the next sample in range and reports whether there was
+// one.
+func (it *SeriesIterator) Next() bool {
+	for !it.done {
+		if it.cur != nil && it.cur.Next() {
+			t, v := it.cur.At()
+			if t < it.mint {
+				continue
+			}
+			if t > it.maxt {
+				it.done = true
+				return false
+			}
+			it.t, it.v = t, v
+			return true
+		}
+		if it.cur != nil && it.cur.Err() != nil {
+			it.err, it.done = it.cur.Err(), true
+			return false
+		}
+		it.cur = nil
+
+		s := it.series
+		switch {
+		case it.next < len(s.sealed):
+			it.cur = s.sealed[it.next].Iterator()
+		case it.next == len(s.sealed):
+			it.cur = s.head.Iterator()
+		default:
+			it.done = true
+			if s.hasLast && s.last.t >= it.mint && s.last.t <= it.maxt {
+				it.t, it.v = s.last.t, s.last.v
+				return true
+			}
+			return false
+		}
+		it.next++
+	}
+	return false
+}
+
+// At returns the current sample.
+func (it *SeriesIterator) At() (int64, float64) {
+	return it.t, it.v
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *SeriesIterator) Err() error {
+	return it.err
+}
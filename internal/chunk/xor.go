@@ -0,0 +1,260 @@
+// Package chunk keeps the history of a series in memory compressed as in
+// Facebook's Gorilla paper: timestamps as deltas of deltas and values XORed
+// with the one before, so regular samples of slowly changing values take a
+// few bits instead of 16 bytes. Samples go into an open head chunk that is
+// sealed into an immutable Chunk once it holds SamplesPerChunk samples.
+package chunk
+
+import (
+	"math"
+	"math/bits"
+)
+
+// Chunk is a sealed, immutable run of compressed samples.
+type Chunk struct {
+	data       []byte
+	count      int
+	minT, maxT int64
+}
+
+// Count returns the number of samples in the chunk.
+func (c *Chunk) Count() int { return c.count }
+
+// MinTime returns the timestamp of the first sample.
+func (c *Chunk) MinTime() int64 { return c.minT }
+
+// MaxTime returns the timestamp of the last sample.
+func (c *Chunk) MaxTime() int64 { return c.maxT }
+
+// Size returns the number of bytes the compressed samples take.
+func (c *Chunk) Size() int { return len(c.data) }
+
+// Iterator returns an iterator over the samples of the chunk.
+func (c *Chunk) Iterator() *Iterator {
+	return newIterator(c.data, c.count)
+}
+
+// Appender compresses samples into a chunk that is still open. Timestamps
+// should not decrease, though the encoding tolerates it.
+type Appender struct {
+	b         bstream
+	count     int
+	minT, t   int64
+	delta     int64
+	v         float64
+	leading   uint8
+	trailing  uint8
+	hasWindow bool
+}
+
+// Count returns the number of samples appended.
+func (a *Appender) Count() int { return a.count }
+
+// Size returns the number of bytes the compressed samples take.
+func (a *Appender) Size() int { return len(a.b.data) }
+
+// Append adds a sample to the chunk.
+func (a *Appender) Append(t int64, v float64) {
+	switch a.count {
+	case 0:
+		a.minT = t
+		a.b.writeBits(uint64(t), 64)
+		a.b.writeBits(math.Float64bits(v), 64)
+	default:
+		delta := t - a.t
+		writeDoD(&a.b, delta-a.delta)
+		a.delta = delta
+		writeXOR(&a.b, v, a.v, &a.leading, &a.trailing, &a.hasWindow)
+	}
+	a.t, a.v = t, v
+	a.count++
+}
+
+// Seal returns the samples appended so far as an immutable Chunk.
+func (a *Appender) Seal() *Chunk {
+	return &Chunk{
+		data:  append([]byte(nil), a.b.data...),
+		count: a.count,
+		minT:  a.minT,
+		maxT:  a.t,
+	}
+}
+
+// Iterator returns an iterator over the samples appended so far. It is
+// invalidated by the next Append.
+func (a *Appender) Iterator() *Iterator {
+	return newIterator(a.b.data, a.count)
+}
+
+// Timestamp deltas of deltas are stored in the smallest of these signed
+// widths they fit in, behind a prefix of one bits naming the width: 0 for a
+// delta of delta of zero, 10 for 14 bits, 110 for 17, 1110 for 20 and 1111
+// for a full 64 bits.
+var dodWidths = [...]int{14, 17, 20}
+
+func writeDoD(b *bstream, dod int64) {
+	if dod == 0 {
+		b.writeBit(false)
+		return
+	}
+	for i, width := range dodWidths {
+		if dod >= -(1<<(width-1)) && dod < 1<<(width-1) {
+			b.writeBits(1<<(i+2)-2, i+2)
+			b.writeBits(uint64(dod), width)
+			return
+		}
+	}
+	b.writeBits(0b1111, 4)
+	b.writeBits(uint64(dod), 64)
+}
+
+func readDoD(r *breader) (int64, error) {
+	prefix := 0
+	for prefix < 4 {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		prefix++
+	}
+	if prefix == 0 {
+		return 0, nil
+	}
+	width := 64
+	if prefix <= len(dodWidths) {
+		width = dodWidths[prefix-1]
+	}
+	u, err := r.readBits(width)
+	if err != nil {
+		return 0, err
+	}
+	if width < 64 && u >= 1<<(width-1) {
+		return int64(u) - 1<<width, nil
+	}
+	return int64(u), nil
+}
+
+// writeXOR stores v as its XOR with the previous value: a 0 bit when they
+// are equal, otherwise the meaningful bits of the XOR, reusing the window
+// of leading and trailing zeros of the previous XOR when it fits.
+func writeXOR(b *bstream, v, prev float64, leading, trailing *uint8, hasWindow *bool) {
+	x := math.Float64bits(v) ^ math.Float64bits(prev)
+	if x == 0 {
+		b.writeBit(false)
+		return
+	}
+	b.writeBit(true)
+
+	l, t := uint8(bits.LeadingZeros64(x)), uint8(bits.TrailingZeros64(x))
+	// The number of leading zeros is stored in 5 bits.
+	l = min(l, 31)
+	if *hasWindow && l >= *leading && t >= *trailing {
+		b.writeBit(false)
+		b.writeBits(x>>*trailing, 64-int(*leading)-int(*trailing))
+		return
+	}
+	*leading, *trailing, *hasWindow = l, t, true
+	sig := 64 - int(l) - int(t)
+	b.writeBit(true)
+	b.writeBits(uint64(l), 5)
+	// 64 meaningful bits do not fit in 6 bits and are stored as 0, which
+	// cannot otherwise occur.
+	b.writeBits(uint64(sig)&0x3f, 6)
+	b.writeBits(x>>t, sig)
+}
+
+func readXOR(r *breader, prev float64, leading, trailing *uint8) (float64, error) {
+	bit, err := r.readBit()
+	if err != nil || !bit {
+		return prev, err
+	}
+	newWindow, err := r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if newWindow {
+		l, err := r.readBits(5)
+		if err != nil {
+			return 0, err
+		}
+		sig, err := r.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		if sig == 0 {
+			sig = 64
+		}
+		*leading, *trailing = uint8(l), uint8(64-l-sig)
+	}
+	x, err := r.readBits(64 - int(*leading) - int(*trailing))
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(math.Float64bits(prev) ^ x<<*trailing), nil
+}
+
+// Iterator decodes the samples of a chunk in order.
+type Iterator struct {
+	r        breader
+	count    int
+	read     int
+	t, delta int64
+	v        float64
+	leading  uint8
+	trailing uint8
+	err      error
+}
+
+func newIterator(data []byte, count int) *Iterator {
+	return &Iterator{r: breader{data: data}, count: count}
+}
+
+// Next advances to the next sample and reports whether there was one.
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.read == it.count {
+		return false
+	}
+	if it.read == 0 {
+		t, err := it.r.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		v, err := it.r.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.t, it.v = int64(t), math.Float64frombits(v)
+		it.read++
+		return true
+	}
+
+	dod, err := readDoD(&it.r)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.delta += dod
+	it.t += it.delta
+	if it.v, err = readXOR(&it.r, it.v, &it.leading, &it.trailing); err != nil {
+		it.err = err
+		return false
+	}
+	it.read++
+	return true
+}
+
+// At returns the current sample.
+func (it *Iterator) At() (int64, float64) {
+	return it.t, it.v
+}
+
+// Err returns the error that stopped the iteration, if any. Only corrupt
+// data causes one.
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -4,34 +4,93 @@ import (
 	"context"
 
 	"fmt"
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"log"
 )
 
-func ConnectToDB(dsn string) (*pgx.Conn, error) {
-	conn, err := pgx.Connect(context.Background(), dsn)
+// ConnectToDB opens a connection pool, so HTTP handlers and background
+// jobs such as compaction can use the database at the same time.
+func ConnectToDB(dsn string) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.New(context.Background(), dsn)
+	if err == nil {
+		// The pool connects lazily; fail now rather than on first use.
+		if err = pool.Ping(context.Background()); err != nil {
+			pool.Close()
+		}
+	}
 	if err != nil {
 		log.Printf("Unable to connect to database: %v\n", err)
 		return nil, err
 	}
 
-	return conn, nil
+	return pool, nil
 }
 
-func InitializeTables(conn *pgx.Conn) error {
+func InitializeTables(conn *pgxpool.Pool) error {
 	gaugeTableQuery := `
 	CREATE TABLE IF NOT EXISTS gauge_metrics (
 		name TEXT PRIMARY KEY,
-		value DOUBLE PRECISION
+		value DOUBLE PRECISION,
+		ts BIGINT
 	);
+	ALTER TABLE gauge_metrics ADD COLUMN IF NOT EXISTS ts BIGINT;
+	UPDATE gauge_metrics SET ts = (EXTRACT(EPOCH FROM now()) * 1000)::BIGINT WHERE ts IS NULL;
 	`
 	counterTableQuery := `
 	CREATE TABLE IF NOT EXISTS counter_metrics (
 		name TEXT PRIMARY KEY,
-		value BIGINT
+		value BIGINT,
+		ts BIGINT
+	);
+	ALTER TABLE counter_metrics ADD COLUMN IF NOT EXISTS ts BIGINT;
+	`
+
+	idempotencyTableQuery := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key TEXT PRIMARY KEY,
+		expires_at TIMESTAMPTZ NOT NULL
+	)
+	`
+
+	metadataTableQuery := `
+	CREATE TABLE IF NOT EXISTS metric_metadata (
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		unit TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		owner TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (name, type)
 	)
 	`
 
+	samplesTableQuery := `
+	CREATE TABLE IF NOT EXISTS metric_samples (
+		type TEXT NOT NULL,
+		name TEXT NOT NULL,
+		ts BIGINT NOT NULL,
+		value DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (type, name, ts)
+	)
+	`
+
+	rollupsTableQuery := `
+	CREATE TABLE IF NOT EXISTS metric_rollups (
+		type TEXT NOT NULL,
+		name TEXT NOT NULL,
+		step BIGINT NOT NULL,
+		ts BIGINT NOT NULL,
+		min DOUBLE PRECISION NOT NULL,
+		max DOUBLE PRECISION NOT NULL,
+		sum DOUBLE PRECISION NOT NULL,
+		count BIGINT NOT NULL,
+		PRIMARY KEY (type, name, step, ts)
+	);
+	CREATE TABLE IF NOT EXISTS rollup_watermarks (
+		step BIGINT PRIMARY KEY,
+		ts BIGINT NOT NULL
+	);
+	`
+
 	_, err := conn.Exec(context.Background(), gaugeTableQuery)
 	if err != nil {
 		return fmt.Errorf("failed to create gauge_metrics table: %w", err)
@@ -42,15 +101,35 @@ func InitializeTables(conn *pgx.Conn) error {
 		return fmt.Errorf("failed to create counter_metrics table: %w", err)
 	}
 
+	_, err = conn.Exec(context.Background(), idempotencyTableQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create idempotency_keys table: %w", err)
+	}
+
+	_, err = conn.Exec(context.Background(), metadataTableQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create metric_metadata table: %w", err)
+	}
+
+	_, err = conn.Exec(context.Background(), samplesTableQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create metric_samples table: %w", err)
+	}
+
+	_, err = conn.Exec(context.Background(), rollupsTableQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create metric_rollups table: %w", err)
+	}
+
 	return nil
 }
 
-func PingDB(conn *pgx.Conn) error {
+func PingDB(conn *pgxpool.Pool) error {
 	return conn.Ping(context.Background())
 }
 
-func CloseDB(conn *pgx.Conn) {
+func CloseDB(conn *pgxpool.Pool) {
 	if conn != nil {
-		conn.Close(context.Background())
+		conn.Close()
 	}
 }
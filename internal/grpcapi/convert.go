@@ -0,0 +1,73 @@
+package grpcapi
+
+import (
+	"fmt"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/proto/metricspb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ToModel converts a protobuf metric to models.Metrics, checking that the
+// type and the value field agree.
+func ToModel(m *metricspb.Metric) (models.Metrics, error) {
+	if m.GetId() == "" {
+		return models.Metrics{}, fmt.Errorf("metric id is required")
+	}
+
+	out := models.Metrics{ID: m.GetId()}
+	switch m.GetType() {
+	case metricspb.MetricType_METRIC_TYPE_GAUGE:
+		v, ok := m.GetData().(*metricspb.Metric_Value)
+		if !ok {
+			return models.Metrics{}, fmt.Errorf("gauge %q requires a value", m.GetId())
+		}
+		out.MType, out.Value = "gauge", &v.Value
+	case metricspb.MetricType_METRIC_TYPE_COUNTER:
+		d, ok := m.GetData().(*metricspb.Metric_Delta)
+		if !ok {
+			return models.Metrics{}, fmt.Errorf("counter %q requires a delta", m.GetId())
+		}
+		out.MType, out.Delta = "counter", &d.Delta
+	default:
+		return models.Metrics{}, fmt.Errorf("invalid metric type for %q", m.GetId())
+	}
+
+	if md := m.GetMeta(); md != nil {
+		out.Meta = &models.Metadata{Unit: md.GetUnit(), Description: md.GetDescription(), Owner: md.GetOwner()}
+	}
+	return out, nil
+}
+
+// FromModel converts models.Metrics to its protobuf form.
+func FromModel(m models.Metrics) *metricspb.Metric {
+	pm := &metricspb.Metric{Id: m.ID}
+	switch m.MType {
+	case "gauge":
+		pm.Type = metricspb.MetricType_METRIC_TYPE_GAUGE
+		if m.Value != nil {
+			pm.Data = &metricspb.Metric_Value{Value: *m.Value}
+		}
+	case "counter":
+		pm.Type = metricspb.MetricType_METRIC_TYPE_COUNTER
+		if m.Delta != nil {
+			pm.Data = &metricspb.Metric_Delta{Delta: *m.Delta}
+		}
+	}
+	if m.Meta != nil {
+		pm.Meta = &metricspb.Metadata{Unit: m.Meta.Unit, Description: m.Meta.Description, Owner: m.Meta.Owner}
+	}
+	return pm
+}
+
+func typeName(t metricspb.MetricType) (string, error) {
+	switch t {
+	case metricspb.MetricType_METRIC_TYPE_GAUGE:
+		return "gauge", nil
+	case metricspb.MetricType_METRIC_TYPE_COUNTER:
+		return "counter", nil
+	}
+	return "", status.Errorf(codes.InvalidArgument, "invalid metric type %v", t)
+}
@@ -0,0 +1,244 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hairutdin/metrics-service/internal/limits"
+	"github.com/hairutdin/metrics-service/internal/relabel"
+	"github.com/hairutdin/metrics-service/internal/validation"
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/proto/metricspb"
+	"github.com/hairutdin/metrics-service/storage"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // lets clients send gzip-compressed messages
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements metricspb.MetricsServiceServer on top of MetricsStorage.
+type Server struct {
+	metricspb.UnimplementedMetricsServiceServer
+	storage        storage.MetricsStorage
+	idempotencyTTL time.Duration
+	limiter        *limits.Limiter
+	relabel        *relabel.Engine
+	validation     validation.Policy
+}
+
+// IdempotencyKeyMetadata is the metadata key under which UpdateMetrics calls
+// may carry an idempotency key, the gRPC counterpart of the HTTP
+// Idempotency-Key header.
+const IdempotencyKeyMetadata = "idempotency-key"
+
+// Options configures NewGRPCServer.
+type Options struct {
+	// Token, when not empty, must be carried by every call as a bearer
+	// token in the authorization metadata.
+	Token string
+	// IdempotencyTTL is how long idempotency keys are remembered; zero
+	// means storage.DefaultIdempotencyTTL.
+	IdempotencyTTL time.Duration
+	// Limiter, when set, applies the cardinality limits to updates.
+	Limiter *limits.Limiter
+	// Relabel, when set, rewrites updates before they are stored.
+	Relabel *relabel.Engine
+	// Validation, when set, replaces validation.DefaultPolicy for updates.
+	Validation *validation.Policy
+}
+
+func NewServer(s storage.MetricsStorage) *Server {
+	return &Server{storage: s, idempotencyTTL: storage.DefaultIdempotencyTTL, validation: validation.DefaultPolicy()}
+}
+
+// NewGRPCServer returns a gRPC server with the metrics service registered.
+func NewGRPCServer(s storage.MetricsStorage, options Options) *grpc.Server {
+	var opts []grpc.ServerOption
+	if options.Token != "" {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(UnaryAuthInterceptor(options.Token)),
+			grpc.ChainStreamInterceptor(StreamAuthInterceptor(options.Token)),
+		)
+	}
+
+	server := NewServer(s)
+	if options.IdempotencyTTL > 0 {
+		server.idempotencyTTL = options.IdempotencyTTL
+	}
+	server.limiter = options.Limiter
+	server.relabel = options.Relabel
+	if options.Validation != nil {
+		server.validation = *options.Validation
+	}
+
+	srv := grpc.NewServer(opts...)
+	metricspb.RegisterMetricsServiceServer(srv, server)
+	return srv
+}
+
+// UpdateMetrics applies a batch. When the call carries an idempotency key,
+// a replay of an already applied batch is acknowledged without applying it
+// again.
+func (s *Server) UpdateMetrics(ctx context.Context, req *metricspb.UpdateMetricsRequest) (*metricspb.UpdateMetricsResponse, error) {
+	var key string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if keys := md.Get(IdempotencyKeyMetadata); len(keys) > 0 {
+			key = keys[0]
+		}
+	}
+
+	n, rejected, err := s.applyOnce(ctx, key, req.GetMetrics(), 0)
+	if err != nil {
+		return nil, err
+	}
+	return &metricspb.UpdateMetricsResponse{Accepted: n, Rejected: rejected}, nil
+}
+
+func (s *Server) UpdateMetricsStream(stream grpc.ClientStreamingServer[metricspb.UpdateMetricsRequest, metricspb.UpdateMetricsResponse]) error {
+	resp := &metricspb.UpdateMetricsResponse{}
+	var received int64
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+
+		n, rejected, err := s.applyOnce(stream.Context(), "", req.GetMetrics(), received)
+		if err != nil {
+			return err
+		}
+		resp.Accepted += n
+		resp.Rejected = append(resp.Rejected, rejected...)
+		received += int64(len(req.GetMetrics()))
+	}
+}
+
+func (s *Server) GetMetric(ctx context.Context, req *metricspb.GetMetricRequest) (*metricspb.Metric, error) {
+	metricType, err := typeName(req.GetType())
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := s.storage.GetMetric(metricType, req.GetId())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "metric %s %q not found", metricType, req.GetId())
+	}
+
+	m := models.Metrics{ID: req.GetId(), MType: metricType}
+	switch metricType {
+	case "gauge":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "invalid stored value %q", value)
+		}
+		m.Value = &v
+	case "counter":
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "invalid stored value %q", value)
+		}
+		m.Delta = &d
+	}
+	return FromModel(m), nil
+}
+
+func (s *Server) ListMetrics(ctx context.Context, req *metricspb.ListMetricsRequest) (*metricspb.ListMetricsResponse, error) {
+	metrics, err := s.storage.Snapshot()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to load metrics: %v", err)
+	}
+
+	resp := &metricspb.ListMetricsResponse{Metrics: make([]*metricspb.Metric, 0, len(metrics))}
+	for _, m := range metrics {
+		resp.Metrics = append(resp.Metrics, FromModel(m))
+	}
+	return resp, nil
+}
+
+// applyOnce stores a batch and returns how many metrics were accepted and
+// why the others were rejected; relabel rules may drop further series
+// silently. Rejection indexes start at offset.
+func (s *Server) applyOnce(ctx context.Context, key string, in []*metricspb.Metric, offset int64) (int64, []*metricspb.Rejection, error) {
+	if len(in) == 0 {
+		return 0, nil, nil
+	}
+
+	metrics := make([]models.Metrics, 0, len(in))
+	positions := make([]int, 0, len(in))
+	for i, pm := range in {
+		m, err := ToModel(pm)
+		if err != nil {
+			return 0, nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if m, ok := s.relabel.Apply(m); ok {
+			metrics = append(metrics, m)
+			positions = append(positions, i)
+		}
+	}
+
+	var rejected []*metricspb.Rejection
+	reject := func(i int, m models.Metrics, reason string) {
+		pm := FromModel(m)
+		rejected = append(rejected, &metricspb.Rejection{Index: offset + int64(i), Id: pm.GetId(), Type: pm.GetType(), Reason: reason})
+	}
+
+	accepted, invalid := s.validation.Split(metrics)
+	invalidAt := make(map[int]bool, len(invalid))
+	for _, rej := range invalid {
+		invalidAt[rej.Index] = true
+		reject(positions[rej.Index], metrics[rej.Index], rej.Reason)
+	}
+	kept := make([]int, 0, len(accepted))
+	for i, pos := range positions {
+		if !invalidAt[i] {
+			kept = append(kept, pos)
+		}
+	}
+	metrics, positions = accepted, kept
+	if len(metrics) == 0 {
+		return 0, rejected, nil
+	}
+
+	if s.limiter != nil {
+		var client string
+		if p, ok := peer.FromContext(ctx); ok {
+			client = limits.ClientID(p.Addr.String())
+		}
+		d, err := s.limiter.Admit(client, metrics)
+		if err != nil {
+			return 0, nil, status.Errorf(codes.Unavailable, "failed to check limits: %v", err)
+		}
+		if d.Throttled || (len(d.Admitted) == 0 && d.OverLimit()) {
+			return 0, nil, status.Error(codes.ResourceExhausted, d.Reason())
+		}
+		if len(d.Admitted) == 0 {
+			return 0, nil, status.Error(codes.InvalidArgument, d.Reason())
+		}
+		for _, rej := range d.Rejected {
+			reject(positions[rej.Index], rej.Metric, rej.Reason)
+		}
+		metrics = d.Admitted
+	}
+	sort.SliceStable(rejected, func(i, j int) bool { return rejected[i].Index < rejected[j].Index })
+
+	var err error
+	if key != "" {
+		_, err = s.storage.UpdateMetricsBatchOnce(key, metrics, s.idempotencyTTL)
+	} else {
+		err = s.storage.UpdateMetricsBatch(metrics)
+	}
+	if err != nil {
+		return 0, nil, status.Errorf(codes.Unavailable, "failed to update metrics: %v", err)
+	}
+	return int64(len(metrics)), rejected, nil
+}
@@ -0,0 +1,167 @@
+package grpcapi
+
+import (
+	"context"
+	"math"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/hairutdin/metrics-service/proto/metricspb"
+	"github.com/hairutdin/metrics-service/storage"
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func startServer(t *testing.T, s storage.MetricsStorage, token string, clientToken string) metricspb.MetricsServiceClient {
+	listener := bufconn.Listen(1 << 20)
+	srv := NewGRPCServer(s, Options{Token: token})
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	opts := []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor(grpcgzip.Name)),
+	}
+	if clientToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(TokenCredentials(clientToken)))
+	}
+	conn, err := grpc.NewClient("passthrough:///bufnet", opts...)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return metricspb.NewMetricsServiceClient(conn)
+}
+
+func gaugeMetric(id string, v float64) *metricspb.Metric {
+	return &metricspb.Metric{Id: id, Type: metricspb.MetricType_METRIC_TYPE_GAUGE, Data: &metricspb.Metric_Value{Value: v}}
+}
+
+func counterMetric(id string, d int64) *metricspb.Metric {
+	return &metricspb.Metric{Id: id, Type: metricspb.MetricType_METRIC_TYPE_COUNTER, Data: &metricspb.Metric_Delta{Delta: d}}
+}
+
+func TestUpdateAndQuery(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	client := startServer(t, memStorage, "secret", "secret")
+	ctx := context.Background()
+
+	resp, err := client.UpdateMetrics(ctx, &metricspb.UpdateMetricsRequest{
+		Metrics: []*metricspb.Metric{gaugeMetric("Alloc", 12.5), counterMetric("PollCount", 2)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), resp.GetAccepted())
+
+	stream, err := client.UpdateMetricsStream(ctx)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, stream.Send(&metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{counterMetric("PollCount", 1)}}))
+	}
+	resp, err = stream.CloseAndRecv()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), resp.GetAccepted())
+
+	metric, err := client.GetMetric(ctx, &metricspb.GetMetricRequest{Id: "PollCount", Type: metricspb.MetricType_METRIC_TYPE_COUNTER})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), metric.GetDelta())
+
+	_, err = client.GetMetric(ctx, &metricspb.GetMetricRequest{Id: "Missing", Type: metricspb.MetricType_METRIC_TYPE_GAUGE})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := client.ListMetrics(ctx, &metricspb.ListMetricsRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, list.GetMetrics(), 2)
+}
+
+func TestUpdateRegistersMetadata(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	client := startServer(t, memStorage, "", "")
+
+	m := gaugeMetric("Alloc", 1)
+	m.Meta = &metricspb.Metadata{Unit: "bytes", Description: "Bytes of allocated heap objects."}
+	_, err := client.UpdateMetrics(context.Background(), &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{m}})
+	assert.NoError(t, err)
+
+	registry, err := memStorage.ListMetadata()
+	assert.NoError(t, err)
+	if assert.Len(t, registry, 1) {
+		assert.Equal(t, "Alloc", registry[0].Name)
+		assert.Equal(t, "bytes", registry[0].Unit)
+	}
+}
+
+func TestUpdateRejectsInvalidMetric(t *testing.T) {
+	client := startServer(t, storage.NewMemStorage(), "", "")
+
+	_, err := client.UpdateMetrics(context.Background(), &metricspb.UpdateMetricsRequest{
+		Metrics: []*metricspb.Metric{{Id: "Alloc", Type: metricspb.MetricType_METRIC_TYPE_GAUGE}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestUpdateReportsRejectedMetrics(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	client := startServer(t, memStorage, "", "")
+	ctx := context.Background()
+
+	resp, err := client.UpdateMetrics(ctx, &metricspb.UpdateMetricsRequest{
+		Metrics: []*metricspb.Metric{gaugeMetric("Ratio", math.Inf(1)), gaugeMetric("Alloc", 1), gaugeMetric(strings.Repeat("a", 300), 1)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), resp.GetAccepted())
+	if assert.Len(t, resp.GetRejected(), 2) {
+		assert.Equal(t, int64(0), resp.GetRejected()[0].GetIndex())
+		assert.Equal(t, "Ratio", resp.GetRejected()[0].GetId())
+		assert.Equal(t, metricspb.MetricType_METRIC_TYPE_GAUGE, resp.GetRejected()[0].GetType())
+		assert.Contains(t, resp.GetRejected()[0].GetReason(), "infinite")
+		assert.Equal(t, int64(2), resp.GetRejected()[1].GetIndex())
+	}
+	_, ok := memStorage.Gauges()["Ratio"]
+	assert.False(t, ok)
+
+	stream, err := client.UpdateMetricsStream(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Send(&metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{gaugeMetric("Alloc", 2)}}))
+	assert.NoError(t, stream.Send(&metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{gaugeMetric("Ratio", math.NaN())}}))
+	resp, err = stream.CloseAndRecv()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), resp.GetAccepted())
+	if assert.Len(t, resp.GetRejected(), 1) {
+		assert.Equal(t, int64(1), resp.GetRejected()[0].GetIndex(), "stream indexes count across requests")
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	client := startServer(t, storage.NewMemStorage(), "secret", "wrong")
+
+	_, err := client.ListMetrics(context.Background(), &metricspb.ListMetricsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	stream, err := client.UpdateMetricsStream(context.Background())
+	if err == nil {
+		_, err = stream.CloseAndRecv()
+	}
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestUpdateMetricsIdempotencyKey(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	client := startServer(t, memStorage, "", "")
+	ctx := metadata.AppendToOutgoingContext(context.Background(), IdempotencyKeyMetadata, "batch-1")
+	req := &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{counterMetric("PollCount", 2)}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.UpdateMetrics(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), resp.GetAccepted())
+	}
+	assert.Equal(t, int64(2), memStorage.Counters()["PollCount"])
+}
@@ -0,0 +1,387 @@
+// Package limits protects storage from unbounded series growth: it caps the
+// total number of series and the rate at which each client creates new ones,
+// and enforces a naming policy.
+package limits
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+)
+
+// Action says what happens to a request that would exceed a series limit.
+type Action string
+
+const (
+	// ActionReject refuses the whole request.
+	ActionReject Action = "reject"
+	// ActionDrop stores the request without the series over the limit.
+	ActionDrop Action = "drop"
+	// ActionSample is ActionDrop, except that one in SampleRate series over
+	// the per-client rate is still admitted so new series trickle in. The
+	// total series cap is never exceeded.
+	ActionSample Action = "sample"
+)
+
+// Rejection reasons, also used as the reason label of the rejected series
+// counter.
+const (
+	ReasonSeriesLimit = "series_limit"
+	ReasonRateLimit   = "rate_limit"
+	ReasonName        = "name"
+	// ReasonThrottled marks metrics that were within the limits but
+	// refused along with the rest of a rejected request. They are not
+	// counted as rejected series.
+	ReasonThrottled = "throttled"
+)
+
+// RejectedMetric is the name of the counter of rejected series.
+const RejectedMetric = "metrics_service_rejected_series_total"
+
+const rateWindow = time.Minute
+
+type Config struct {
+	// MaxSeries caps the number of stored series; 0 means no limit.
+	MaxSeries int
+	// MaxNewSeriesPerMinute caps how many series one client may create
+	// per minute; 0 means no limit.
+	MaxNewSeriesPerMinute int
+	// NamePattern, when set, must match every metric name (the ID
+	// without labels).
+	NamePattern *regexp.Regexp
+	Action      Action
+	// SampleRate is the N of "one in N" for ActionSample.
+	SampleRate int
+}
+
+// ParseAction validates an action name; the empty string means reject.
+func ParseAction(s string) (Action, error) {
+	switch Action(s) {
+	case "":
+		return ActionReject, nil
+	case ActionReject, ActionDrop, ActionSample:
+		return Action(s), nil
+	}
+	return "", fmt.Errorf("unknown limit action %q, want reject, drop or sample", s)
+}
+
+// Rejected is a metric left out of a request, with its position in the
+// request, the Reason* constant that caused it and a human-readable reason.
+type Rejected struct {
+	Index  int
+	Metric models.Metrics
+	Cause  string
+	Reason string
+}
+
+// Reason explains the decision in one line, preferring a limit that was
+// hit over the other rejections.
+func (d Decision) Reason() string {
+	for _, r := range d.Rejected {
+		if r.Cause == ReasonSeriesLimit || r.Cause == ReasonRateLimit {
+			return r.Reason
+		}
+	}
+	if len(d.Rejected) > 0 {
+		return d.Rejected[0].Reason
+	}
+	return ""
+}
+
+// OverLimit reports whether any metric was rejected for a series limit
+// rather than for its name.
+func (d Decision) OverLimit() bool {
+	for _, r := range d.Rejected {
+		if r.Cause != ReasonName {
+			return true
+		}
+	}
+	return false
+}
+
+// Decision is the outcome of Admit.
+type Decision struct {
+	Admitted []models.Metrics
+	Rejected []Rejected
+	// Throttled is set when ActionReject refused the whole request; every
+	// metric is then listed in Rejected.
+	Throttled bool
+	// RetryAfter suggests when a rate-limited client may try again.
+	RetryAfter time.Duration
+}
+
+type window struct {
+	start time.Time
+	count int
+}
+
+type Limiter struct {
+	cfg     Config
+	storage storage.MetricsStorage
+	now     func() time.Time
+
+	mu       sync.Mutex
+	clients  map[string]*window
+	swept    time.Time
+	sampled  int
+	rejected map[string]int64
+}
+
+func NewLimiter(s storage.MetricsStorage, cfg Config) *Limiter {
+	if cfg.Action == "" {
+		cfg.Action = ActionReject
+	}
+	if cfg.SampleRate <= 0 {
+		cfg.SampleRate = 1
+	}
+	return &Limiter{
+		cfg:      cfg,
+		storage:  s,
+		now:      time.Now,
+		clients:  make(map[string]*window),
+		rejected: make(map[string]int64),
+	}
+}
+
+// ClientID identifies a client by the host part of its address.
+func ClientID(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Admit decides which metrics of a request from client may be stored.
+// Metrics of series that already exist only go through the name check. The
+// limits are soft under concurrency: requests admitted at the same time may
+// together overshoot MaxSeries by a few series.
+func (l *Limiter) Admit(client string, metrics []models.Metrics) (Decision, error) {
+	var d Decision
+	named := make([]models.Metrics, 0, len(metrics))
+	positions := make([]int, 0, len(metrics))
+	for i, m := range metrics {
+		if l.cfg.NamePattern != nil && !l.cfg.NamePattern.MatchString(models.MetadataName(m.ID)) {
+			d.Rejected = append(d.Rejected, Rejected{i, m, ReasonName, fmt.Sprintf("metric name does not match %s", l.cfg.NamePattern)})
+			continue
+		}
+		named = append(named, m)
+		positions = append(positions, i)
+	}
+	nameRejections := len(d.Rejected)
+
+	newSeries, err := l.newSeries(named)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	var room int
+	if l.cfg.MaxSeries > 0 && len(newSeries) > 0 {
+		count, err := l.storage.CountSeries()
+		if err != nil {
+			return Decision{}, err
+		}
+		room = l.cfg.MaxSeries - count
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	w := l.clients[client]
+	if w == nil || now.Sub(w.start) >= rateWindow {
+		w = &window{start: now}
+		l.clients[client] = w
+	}
+
+	over := make(map[seriesKey]string)
+	admittedNew, sampled := 0, l.sampled
+	for _, k := range newSeries {
+		switch {
+		case l.cfg.MaxSeries > 0 && room <= 0:
+			over[k] = ReasonSeriesLimit
+		case l.cfg.MaxNewSeriesPerMinute > 0 && w.count+admittedNew >= l.cfg.MaxNewSeriesPerMinute:
+			sampled++
+			if l.cfg.Action != ActionSample || sampled%l.cfg.SampleRate != 0 {
+				over[k] = ReasonRateLimit
+				continue
+			}
+			fallthrough
+		default:
+			admittedNew++
+			room--
+		}
+	}
+
+	if len(over) > 0 && l.cfg.Action == ActionReject {
+		for i, m := range named {
+			cause := over[seriesKey{m.MType, m.ID}]
+			reason := l.describe(cause)
+			if cause == "" {
+				cause, reason = ReasonThrottled, "request rejected with other series over the limit"
+			}
+			d.Rejected = append(d.Rejected, Rejected{positions[i], m, cause, reason})
+		}
+		d.Throttled = true
+		l.count(over, nameRejections)
+		d.RetryAfter = l.retryAfter(over, w, now)
+		sort.Slice(d.Rejected, func(i, j int) bool { return d.Rejected[i].Index < d.Rejected[j].Index })
+		return d, nil
+	}
+
+	w.count += admittedNew
+	l.sampled = sampled
+	for i, m := range named {
+		if cause, ok := over[seriesKey{m.MType, m.ID}]; ok {
+			d.Rejected = append(d.Rejected, Rejected{positions[i], m, cause, l.describe(cause)})
+			continue
+		}
+		d.Admitted = append(d.Admitted, m)
+	}
+	l.count(over, nameRejections)
+	d.RetryAfter = l.retryAfter(over, w, now)
+	sort.Slice(d.Rejected, func(i, j int) bool { return d.Rejected[i].Index < d.Rejected[j].Index })
+	return d, nil
+}
+
+type seriesKey struct{ mtype, id string }
+
+// newSeries returns the distinct series of metrics that are not stored yet,
+// in request order.
+func (l *Limiter) newSeries(metrics []models.Metrics) ([]seriesKey, error) {
+	if len(metrics) == 0 || (l.cfg.MaxSeries <= 0 && l.cfg.MaxNewSeriesPerMinute <= 0) {
+		return nil, nil
+	}
+
+	seen := make(map[seriesKey]bool, len(metrics))
+	keys := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		k := seriesKey{m.MType, m.ID}
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, models.Metrics{ID: m.ID, MType: m.MType})
+		}
+	}
+
+	existing, err := l.storage.GetMetrics(keys)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[seriesKey]bool, len(existing))
+	for _, m := range existing {
+		stored[seriesKey{m.MType, m.ID}] = true
+	}
+
+	var fresh []seriesKey
+	for _, m := range keys {
+		if k := (seriesKey{m.MType, m.ID}); !stored[k] {
+			fresh = append(fresh, k)
+		}
+	}
+	return fresh, nil
+}
+
+func (l *Limiter) describe(cause string) string {
+	switch cause {
+	case ReasonSeriesLimit:
+		return fmt.Sprintf("series limit of %d reached", l.cfg.MaxSeries)
+	case ReasonRateLimit:
+		return fmt.Sprintf("client may create at most %d new series per minute", l.cfg.MaxNewSeriesPerMinute)
+	}
+	return cause
+}
+
+// count must be called with mu held.
+func (l *Limiter) count(over map[seriesKey]string, nameRejections int) {
+	for _, reason := range over {
+		l.rejected[reason]++
+	}
+	if nameRejections > 0 {
+		l.rejected[ReasonName] += int64(nameRejections)
+	}
+}
+
+// retryAfter must be called with mu held.
+func (l *Limiter) retryAfter(over map[seriesKey]string, w *window, now time.Time) time.Duration {
+	for _, reason := range over {
+		if reason == ReasonRateLimit {
+			return w.start.Add(rateWindow).Sub(now)
+		}
+	}
+	return 0
+}
+
+// sweep forgets the windows of clients that have been quiet for a minute.
+// It must be called with mu held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < rateWindow {
+		return
+	}
+	for client, w := range l.clients {
+		if now.Sub(w.start) >= rateWindow {
+			delete(l.clients, client)
+		}
+	}
+	l.swept = now
+}
+
+// Stats is a snapshot of the configured limits and rejection counts.
+type Stats struct {
+	MaxSeries             int              `json:"max_series"`
+	MaxNewSeriesPerMinute int              `json:"max_new_series_per_minute"`
+	NamePattern           string           `json:"name_pattern,omitempty"`
+	Action                Action           `json:"action"`
+	Series                int              `json:"series"`
+	Rejected              map[string]int64 `json:"rejected"`
+}
+
+func (l *Limiter) Stats() (Stats, error) {
+	count, err := l.storage.CountSeries()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{
+		MaxSeries:             l.cfg.MaxSeries,
+		MaxNewSeriesPerMinute: l.cfg.MaxNewSeriesPerMinute,
+		Action:                l.cfg.Action,
+		Series:                count,
+		Rejected:              make(map[string]int64),
+	}
+	if l.cfg.NamePattern != nil {
+		stats.NamePattern = l.cfg.NamePattern.String()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, reason := range []string{ReasonSeriesLimit, ReasonRateLimit, ReasonName} {
+		stats.Rejected[reason] = l.rejected[reason]
+	}
+	return stats, nil
+}
+
+// Metrics returns the rejected series counters for the exposition, one
+// series per reason.
+func (l *Limiter) Metrics() []models.Metrics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reasons := []string{ReasonName, ReasonRateLimit, ReasonSeriesLimit}
+	metrics := make([]models.Metrics, 0, len(reasons))
+	for _, reason := range reasons {
+		n := l.rejected[reason]
+		metrics = append(metrics, models.Metrics{
+			ID:    models.SeriesID(RejectedMetric, map[string]string{"reason": reason}),
+			MType: "counter",
+			Delta: &n,
+			Meta:  &models.Metadata{Description: "Series rejected by the cardinality limits and naming policy."},
+		})
+	}
+	return metrics
+}
@@ -0,0 +1,106 @@
+package limits
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func gauges(ids ...string) []models.Metrics {
+	metrics := make([]models.Metrics, 0, len(ids))
+	for _, id := range ids {
+		v := 1.0
+		metrics = append(metrics, models.Metrics{ID: id, MType: "gauge", Value: &v})
+	}
+	return metrics
+}
+
+func ids(metrics []models.Metrics) []string {
+	var out []string
+	for _, m := range metrics {
+		out = append(out, m.ID)
+	}
+	return out
+}
+
+func TestMaxSeries(t *testing.T) {
+	s := storage.NewMemStorage()
+	s.UpdateGauge("Alloc", 1)
+
+	l := NewLimiter(s, Config{MaxSeries: 2, Action: ActionDrop})
+	d, err := l.Admit("a", gauges("Alloc", "HeapAlloc", "req_1", "req_2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Alloc", "HeapAlloc"}, ids(d.Admitted))
+	assert.False(t, d.Throttled)
+	assert.Len(t, d.Rejected, 2)
+	assert.Equal(t, 2, d.Rejected[0].Index)
+	assert.Equal(t, ReasonSeriesLimit, d.Rejected[0].Cause)
+	assert.Equal(t, "series limit of 2 reached", d.Reason())
+
+	reject := NewLimiter(s, Config{MaxSeries: 1})
+	d, err = reject.Admit("a", gauges("Alloc", "req_1"))
+	assert.NoError(t, err)
+	assert.True(t, d.Throttled)
+	assert.Empty(t, d.Admitted)
+	assert.Equal(t, ReasonThrottled, d.Rejected[0].Cause)
+
+	stats, err := reject.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Rejected[ReasonSeriesLimit])
+	assert.Equal(t, 1, stats.Series)
+}
+
+func TestNewSeriesRatePerClient(t *testing.T) {
+	s := storage.NewMemStorage()
+	now := time.Unix(1_700_000_000, 0)
+	l := NewLimiter(s, Config{MaxNewSeriesPerMinute: 2, Action: ActionDrop})
+	l.now = func() time.Time { return now }
+
+	d, _ := l.Admit("a", gauges("a1", "a2", "a3"))
+	assert.Equal(t, []string{"a1", "a2"}, ids(d.Admitted))
+	assert.Equal(t, ReasonRateLimit, d.Rejected[0].Cause)
+	assert.Equal(t, time.Minute, d.RetryAfter)
+	s.UpdateMetricsBatch(d.Admitted)
+
+	d, _ = l.Admit("b", gauges("b1"))
+	assert.Equal(t, []string{"b1"}, ids(d.Admitted), "clients have separate budgets")
+
+	d, _ = l.Admit("a", gauges("a1", "a4"))
+	assert.Equal(t, []string{"a1"}, ids(d.Admitted), "existing series are not limited")
+
+	now = now.Add(time.Minute)
+	d, _ = l.Admit("a", gauges("a4"))
+	assert.Equal(t, []string{"a4"}, ids(d.Admitted))
+}
+
+func TestSampleAction(t *testing.T) {
+	l := NewLimiter(storage.NewMemStorage(), Config{MaxNewSeriesPerMinute: 1, Action: ActionSample, SampleRate: 2})
+	d, err := l.Admit("a", gauges("s1", "s2", "s3", "s4", "s5"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"s1", "s3", "s5"}, ids(d.Admitted))
+}
+
+func TestNamePattern(t *testing.T) {
+	l := NewLimiter(storage.NewMemStorage(), Config{NamePattern: regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)})
+	d, err := l.Admit("a", gauges(`http_requests{id="x-1"}`, "request-7f3a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`http_requests{id="x-1"}`}, ids(d.Admitted))
+	assert.Equal(t, ReasonName, d.Rejected[0].Cause)
+	assert.False(t, d.OverLimit())
+
+	counters := l.Metrics()
+	assert.Equal(t, `metrics_service_rejected_series_total{reason="name"}`, counters[0].ID)
+	assert.Equal(t, int64(1), *counters[0].Delta)
+}
+
+func TestParseAction(t *testing.T) {
+	action, err := ParseAction("")
+	assert.NoError(t, err)
+	assert.Equal(t, ActionReject, action)
+	_, err = ParseAction("ignore")
+	assert.Error(t, err)
+}
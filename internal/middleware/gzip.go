@@ -16,11 +16,22 @@ func (w *gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.writer.Write(b)
 }
 
+// Flush pushes buffered compressed data to the client so streaming
+// responses such as server-sent events keep working behind gzip.
+func (w *gzipResponseWriter) Flush() {
+	w.writer.Flush()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func GzipDecompress(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Content-Encoding") == "gzip" {
 			contentType := r.Header.Get("Content-Type")
-			if strings.Contains(contentType, "application/json") || strings.Contains(contentType, "text/html") {
+			if strings.Contains(contentType, "application/json") || strings.Contains(contentType, "text/html") ||
+				strings.Contains(contentType, "protobuf") || strings.Contains(contentType, "text/plain") ||
+				strings.Contains(contentType, "ndjson") {
 				gzReader, err := gzip.NewReader(r.Body)
 				if err != nil {
 					http.Error(w, "Invalid gzip data", http.StatusBadRequest)
@@ -50,3 +50,9 @@ func (w *responseWriterWrapper) Write(b []byte) (int, error) {
 	w.size += size
 	return size, err
 }
+
+func (w *responseWriterWrapper) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -9,6 +9,8 @@ import (
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var retryIntervals = []time.Duration{
@@ -51,5 +53,9 @@ func isRetriable(err error) bool {
 		return pgErr.Code == pgerrcode.ConnectionException
 	}
 
+	if st, ok := status.FromError(err); ok {
+		return st.Code() == codes.Unavailable || st.Code() == codes.DeadlineExceeded
+	}
+
 	return false
 }
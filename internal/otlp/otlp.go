@@ -0,0 +1,405 @@
+package otlp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hairutdin/metrics-service/internal/relabel"
+	"github.com/hairutdin/metrics-service/models"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// Converter maps OTLP metric exports onto gauges and counters. Counters in
+// this service are stored as running totals that grow by deltas, so the
+// converter remembers the last cumulative value of every monotonic series to
+// turn cumulative temporality into deltas.
+type Converter struct {
+	mu      sync.Mutex
+	store   Store
+	relabel *relabel.Engine
+	series  map[string]seriesState
+	now     func() time.Time
+	swept   time.Time
+}
+
+// Store looks up the stored values of series, as
+// storage.MetricsStorage.GetMetrics does.
+type Store interface {
+	GetMetrics(keys []models.Metrics) ([]models.Metrics, error)
+}
+
+// IdleTimeout is how long the converter remembers a series that is no
+// longer exported. A series that comes back is picked up from its stored
+// value again.
+const IdleTimeout = time.Hour
+
+type seriesState struct {
+	start    uint64
+	value    float64
+	lastSeen time.Time
+}
+
+// Result holds the converted metrics and the number of data points that could
+// not be mapped (reported back to the exporter as a partial success).
+type Result struct {
+	Metrics  []models.Metrics
+	Rejected int64
+	Errors   []string
+
+	// pending are the points whose value depends on the previous state of
+	// their series, resolved once the whole request has been walked.
+	pending []pendingPoint
+}
+
+// pendingPoint is a cumulative monotonic point (a counter) or a delta
+// non-monotonic point (a gauge) stored at index of Result.Metrics.
+type pendingPoint struct {
+	index   int
+	id      string
+	start   uint64
+	value   float64
+	counter bool
+}
+
+// NewConverter returns a converter that picks up series it has not seen
+// yet, e.g. after a restart, from their values in store.
+func NewConverter(store Store) *Converter {
+	return &Converter{store: store, series: make(map[string]seriesState), now: time.Now}
+}
+
+// SetRelabeler tells the converter which rules the converted metrics are
+// stored under, so stored values are looked up by the rewritten IDs.
+func (c *Converter) SetRelabeler(e *relabel.Engine) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.relabel = e
+}
+
+// Export converts req and passes the result to apply, which stores it. The
+// state cumulative points are diffed against only advances when apply
+// succeeds, so an export retried after a failure yields the same deltas.
+// Exports are converted and applied one at a time.
+func (c *Converter) Export(req *colmetricspb.ExportMetricsServiceRequest, apply func(*Result) error) (Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var res Result
+	for _, rm := range req.GetResourceMetrics() {
+		resourceLabels := attributesToLabels(rm.GetResource().GetAttributes(), nil)
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				first := len(res.Metrics)
+				c.convertMetric(m, resourceLabels, &res)
+				attachMetadata(m, res.Metrics[first:])
+			}
+		}
+	}
+
+	staged, err := c.resolve(&res)
+	if err != nil {
+		return res, err
+	}
+	if err := apply(&res); err != nil {
+		return res, err
+	}
+
+	now := c.now()
+	for id, state := range staged {
+		state.lastSeen = now
+		c.series[id] = state
+	}
+	c.sweep(now)
+	return res, nil
+}
+
+func (c *Converter) convertMetric(m *metricspb.Metric, resourceLabels map[string]string, res *Result) {
+	name := models.SanitizeName(m.GetName())
+
+	switch data := m.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		for _, dp := range data.Gauge.GetDataPoints() {
+			id := models.SeriesID(name, attributesToLabels(dp.GetAttributes(), resourceLabels))
+			res.Metrics = append(res.Metrics, gauge(id, numberValue(dp)))
+		}
+	case *metricspb.Metric_Sum:
+		sum := data.Sum
+		delta := sum.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		for _, dp := range sum.GetDataPoints() {
+			id := models.SeriesID(name, attributesToLabels(dp.GetAttributes(), resourceLabels))
+			value := numberValue(dp)
+			switch {
+			case sum.GetIsMonotonic() && (math.IsNaN(value) || math.IsInf(value, 0)):
+				res.reject(1, "counter %q has a non-finite value", id)
+			case sum.GetIsMonotonic():
+				res.counter(id, dp.GetStartTimeUnixNano(), value, delta)
+			case delta:
+				res.deltaGauge(id, value)
+			default:
+				res.Metrics = append(res.Metrics, gauge(id, value))
+			}
+		}
+	case *metricspb.Metric_Histogram:
+		hist := data.Histogram
+		delta := hist.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		for _, dp := range hist.GetDataPoints() {
+			convertHistogramPoint(name, dp, resourceLabels, delta, res)
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		res.reject(len(data.ExponentialHistogram.GetDataPoints()), "exponential histogram %q is not supported", m.GetName())
+	case *metricspb.Metric_Summary:
+		res.reject(len(data.Summary.GetDataPoints()), "summary %q is not supported", m.GetName())
+	default:
+		res.reject(1, "metric %q has no data", m.GetName())
+	}
+}
+
+// attachMetadata passes the description and unit of an OTLP metric on to
+// every series converted from it.
+func attachMetadata(m *metricspb.Metric, converted []models.Metrics) {
+	if m.GetDescription() == "" && m.GetUnit() == "" {
+		return
+	}
+	meta := &models.Metadata{Unit: m.GetUnit(), Description: m.GetDescription()}
+	for i := range converted {
+		converted[i].Meta = meta
+	}
+}
+
+// convertHistogramPoint flattens a histogram into Prometheus-style series:
+// cumulative name_bucket{le="..."} and name_count counters plus a name_sum
+// gauge holding the running sum of observations.
+func convertHistogramPoint(name string, dp *metricspb.HistogramDataPoint, resourceLabels map[string]string, delta bool, res *Result) {
+	labels := attributesToLabels(dp.GetAttributes(), resourceLabels)
+	start := dp.GetStartTimeUnixNano()
+
+	bounds := dp.GetExplicitBounds()
+	var cumulative uint64
+	for i, count := range dp.GetBucketCounts() {
+		cumulative += count
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(bounds[i], 'g', -1, 64)
+		}
+		bucketLabels := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			bucketLabels[k] = v
+		}
+		bucketLabels["le"] = le
+		res.counter(models.SeriesID(name+"_bucket", bucketLabels), start, float64(cumulative), delta)
+	}
+
+	res.counter(models.SeriesID(name+"_count", labels), start, float64(dp.GetCount()), delta)
+
+	if dp.Sum != nil {
+		sumID := models.SeriesID(name+"_sum", labels)
+		if delta {
+			res.deltaGauge(sumID, dp.GetSum())
+		} else {
+			res.Metrics = append(res.Metrics, gauge(sumID, dp.GetSum()))
+		}
+	}
+}
+
+// counter adds a counter point. Delta points are applied as-is; cumulative
+// points are resolved against the previous point of the series.
+func (r *Result) counter(id string, start uint64, value float64, delta bool) {
+	if !delta {
+		r.pending = append(r.pending, pendingPoint{index: len(r.Metrics), id: id, start: start, value: value, counter: true})
+	}
+	r.Metrics = append(r.Metrics, counter(id, int64(math.Round(value))))
+}
+
+// deltaGauge adds a delta point of a non-monotonic sum, which is
+// accumulated into a running total.
+func (r *Result) deltaGauge(id string, value float64) {
+	r.pending = append(r.pending, pendingPoint{index: len(r.Metrics), id: id, value: value})
+	r.Metrics = append(r.Metrics, gauge(id, value))
+}
+
+// resolve fills in the values of pending points and returns the state of
+// their series after this export. Cumulative counters are diffed against
+// the previous point of the series, treating a new start time or a
+// decrease as a reset; values are rounded before diffing so fractional sums
+// do not drift. Series the converter does not know continue from their
+// stored value.
+func (c *Converter) resolve(res *Result) (map[string]seriesState, error) {
+	stored, err := c.storedValues(res.pending)
+	if err != nil {
+		return nil, err
+	}
+
+	staged := make(map[string]seriesState, len(res.pending))
+	for _, p := range res.pending {
+		prev, seen := staged[p.id]
+		if !seen {
+			prev, seen = c.series[p.id]
+		}
+		if !seen {
+			var value float64
+			if key, ok := c.storedKey(p); ok {
+				value, seen = stored[key]
+			}
+			prev = seriesState{start: p.start, value: value}
+		}
+
+		m := &res.Metrics[p.index]
+		if !p.counter {
+			total := prev.value + p.value
+			m.Value = &total
+			staged[p.id] = seriesState{value: total}
+			continue
+		}
+		delta := int64(math.Round(p.value))
+		if seen && prev.start == p.start && p.value >= prev.value {
+			delta -= int64(math.Round(prev.value))
+		}
+		m.Delta = &delta
+		staged[p.id] = seriesState{start: p.start, value: p.value}
+	}
+	return staged, nil
+}
+
+// storedValues looks up the stored values of the pending series the
+// converter does not know, keyed by type and ID.
+func (c *Converter) storedValues(pending []pendingPoint) (map[seriesKey]float64, error) {
+	if c.store == nil {
+		return nil, nil
+	}
+	var keys []models.Metrics
+	wanted := make(map[seriesKey]bool)
+	for _, p := range pending {
+		if _, ok := c.series[p.id]; ok {
+			continue
+		}
+		key, ok := c.storedKey(p)
+		if !ok || wanted[key] {
+			continue
+		}
+		wanted[key] = true
+		keys = append(keys, models.Metrics{ID: key.id, MType: key.mtype})
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	found, err := c.store.GetMetrics(keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stored totals: %w", err)
+	}
+	values := make(map[seriesKey]float64, len(found))
+	for _, m := range found {
+		key := seriesKey{mtype: m.MType, id: m.ID}
+		switch {
+		case m.Delta != nil:
+			values[key] = float64(*m.Delta)
+		case m.Value != nil:
+			values[key] = *m.Value
+		}
+	}
+	return values, nil
+}
+
+type seriesKey struct {
+	mtype string
+	id    string
+}
+
+// storedKey returns the key p's series is stored under once relabeled. It
+// reports false when the series is dropped or coerced to the other type, as
+// the stored value then no longer continues the OTLP series.
+func (c *Converter) storedKey(p pendingPoint) (seriesKey, bool) {
+	var zero int64
+	var probe float64
+	m := models.Metrics{ID: p.id, MType: "gauge", Value: &probe}
+	if p.counter {
+		m = models.Metrics{ID: p.id, MType: "counter", Delta: &zero}
+	}
+	mtype := m.MType
+	m, ok := c.relabel.Apply(m)
+	if !ok || m.MType != mtype {
+		return seriesKey{}, false
+	}
+	return seriesKey{mtype: m.MType, id: m.ID}, true
+}
+
+// sweep forgets series not exported for IdleTimeout, at most once per
+// IdleTimeout.
+func (c *Converter) sweep(now time.Time) {
+	if now.Sub(c.swept) < IdleTimeout {
+		return
+	}
+	c.swept = now
+	for id, state := range c.series {
+		if now.Sub(state.lastSeen) >= IdleTimeout {
+			delete(c.series, id)
+		}
+	}
+}
+
+func (r *Result) reject(points int, format string, args ...interface{}) {
+	r.Rejected += int64(points)
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func numberValue(dp *metricspb.NumberDataPoint) float64 {
+	if v, ok := dp.GetValue().(*metricspb.NumberDataPoint_AsInt); ok {
+		return float64(v.AsInt)
+	}
+	return dp.GetAsDouble()
+}
+
+// attributesToLabels converts OTLP attributes to labels on top of base, with
+// attribute keys sanitized the same way as metric names.
+func attributesToLabels(attrs []*commonpb.KeyValue, base map[string]string) map[string]string {
+	labels := make(map[string]string, len(base)+len(attrs))
+	for k, v := range base {
+		labels[k] = v
+	}
+	for _, kv := range attrs {
+		labels[models.SanitizeName(kv.GetKey())] = anyValueString(kv.GetValue())
+	}
+	return labels
+}
+
+func anyValueString(v *commonpb.AnyValue) string {
+	switch val := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return val.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(val.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(val.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(val.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return fmt.Sprintf("%x", val.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		parts := make([]string, 0, len(val.ArrayValue.GetValues()))
+		for _, item := range val.ArrayValue.GetValues() {
+			parts = append(parts, anyValueString(item))
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	case *commonpb.AnyValue_KvlistValue:
+		parts := make([]string, 0, len(val.KvlistValue.GetValues()))
+		for _, kv := range val.KvlistValue.GetValues() {
+			parts = append(parts, kv.GetKey()+"="+anyValueString(kv.GetValue()))
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	}
+	return ""
+}
+
+func gauge(id string, value float64) models.Metrics {
+	return models.Metrics{ID: id, MType: "gauge", Value: &value}
+}
+
+func counter(id string, delta int64) models.Metrics {
+	return models.Metrics{ID: id, MType: "counter", Delta: &delta}
+}
@@ -0,0 +1,229 @@
+package otlp
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hairutdin/metrics-service/internal/relabel"
+	"github.com/hairutdin/metrics-service/storage"
+
+	"github.com/stretchr/testify/assert"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+func exportRequest(metrics ...*metricspb.Metric) *colmetricspb.ExportMetricsServiceRequest {
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{{
+				Key:   "service.name",
+				Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "api"}},
+			}}},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+		}},
+	}
+}
+
+func cumulativeSum(name string, start uint64, value int64) *metricspb.Metric {
+	return &metricspb.Metric{
+		Name: name,
+		Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			IsMonotonic:            true,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			DataPoints: []*metricspb.NumberDataPoint{{
+				StartTimeUnixNano: start,
+				Value:             &metricspb.NumberDataPoint_AsInt{AsInt: value},
+			}},
+		}},
+	}
+}
+
+// convert exports req with an apply step that always succeeds.
+func convert(t *testing.T, c *Converter, req *colmetricspb.ExportMetricsServiceRequest) Result {
+	res, err := c.Export(req, func(*Result) error { return nil })
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	return res
+}
+
+func TestConvertGaugeWithResourceAttributes(t *testing.T) {
+	c := NewConverter(nil)
+	res := convert(t, c, exportRequest(&metricspb.Metric{
+		Name: "process.memory",
+		Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+			DataPoints: []*metricspb.NumberDataPoint{{
+				Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: 12.5},
+			}},
+		}},
+	}))
+
+	assert.Len(t, res.Metrics, 1)
+	assert.Equal(t, `process_memory{service_name="api"}`, res.Metrics[0].ID)
+	assert.Equal(t, "gauge", res.Metrics[0].MType)
+	assert.Equal(t, 12.5, *res.Metrics[0].Value)
+}
+
+func TestConvertCumulativeSumToDeltas(t *testing.T) {
+	c := NewConverter(nil)
+
+	deltas := []int64{}
+	for _, v := range []int64{10, 15, 15, 3} {
+		start := uint64(1)
+		if v == 3 {
+			start = 2 // process restarted
+		}
+		res := convert(t, c, exportRequest(cumulativeSum("requests", start, v)))
+		assert.Len(t, res.Metrics, 1)
+		assert.Equal(t, "counter", res.Metrics[0].MType)
+		deltas = append(deltas, *res.Metrics[0].Delta)
+	}
+
+	assert.Equal(t, []int64{10, 5, 0, 3}, deltas)
+}
+
+func TestConvertHistogram(t *testing.T) {
+	c := NewConverter(nil)
+	sum := 7.5
+	res := convert(t, c, exportRequest(&metricspb.Metric{
+		Name: "latency",
+		Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+			DataPoints: []*metricspb.HistogramDataPoint{{
+				Count:          3,
+				Sum:            &sum,
+				ExplicitBounds: []float64{1, 5},
+				BucketCounts:   []uint64{1, 1, 1},
+			}},
+		}},
+	}))
+
+	got := make(map[string]float64)
+	for _, m := range res.Metrics {
+		if m.Delta != nil {
+			got[m.ID] = float64(*m.Delta)
+		} else {
+			got[m.ID] = *m.Value
+		}
+	}
+
+	assert.Equal(t, map[string]float64{
+		`latency_bucket{le="1",service_name="api"}`:    1,
+		`latency_bucket{le="5",service_name="api"}`:    2,
+		`latency_bucket{le="+Inf",service_name="api"}`: 3,
+		`latency_count{service_name="api"}`:            3,
+		`latency_sum{service_name="api"}`:              7.5,
+	}, got)
+}
+
+func TestConvertRejectsUnsupportedTypes(t *testing.T) {
+	c := NewConverter(nil)
+	res := convert(t, c, exportRequest(&metricspb.Metric{
+		Name: "rpc",
+		Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+			DataPoints: []*metricspb.SummaryDataPoint{{}, {}},
+		}},
+	}))
+
+	assert.Empty(t, res.Metrics)
+	assert.Equal(t, int64(2), res.Rejected)
+}
+
+func TestExportRetriedAfterFailedApply(t *testing.T) {
+	c := NewConverter(nil)
+	convert(t, c, exportRequest(cumulativeSum("requests", 1, 10)))
+
+	failed := errors.New("storage unavailable")
+	for i := 0; i < 2; i++ {
+		res, err := c.Export(exportRequest(cumulativeSum("requests", 1, 25)), func(*Result) error { return failed })
+		assert.ErrorIs(t, err, failed)
+		assert.Equal(t, int64(15), *res.Metrics[0].Delta, "a failed export does not advance the series")
+	}
+
+	res := convert(t, c, exportRequest(cumulativeSum("requests", 1, 25)))
+	assert.Equal(t, int64(15), *res.Metrics[0].Delta)
+	res = convert(t, c, exportRequest(cumulativeSum("requests", 1, 25)))
+	assert.Equal(t, int64(0), *res.Metrics[0].Delta)
+}
+
+func TestExportContinuesFromStoredTotal(t *testing.T) {
+	s := storage.NewMemStorage()
+	s.UpdateCounter(`requests{service_name="api"}`, 40)
+	s.UpdateGauge(`queue{service_name="api"}`, 3)
+
+	// A new converter, as after a restart.
+	c := NewConverter(s)
+	res := convert(t, c, exportRequest(cumulativeSum("requests", 1, 50), &metricspb.Metric{
+		Name: "queue",
+		Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+			DataPoints: []*metricspb.NumberDataPoint{{
+				Value: &metricspb.NumberDataPoint_AsInt{AsInt: 2},
+			}},
+		}},
+	}))
+	assert.Equal(t, int64(10), *res.Metrics[0].Delta, "only the increase since the stored total is added")
+	assert.Equal(t, 5.0, *res.Metrics[1].Value)
+
+	// A cumulative value below the stored total means the source reset.
+	c = NewConverter(s)
+	res = convert(t, c, exportRequest(cumulativeSum("requests", 2, 4)))
+	assert.Equal(t, int64(4), *res.Metrics[0].Delta)
+}
+
+func TestExportContinuesFromRelabeledTotal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relabel.json")
+	rules := `{"rules":[{"action":"rename","match":"requests","replacement":"http_requests"}]}`
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+	e, err := relabel.Load(path)
+	if err != nil {
+		t.Fatalf("failed to load rules: %v", err)
+	}
+
+	s := storage.NewMemStorage()
+	s.UpdateCounter(`http_requests{service_name="api"}`, 40)
+
+	// A new converter, as after a restart, whose series are stored renamed.
+	c := NewConverter(s)
+	c.SetRelabeler(e)
+	res := convert(t, c, exportRequest(cumulativeSum("requests", 1, 50)))
+	assert.Equal(t, int64(10), *res.Metrics[0].Delta, "the renamed stored total is not counted again")
+}
+
+func TestExportForgetsIdleSeries(t *testing.T) {
+	c := NewConverter(nil)
+	now := time.Unix(0, 0)
+	c.now = func() time.Time { return now }
+
+	convert(t, c, exportRequest(cumulativeSum("idle", 1, 10)))
+	now = now.Add(IdleTimeout)
+	convert(t, c, exportRequest(cumulativeSum("busy", 1, 10)))
+	assert.Len(t, c.series, 1)
+	assert.Contains(t, c.series, `busy{service_name="api"}`)
+}
+
+func TestConvertRejectsNonFiniteCounters(t *testing.T) {
+	c := NewConverter(nil)
+	res := convert(t, c, exportRequest(&metricspb.Metric{
+		Name: "requests",
+		Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			IsMonotonic:            true,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			DataPoints: []*metricspb.NumberDataPoint{{
+				Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: math.Inf(1)},
+			}},
+		}},
+	}))
+
+	assert.Empty(t, res.Metrics)
+	assert.Equal(t, int64(1), res.Rejected)
+}
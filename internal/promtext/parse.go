@@ -0,0 +1,223 @@
+// Package promtext reads and writes the Prometheus text exposition format
+// (version 0.0.4).
+package promtext
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type Family struct {
+	Name    string
+	Type    string // counter, gauge, histogram, summary or untyped
+	Help    string
+	Samples []Sample
+}
+
+type Sample struct {
+	Name      string
+	Labels    map[string]string
+	Value     float64
+	Timestamp *int64
+}
+
+// Parse reads every metric family from r. Samples that appear without a
+// preceding # TYPE line form their own untyped family.
+func Parse(r io.Reader) ([]Family, error) {
+	var families []Family
+	index := make(map[string]int)
+
+	family := func(name string) *Family {
+		if i, ok := index[name]; ok {
+			return &families[i]
+		}
+		families = append(families, Family{Name: name, Type: "untyped"})
+		index[name] = len(families) - 1
+		return &families[len(families)-1]
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(strings.TrimSpace(line[1:]), " ", 3)
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[0] {
+			case "TYPE":
+				typ := strings.TrimSpace(fields[2])
+				switch typ {
+				case "counter", "gauge", "histogram", "summary", "untyped":
+				default:
+					return nil, fmt.Errorf("line %d: unknown metric type %q", lineNo, typ)
+				}
+				family(fields[1]).Type = typ
+			case "HELP":
+				family(fields[1]).Help = unescapeHelp(fields[2])
+			}
+			continue
+		}
+
+		sample, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		f := family(familyName(sample.Name, index, families))
+		f.Samples = append(f.Samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return families, nil
+}
+
+// familyName maps suffixed histogram and summary samples (x_bucket, x_sum,
+// x_count) back to the family declared for x.
+func familyName(sample string, index map[string]int, families []Family) string {
+	if _, ok := index[sample]; ok {
+		return sample
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		base, found := strings.CutSuffix(sample, suffix)
+		if !found {
+			continue
+		}
+		if i, ok := index[base]; ok {
+			typ := families[i].Type
+			if typ == "histogram" || (typ == "summary" && suffix != "_bucket") {
+				return base
+			}
+		}
+	}
+	return sample
+}
+
+func parseSample(line string) (Sample, error) {
+	var s Sample
+
+	end := 0
+	for end < len(line) && isNameChar(line[end], end == 0) {
+		end++
+	}
+	if end == 0 {
+		return s, fmt.Errorf("invalid metric name")
+	}
+	s.Name = line[:end]
+	rest := line[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		labels, n, err := parseLabels(rest)
+		if err != nil {
+			return s, err
+		}
+		s.Labels = labels
+		rest = rest[n:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("expected value and optional timestamp")
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid value %q", fields[0])
+	}
+	s.Value = value
+
+	if len(fields) == 2 {
+		ts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+		s.Timestamp = &ts
+	}
+
+	return s, nil
+}
+
+// parseLabels parses a {name="value",...} block at the start of s and returns
+// the labels and the number of bytes consumed.
+func parseLabels(s string) (map[string]string, int, error) {
+	labels := make(map[string]string)
+	i := 1
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("unterminated label set")
+		}
+		if s[i] == '}' {
+			return labels, i + 1, nil
+		}
+
+		start := i
+		for i < len(s) && isNameChar(s[i], i == start) {
+			i++
+		}
+		if i == start {
+			return nil, 0, fmt.Errorf("invalid label name")
+		}
+		name := s[start:i]
+
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i+1 >= len(s) || s[i] != '=' || s[i+1] != '"' {
+			return nil, 0, fmt.Errorf("expected =\" after label %q", name)
+		}
+		i += 2
+
+		var value strings.Builder
+		for {
+			if i >= len(s) {
+				return nil, 0, fmt.Errorf("unterminated value for label %q", name)
+			}
+			c := s[i]
+			if c == '"' {
+				i++
+				break
+			}
+			if c == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				i++
+				continue
+			}
+			value.WriteByte(c)
+			i++
+		}
+		labels[name] = value.String()
+	}
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(!first && c >= '0' && c <= '9')
+}
+
+// unescapeHelp undoes the \\ and \n escapes allowed in HELP text.
+func unescapeHelp(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(s)
+}
@@ -0,0 +1,77 @@
+package promtext
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	input := `# HELP jobs_total Jobs processed.
+# TYPE jobs_total counter
+jobs_total{queue="default"} 42
+jobs_total{queue="slow\"er"} 3
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 4.5
+duration_seconds_count 3
+last_run 1.7e9 1700000000000
+`
+	families, err := Parse(strings.NewReader(input))
+	assert.NoError(t, err)
+	assert.Len(t, families, 3)
+
+	assert.Equal(t, "jobs_total", families[0].Name)
+	assert.Equal(t, "counter", families[0].Type)
+	assert.Equal(t, "Jobs processed.", families[0].Help)
+	assert.Equal(t, `slow"er`, families[0].Samples[1].Labels["queue"])
+
+	assert.Equal(t, "histogram", families[1].Type)
+	assert.Len(t, families[1].Samples, 4)
+
+	assert.Equal(t, "untyped", families[2].Type)
+	assert.Equal(t, 1.7e9, families[2].Samples[0].Value)
+	assert.Equal(t, int64(1700000000000), *families[2].Samples[0].Timestamp)
+}
+
+func TestParseReportsLine(t *testing.T) {
+	_, err := Parse(strings.NewReader("ok 1\nbroken{ 1\n"))
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestWrite(t *testing.T) {
+	value := 0.25
+	delta := int64(7)
+	var buf bytes.Buffer
+	err := Write(&buf, []models.Metrics{
+		{ID: `requests{code="200"}`, MType: "counter", Delta: &delta},
+		{ID: "GCCPUFraction", MType: "gauge", Value: &value},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `# TYPE GCCPUFraction gauge
+GCCPUFraction 0.25
+# TYPE requests counter
+requests{code="200"} 7
+`, buf.String())
+}
+
+func TestWriteMetadata(t *testing.T) {
+	value := 1024.0
+	meta := &models.Metadata{Unit: "bytes", Description: "Heap in use.\nSee runtime.MemStats"}
+	var buf bytes.Buffer
+	err := Write(&buf, []models.Metrics{{ID: "HeapInuse", MType: "gauge", Value: &value, Meta: meta}})
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP HeapInuse Heap in use.\nSee runtime.MemStats
+# TYPE HeapInuse gauge
+# UNIT HeapInuse bytes
+HeapInuse 1024
+`, buf.String())
+
+	families, err := Parse(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, meta.Description, families[0].Help)
+}
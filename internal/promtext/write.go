@@ -0,0 +1,83 @@
+package promtext
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Write renders metrics in the text exposition format. Series are grouped by
+// metric name so every family gets a single # TYPE line, preceded by # HELP
+// and followed by # UNIT when a series of the family carries metadata.
+func Write(w io.Writer, metrics []models.Metrics) error {
+	type series struct {
+		name string
+		id   string
+		m    models.Metrics
+	}
+
+	all := make([]series, 0, len(metrics))
+	for _, m := range metrics {
+		name, labels, err := models.ParseSeriesID(m.ID)
+		if err != nil {
+			name, labels = m.ID, nil
+		}
+		name = models.SanitizeName(name)
+		all = append(all, series{name: name, id: models.SeriesID(name, labels), m: m})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].name != all[j].name {
+			return all[i].name < all[j].name
+		}
+		return all[i].id < all[j].id
+	})
+
+	meta := make(map[string]*models.Metadata)
+	for _, s := range all {
+		if s.m.Meta != nil && meta[s.name] == nil {
+			meta[s.name] = s.m.Meta
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	lastFamily := ""
+	for _, s := range all {
+		if s.name != lastFamily {
+			md := meta[s.name]
+			if md != nil && md.Description != "" {
+				bw.WriteString("# HELP " + s.name + " " + escapeHelp(md.Description) + "\n")
+			}
+			bw.WriteString("# TYPE " + s.name + " " + s.m.MType + "\n")
+			if md != nil && md.Unit != "" {
+				bw.WriteString("# UNIT " + s.name + " " + escapeHelp(md.Unit) + "\n")
+			}
+			lastFamily = s.name
+		}
+
+		bw.WriteString(s.id)
+		bw.WriteByte(' ')
+		switch {
+		case s.m.Delta != nil:
+			bw.WriteString(strconv.FormatInt(*s.m.Delta, 10))
+		case s.m.Value != nil:
+			bw.WriteString(strconv.FormatFloat(*s.m.Value, 'g', -1, 64))
+		default:
+			bw.WriteString("NaN")
+		}
+		bw.WriteByte('\n')
+	}
+
+	return bw.Flush()
+}
+
+// escapeHelp escapes backslashes and line feeds, the inverse of unescapeHelp.
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
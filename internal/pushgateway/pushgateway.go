@@ -0,0 +1,350 @@
+// Package pushgateway implements the grouping semantics of the Prometheus
+// Pushgateway on top of MetricsStorage.
+package pushgateway
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hairutdin/metrics-service/internal/limits"
+	"github.com/hairutdin/metrics-service/internal/promtext"
+	"github.com/hairutdin/metrics-service/internal/relabel"
+	"github.com/hairutdin/metrics-service/internal/validation"
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+)
+
+// PushTimeMetric is set for every group on each successful push.
+const PushTimeMetric = "push_time_seconds"
+
+var (
+	ErrTimestampNotAllowed = errors.New("pushed metrics must not carry timestamps")
+	ErrInvalidMetric       = errors.New("invalid pushed metric")
+)
+
+type seriesKey struct {
+	MType string
+	ID    string
+}
+
+// Service stores pushed groups. Each series carries its grouping labels in
+// its ID, and the service remembers which series and metric families belong
+// to which group so PUT and DELETE can remove what a group pushed before.
+// Series pushed before a restart are found again in storage by their
+// grouping labels.
+type Service struct {
+	mu      sync.Mutex
+	storage storage.MetricsStorage
+	groups  map[string]map[seriesKey]string // group key -> series -> family
+	now     func() time.Time
+	relabel *relabel.Engine
+	policy  validation.Policy
+	limiter *limits.Limiter
+}
+
+// LimitError is returned when the limiter refuses a push.
+type LimitError struct {
+	Decision limits.Decision
+}
+
+func (e *LimitError) Error() string {
+	return e.Decision.Reason()
+}
+
+func NewService(s storage.MetricsStorage) *Service {
+	return &Service{
+		storage: s,
+		groups:  make(map[string]map[seriesKey]string),
+		now:     time.Now,
+		policy:  validation.DefaultPolicy(),
+	}
+}
+
+// SetRelabeler rewrites pushed metrics with e's rules. Group membership is
+// tracked under the rewritten IDs; the push time series is not rewritten.
+func (s *Service) SetRelabeler(e *relabel.Engine) {
+	s.relabel = e
+}
+
+// SetValidationPolicy replaces the default policy pushed metrics are
+// checked against.
+func (s *Service) SetValidationPolicy(p validation.Policy) {
+	s.policy = p
+}
+
+// SetLimiter applies l's cardinality limits to pushes, including the push
+// time series of every group.
+func (s *Service) SetLimiter(l *limits.Limiter) {
+	s.limiter = l
+}
+
+// Push stores families under the grouping labels. With replace set (PUT) all
+// metrics previously pushed to the group are removed first; otherwise (POST)
+// only previously pushed metrics with the same family names are replaced.
+// Series the limiter drops are left out; when it refuses the push as a whole
+// a *LimitError is returned and the group is left untouched. client
+// identifies the pusher to the limiter's rate limit.
+func (s *Service) Push(client string, grouping map[string]string, families []promtext.Family, replace bool) error {
+	metrics, members, err := toMetrics(grouping, families, s.relabel)
+	if err != nil {
+		return err
+	}
+	// A push is applied whole or not at all, like the Pushgateway does.
+	for _, m := range metrics {
+		if err := s.policy.Check(m); err != nil {
+			return fmt.Errorf("%w %s: %v", ErrInvalidMetric, m.ID, err)
+		}
+	}
+
+	pushTime := float64(s.now().UnixNano()) / 1e9
+	pushTimeID := models.SeriesID(PushTimeMetric, grouping)
+	metrics = append(metrics, models.Metrics{ID: pushTimeID, MType: "gauge", Value: &pushTime})
+	members[seriesKey{MType: "gauge", ID: pushTimeID}] = PushTimeMetric
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The limiter runs before anything is deleted, so a refused push
+	// leaves the group as it was and its current series count as existing.
+	if s.limiter != nil {
+		d, err := s.limiter.Admit(client, metrics)
+		if err != nil {
+			return fmt.Errorf("failed to check limits: %w", err)
+		}
+		if d.Throttled || len(d.Admitted) == 0 {
+			return &LimitError{Decision: d}
+		}
+		admitted := make(map[seriesKey]string, len(d.Admitted))
+		for _, m := range d.Admitted {
+			sk := seriesKey{MType: m.MType, ID: m.ID}
+			admitted[sk] = members[sk]
+		}
+		metrics, members = d.Admitted, admitted
+	}
+
+	group, err := s.group(grouping)
+	if err != nil {
+		return err
+	}
+
+	pushed := make(map[string]bool, len(families))
+	for _, f := range families {
+		pushed[f.Name] = true
+	}
+	for sk, family := range group {
+		if !replace && !isPushed(family, pushed) {
+			continue
+		}
+		if err := s.delete(sk); err != nil {
+			return err
+		}
+		delete(group, sk)
+	}
+
+	// Counters are written as deltas, so any leftover copy of a pushed
+	// counter (e.g. from before a restart) must go as well.
+	for sk := range members {
+		if sk.MType != "counter" {
+			continue
+		}
+		if err := s.delete(sk); err != nil {
+			return err
+		}
+	}
+
+	if err := s.storage.UpdateMetricsBatch(metrics); err != nil {
+		return fmt.Errorf("failed to store pushed metrics: %w", err)
+	}
+	for sk, family := range members {
+		group[sk] = family
+	}
+	return nil
+}
+
+// Delete removes every metric pushed to the group.
+func (s *Service) Delete(grouping map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, err := s.group(grouping)
+	if err != nil {
+		return err
+	}
+	for sk := range group {
+		if err := s.delete(sk); err != nil {
+			return err
+		}
+	}
+	delete(s.groups, models.SeriesID("", grouping))
+
+	// The push time series also exists for groups pushed before a restart.
+	return s.delete(seriesKey{MType: "gauge", ID: models.SeriesID(PushTimeMetric, grouping)})
+}
+
+// group returns the members of the group, adding the series found in storage
+// to the ones remembered since the start. Members found in storage are
+// recorded under their series name rather than their family.
+func (s *Service) group(grouping map[string]string) (map[seriesKey]string, error) {
+	key := models.SeriesID("", grouping)
+	group := s.groups[key]
+	if group == nil {
+		group = make(map[seriesKey]string)
+		s.groups[key] = group
+	}
+
+	stored, err := s.storedMembers(grouping)
+	if err != nil {
+		return nil, err
+	}
+	for sk, name := range stored {
+		if _, ok := group[sk]; !ok {
+			group[sk] = name
+		}
+	}
+	return group, nil
+}
+
+// storedMembers returns the stored series that carry the grouping labels and
+// belong to no more specific group, i.e. no other group whose push time
+// series exists and whose labels the series also carries.
+func (s *Service) storedMembers(grouping map[string]string) (map[seriesKey]string, error) {
+	metrics, err := s.storage.Snapshot()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stored metrics: %w", err)
+	}
+
+	type series struct {
+		key    seriesKey
+		name   string
+		labels map[string]string
+	}
+	var candidates []series
+	var groups []map[string]string
+	for _, m := range metrics {
+		name, labels, err := models.ParseSeriesID(m.ID)
+		if err != nil || !hasLabels(labels, grouping) {
+			continue
+		}
+		if name == PushTimeMetric && m.MType == "gauge" {
+			groups = append(groups, labels)
+		}
+		candidates = append(candidates, series{key: seriesKey{MType: m.MType, ID: m.ID}, name: name, labels: labels})
+	}
+
+	members := make(map[seriesKey]string)
+	for _, c := range candidates {
+		owned := true
+		for _, g := range groups {
+			if len(g) > len(grouping) && hasLabels(c.labels, g) {
+				owned = false
+				break
+			}
+		}
+		if owned {
+			members[c.key] = c.name
+		}
+	}
+	return members, nil
+}
+
+// hasLabels reports whether labels contains every label in want.
+func hasLabels(labels, want map[string]string) bool {
+	for k, v := range want {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// isPushed reports whether family, a family name or the name of one of its
+// series, was pushed again.
+func isPushed(family string, pushed map[string]bool) bool {
+	if pushed[family] {
+		return true
+	}
+	for _, suffix := range []string{"_bucket", "_count", "_sum"} {
+		if name, ok := strings.CutSuffix(family, suffix); ok && pushed[name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) delete(sk seriesKey) error {
+	err := s.storage.DeleteMetric(sk.MType, sk.ID)
+	if err != nil && !errors.Is(err, storage.ErrMetricNotFound) {
+		return fmt.Errorf("failed to delete %s %s: %w", sk.MType, sk.ID, err)
+	}
+	return nil
+}
+
+// toMetrics converts parsed families to metrics. Counter samples (and the
+// _count/_bucket series of histograms and summaries) become counters whose
+// delta is the pushed absolute value; this is exact because the previous
+// series is deleted before the push is written. Everything else is a gauge.
+// Relabel rules apply last.
+func toMetrics(grouping map[string]string, families []promtext.Family, rules *relabel.Engine) ([]models.Metrics, map[seriesKey]string, error) {
+	var metrics []models.Metrics
+	members := make(map[seriesKey]string)
+
+	for _, f := range families {
+		var meta *models.Metadata
+		if f.Help != "" {
+			meta = &models.Metadata{Description: f.Help}
+		}
+		for _, sample := range f.Samples {
+			if sample.Timestamp != nil {
+				return nil, nil, ErrTimestampNotAllowed
+			}
+
+			labels := make(map[string]string, len(sample.Labels)+len(grouping))
+			for k, v := range sample.Labels {
+				labels[k] = v
+			}
+			for k, v := range grouping {
+				labels[k] = v
+			}
+
+			m := models.Metrics{ID: models.SeriesID(sample.Name, labels), Meta: meta}
+			if isCounterSample(f, sample.Name) {
+				if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+					return nil, nil, fmt.Errorf("%w %s: counter value must be finite", ErrInvalidMetric, sample.Name)
+				}
+				delta := int64(math.Round(sample.Value))
+				m.MType = "counter"
+				m.Delta = &delta
+			} else {
+				value := sample.Value
+				m.MType = "gauge"
+				m.Value = &value
+			}
+
+			m, keep := rules.Apply(m)
+			if !keep {
+				continue
+			}
+
+			metrics = append(metrics, m)
+			members[seriesKey{MType: m.MType, ID: m.ID}] = f.Name
+		}
+	}
+
+	return metrics, members, nil
+}
+
+func isCounterSample(f promtext.Family, sample string) bool {
+	switch f.Type {
+	case "counter":
+		return true
+	case "histogram":
+		return sample == f.Name+"_bucket" || sample == f.Name+"_count"
+	case "summary":
+		return sample == f.Name+"_count"
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package pushgateway
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hairutdin/metrics-service/internal/promtext"
+	"github.com/hairutdin/metrics-service/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func parse(t *testing.T, text string) []promtext.Family {
+	families, err := promtext.Parse(strings.NewReader(text))
+	assert.NoError(t, err)
+	return families
+}
+
+func TestPushReplaceAndDelete(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	svc := NewService(memStorage)
+	grouping := map[string]string{"job": "backup", "instance": "db1"}
+
+	err := svc.Push("", grouping, parse(t, "# TYPE rows counter\nrows 10\nduration 3.5\n"), true)
+	assert.NoError(t, err)
+
+	value, err := memStorage.GetMetric("counter", `rows{instance="db1",job="backup"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "10", value)
+
+	// Pushed counters are absolute values, not increments.
+	err = svc.Push("", grouping, parse(t, "# TYPE rows counter\nrows 12\n"), false)
+	assert.NoError(t, err)
+	value, _ = memStorage.GetMetric("counter", `rows{instance="db1",job="backup"}`)
+	assert.Equal(t, "12", value)
+
+	// POST keeps families that were not pushed again.
+	_, err = memStorage.GetMetric("gauge", `duration{instance="db1",job="backup"}`)
+	assert.NoError(t, err)
+
+	// PUT replaces the whole group.
+	err = svc.Push("", grouping, parse(t, "other 1\n"), true)
+	assert.NoError(t, err)
+	_, err = memStorage.GetMetric("gauge", `duration{instance="db1",job="backup"}`)
+	assert.ErrorIs(t, err, storage.ErrMetricNotFound)
+
+	assert.NoError(t, svc.Delete(grouping))
+	metrics, _ := memStorage.Snapshot()
+	assert.Empty(t, metrics)
+}
+
+func TestGroupsSurviveRestart(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	backup := map[string]string{"job": "backup"}
+	db1 := map[string]string{"job": "backup", "instance": "db1"}
+
+	svc := NewService(memStorage)
+	assert.NoError(t, svc.Push("", backup, parse(t, "# TYPE rows counter\nrows 10\nduration 3.5\n# TYPE latency histogram\nlatency_bucket{le=\"+Inf\"} 2\nlatency_sum 1.5\nlatency_count 2\n"), true))
+	assert.NoError(t, svc.Push("", db1, parse(t, "duration 1\n"), true))
+
+	// A new service, as after a restart, finds the groups in storage.
+	svc = NewService(memStorage)
+	assert.NoError(t, svc.Push("", backup, parse(t, "# TYPE latency histogram\nlatency_bucket{le=\"+Inf\"} 3\nlatency_sum 2\nlatency_count 3\n"), false))
+	value, err := memStorage.GetMetric("counter", `latency_count{job="backup"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", value)
+	_, err = memStorage.GetMetric("gauge", `duration{job="backup"}`)
+	assert.NoError(t, err, "POST keeps families that were not pushed again")
+
+	svc = NewService(memStorage)
+	assert.NoError(t, svc.Push("", backup, parse(t, "other 1\n"), true))
+	_, err = memStorage.GetMetric("gauge", `duration{job="backup"}`)
+	assert.ErrorIs(t, err, storage.ErrMetricNotFound)
+	_, err = memStorage.GetMetric("counter", `rows{job="backup"}`)
+	assert.ErrorIs(t, err, storage.ErrMetricNotFound)
+
+	svc = NewService(memStorage)
+	assert.NoError(t, svc.Delete(backup))
+	metrics, _ := memStorage.Snapshot()
+	ids := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		ids = append(ids, m.ID)
+	}
+	assert.ElementsMatch(t, []string{`duration{instance="db1",job="backup"}`, `push_time_seconds{instance="db1",job="backup"}`}, ids,
+		"a more specific group is left alone")
+}
+
+func TestPushRejectsTimestamps(t *testing.T) {
+	svc := NewService(storage.NewMemStorage())
+	err := svc.Push("", map[string]string{"job": "x"}, parse(t, "m 1 1700000000000\n"), true)
+	assert.ErrorIs(t, err, ErrTimestampNotAllowed)
+}
+
+func TestPushRejectsInvalidMetrics(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	svc := NewService(memStorage)
+	grouping := map[string]string{"job": "x"}
+	assert.NoError(t, svc.Push("", grouping, parse(t, "m 1\n"), true))
+
+	for _, text := range []string{
+		"ratio +Inf\nm 2\n",
+		"# TYPE rows counter\nrows NaN\n",
+		strings.Repeat("a", 300) + " 1\n",
+	} {
+		err := svc.Push("", grouping, parse(t, text), true)
+		assert.ErrorIs(t, err, ErrInvalidMetric, text)
+	}
+
+	value, _ := memStorage.GetMetric("gauge", `m{job="x"}`)
+	assert.Equal(t, "1.000000", value, "a rejected push leaves the group untouched")
+}
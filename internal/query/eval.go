@@ -0,0 +1,446 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hairutdin/metrics-service/internal/rate"
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+)
+
+// ErrStorage wraps failures to read metrics, as opposed to mistakes in the
+// query.
+var ErrStorage = errors.New("failed to read metrics")
+
+// NameLabel holds the metric name in result labels.
+const NameLabel = "__name__"
+
+// typeLabel can be matched on to pick a metric type; results do not carry
+// it.
+const typeLabel = "__type__"
+
+// functions take the samples of one series over a range and report false
+// when there are too few.
+var functions = map[string]rate.Func{
+	"rate":     rate.Rate,
+	"irate":    rate.IRate,
+	"increase": rate.Increase,
+	"avg_over_time": func(samples []models.Sample) (float64, bool) {
+		sum, ok := sumOverTime(samples)
+		return sum / float64(len(samples)), ok
+	},
+	"min_over_time": func(samples []models.Sample) (float64, bool) {
+		return foldOverTime(samples, math.Min)
+	},
+	"max_over_time": func(samples []models.Sample) (float64, bool) {
+		return foldOverTime(samples, math.Max)
+	},
+	"sum_over_time": sumOverTime,
+	"count_over_time": func(samples []models.Sample) (float64, bool) {
+		return float64(len(samples)), len(samples) > 0
+	},
+	"last_over_time": func(samples []models.Sample) (float64, bool) {
+		if len(samples) == 0 {
+			return 0, false
+		}
+		return samples[len(samples)-1].Value, true
+	},
+}
+
+func sumOverTime(samples []models.Sample) (float64, bool) {
+	var sum float64
+	for _, s := range samples {
+		sum += s.Value
+	}
+	return sum, len(samples) > 0
+}
+
+func foldOverTime(samples []models.Sample, f func(a, b float64) float64) (float64, bool) {
+	if len(samples) == 0 {
+		return 0, false
+	}
+	v := samples[0].Value
+	for _, s := range samples[1:] {
+		v = f(v, s.Value)
+	}
+	return v, true
+}
+
+// Value is the result of an expression: a Vector or a Scalar.
+type Value interface {
+	Type() string
+}
+
+// Sample is the value of one series.
+type Sample struct {
+	Labels map[string]string `json:"metric"`
+	Value  float64           `json:"value"`
+}
+
+// Vector holds one sample per series.
+type Vector []Sample
+
+// Scalar is a plain number.
+type Scalar float64
+
+func (Vector) Type() string { return "vector" }
+func (Scalar) Type() string { return "scalar" }
+
+// MarshalJSON writes NaN and infinities, which division can produce, as the
+// strings "NaN", "+Inf" and "-Inf".
+func (s Sample) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Labels map[string]string `json:"metric"`
+		Value  json.RawMessage   `json:"value"`
+	}{s.Labels, formatValue(float64(s.Value))})
+}
+
+func (s Scalar) MarshalJSON() ([]byte, error) {
+	return formatValue(float64(s)), nil
+}
+
+func formatValue(v float64) json.RawMessage {
+	switch {
+	case math.IsNaN(v):
+		return json.RawMessage(`"NaN"`)
+	case math.IsInf(v, 1):
+		return json.RawMessage(`"+Inf"`)
+	case math.IsInf(v, -1):
+		return json.RawMessage(`"-Inf"`)
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// Engine evaluates queries against the current metrics and their recorded
+// history.
+type Engine struct {
+	storage storage.MetricsStorage
+	now     func() time.Time
+}
+
+func NewEngine(s storage.MetricsStorage) *Engine {
+	return &Engine{storage: s, now: time.Now}
+}
+
+// Query parses and evaluates q.
+func (e *Engine) Query(q string) (Value, error) {
+	expr, err := Parse(q)
+	if err != nil {
+		return nil, err
+	}
+	return e.Eval(expr)
+}
+
+// Eval evaluates a parsed expression. Vectors come back sorted by labels.
+func (e *Engine) Eval(expr Expr) (Value, error) {
+	ev := &evaluator{storage: e.storage, now: e.now()}
+	v, err := ev.eval(expr)
+	if err != nil {
+		return nil, err
+	}
+	if vec, ok := v.(Vector); ok {
+		sort.Slice(vec, func(i, j int) bool {
+			return signature(vec[i].Labels, false) < signature(vec[j].Labels, false)
+		})
+	}
+	return v, nil
+}
+
+// evaluator reads the stored metrics at most once per evaluation.
+type evaluator struct {
+	storage  storage.MetricsStorage
+	now      time.Time
+	snapshot []models.Metrics
+	loaded   bool
+}
+
+// series is a stored series picked by a selector.
+type series struct {
+	id, mtype string
+	labels    map[string]string
+	value     float64
+}
+
+func (ev *evaluator) eval(expr Expr) (Value, error) {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return Scalar(e.Value), nil
+	case *ParenExpr:
+		return ev.eval(e.Expr)
+	case *UnaryExpr:
+		v, err := ev.eval(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return arithmetic("*", Scalar(-1), v)
+	case *VectorSelector:
+		if e.Range > 0 {
+			return nil, fmt.Errorf("range selector %s must be passed to a function such as rate", e)
+		}
+		selected, err := ev.selectSeries(e)
+		if err != nil {
+			return nil, err
+		}
+		vec := make(Vector, 0, len(selected))
+		for _, s := range selected {
+			vec = append(vec, Sample{Labels: s.labels, Value: s.value})
+		}
+		return vec, nil
+	case *Call:
+		return ev.evalCall(e)
+	case *Aggregation:
+		return ev.evalAggregation(e)
+	case *BinaryExpr:
+		lhs, err := ev.eval(e.LHS)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := ev.eval(e.RHS)
+		if err != nil {
+			return nil, err
+		}
+		return arithmetic(e.Op, lhs, rhs)
+	}
+	return nil, fmt.Errorf("unsupported expression %s", expr)
+}
+
+func (ev *evaluator) selectSeries(sel *VectorSelector) ([]series, error) {
+	if !ev.loaded {
+		snapshot, err := ev.storage.Snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+		ev.snapshot, ev.loaded = snapshot, true
+	}
+
+	var selected []series
+	for _, m := range ev.snapshot {
+		name, labels, err := models.ParseSeriesID(m.ID)
+		if err != nil || name != sel.Name {
+			continue
+		}
+		matched := true
+		for _, matcher := range sel.Matchers {
+			v := labels[matcher.Name]
+			switch matcher.Name {
+			case NameLabel:
+				v = name
+			case typeLabel:
+				v = m.MType
+			}
+			if !matcher.Matches(v) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		withName := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			withName[k] = v
+		}
+		withName[NameLabel] = name
+		s := series{id: m.ID, mtype: m.MType, labels: withName}
+		if m.Value != nil {
+			s.value = *m.Value
+		} else if m.Delta != nil {
+			s.value = float64(*m.Delta)
+		}
+		selected = append(selected, s)
+	}
+	return selected, nil
+}
+
+func (ev *evaluator) evalCall(call *Call) (Value, error) {
+	sel, ok := call.Args[0].(*VectorSelector)
+	if !ok || sel.Range <= 0 {
+		return nil, fmt.Errorf("%s expects a range selector such as metric[5m]", call.Func)
+	}
+	f := functions[call.Func]
+
+	selected, err := ev.selectSeries(sel)
+	if err != nil {
+		return nil, err
+	}
+	vec := make(Vector, 0, len(selected))
+	for _, s := range selected {
+		samples, err := ev.storage.History(s.mtype, s.id, ev.now.Add(-sel.Range), ev.now)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+		v, ok := f(samples)
+		if !ok {
+			continue
+		}
+		vec = append(vec, Sample{Labels: dropName(s.labels), Value: v})
+	}
+	return vec, nil
+}
+
+func (ev *evaluator) evalAggregation(agg *Aggregation) (Value, error) {
+	v, err := ev.eval(agg.Expr)
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := v.(Vector)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a vector, got a scalar", agg.Op)
+	}
+
+	type group struct {
+		labels        map[string]string
+		sum, min, max float64
+		count         int
+	}
+	groups := make(map[string]*group)
+	var order []string
+	for _, s := range vec {
+		labels := groupLabels(s.Labels, agg)
+		key := signature(labels, false)
+		g := groups[key]
+		if g == nil {
+			g = &group{labels: labels, min: s.Value, max: s.Value}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.sum += s.Value
+		g.min = math.Min(g.min, s.Value)
+		g.max = math.Max(g.max, s.Value)
+		g.count++
+	}
+
+	result := make(Vector, 0, len(groups))
+	for _, key := range order {
+		g := groups[key]
+		var value float64
+		switch agg.Op {
+		case "sum":
+			value = g.sum
+		case "avg":
+			value = g.sum / float64(g.count)
+		case "min":
+			value = g.min
+		case "max":
+			value = g.max
+		case "count":
+			value = float64(g.count)
+		}
+		result = append(result, Sample{Labels: g.labels, Value: value})
+	}
+	return result, nil
+}
+
+func groupLabels(labels map[string]string, agg *Aggregation) map[string]string {
+	grouped := make(map[string]string)
+	if agg.Without {
+		for k, v := range labels {
+			grouped[k] = v
+		}
+		delete(grouped, NameLabel)
+		for _, k := range agg.Grouping {
+			delete(grouped, k)
+		}
+		return grouped
+	}
+	for _, k := range agg.Grouping {
+		if v, ok := labels[k]; ok {
+			grouped[k] = v
+		}
+	}
+	return grouped
+}
+
+// arithmetic applies op to scalars and vectors. Between two vectors, series
+// with the same labels apart from the name are paired up; unpaired series
+// are dropped.
+func arithmetic(op string, lhs, rhs Value) (Value, error) {
+	apply := func(a, b float64) float64 {
+		switch op {
+		case "+":
+			return a + b
+		case "-":
+			return a - b
+		case "*":
+			return a * b
+		default:
+			return a / b
+		}
+	}
+
+	switch l := lhs.(type) {
+	case Scalar:
+		switch r := rhs.(type) {
+		case Scalar:
+			return Scalar(apply(float64(l), float64(r))), nil
+		case Vector:
+			out := make(Vector, 0, len(r))
+			for _, s := range r {
+				out = append(out, Sample{Labels: dropName(s.Labels), Value: apply(float64(l), s.Value)})
+			}
+			return out, nil
+		}
+	case Vector:
+		switch r := rhs.(type) {
+		case Scalar:
+			out := make(Vector, 0, len(l))
+			for _, s := range l {
+				out = append(out, Sample{Labels: dropName(s.Labels), Value: apply(s.Value, float64(r))})
+			}
+			return out, nil
+		case Vector:
+			right := make(map[string]Sample, len(r))
+			for _, s := range r {
+				key := signature(s.Labels, true)
+				if _, dup := right[key]; dup {
+					return nil, fmt.Errorf("several series on the right of %q have the labels %s", op, key)
+				}
+				right[key] = s
+			}
+			seen := make(map[string]bool, len(l))
+			out := make(Vector, 0, len(l))
+			for _, s := range l {
+				key := signature(s.Labels, true)
+				if seen[key] {
+					return nil, fmt.Errorf("several series on the left of %q have the labels %s", op, key)
+				}
+				seen[key] = true
+				match, ok := right[key]
+				if !ok {
+					continue
+				}
+				out = append(out, Sample{Labels: dropName(s.Labels), Value: apply(s.Value, match.Value)})
+			}
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported operands for %q", op)
+}
+
+// signature identifies a label set, optionally ignoring the metric name.
+func signature(labels map[string]string, withoutName bool) string {
+	if withoutName {
+		labels = dropName(labels)
+	}
+	return models.SeriesID("", labels)
+}
+
+func dropName(labels map[string]string) map[string]string {
+	if _, ok := labels[NameLabel]; !ok {
+		return labels
+	}
+	out := make(map[string]string, len(labels)-1)
+	for k, v := range labels {
+		if k != NameLabel {
+			out[k] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,216 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokDuration
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokLBracket
+	tokRBracket
+	tokComma
+	tokOp // = != =~ !~ + - * /
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// ParseError reports where a query stopped making sense.
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at position %d: %s", e.Pos+1, e.Msg)
+}
+
+// lex splits a query into tokens. The text between square brackets is read
+// as a single duration token.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentStart(c):
+			start := i
+			for i < len(input) && isIdentChar(input[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, input[start:i], start})
+		case isDigit(c) || (c == '.' && i+1 < len(input) && isDigit(input[i+1])):
+			start := i
+			i = scanNumber(input, i)
+			tokens = append(tokens, token{tokNumber, input[start:i], start})
+		case c == '"' || c == '\'':
+			start := i
+			value, end, err := scanString(input, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, token{tokString, value, start})
+		case c == '[':
+			end := strings.IndexByte(input[i:], ']')
+			if end < 0 {
+				return nil, &ParseError{i, "unclosed range"}
+			}
+			tokens = append(tokens,
+				token{tokLBracket, "[", i},
+				token{tokDuration, strings.TrimSpace(input[i+1 : i+end]), i + 1},
+				token{tokRBracket, "]", i + end})
+			i += end + 1
+		case c == '=' || c == '!':
+			if i+1 < len(input) && (input[i+1] == '=' || input[i+1] == '~') {
+				tokens = append(tokens, token{tokOp, input[i : i+2], i})
+				i += 2
+				continue
+			}
+			if c == '!' {
+				return nil, &ParseError{i, "unexpected character '!'"}
+			}
+			tokens = append(tokens, token{tokOp, "=", i})
+			i++
+		case strings.IndexByte("+-*/", c) >= 0:
+			tokens = append(tokens, token{tokOp, string(c), i})
+			i++
+		default:
+			kind, ok := punctuation[c]
+			if !ok {
+				return nil, &ParseError{i, fmt.Sprintf("unexpected character %q", c)}
+			}
+			tokens = append(tokens, token{kind, string(c), i})
+			i++
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(input)}), nil
+}
+
+var punctuation = map[byte]tokenKind{
+	'(': tokLParen,
+	')': tokRParen,
+	'{': tokLBrace,
+	'}': tokRBrace,
+	']': tokRBracket,
+	',': tokComma,
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '.'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func scanNumber(input string, i int) int {
+	for i < len(input) && (isDigit(input[i]) || input[i] == '.') {
+		i++
+	}
+	if i < len(input) && (input[i] == 'e' || input[i] == 'E') {
+		j := i + 1
+		if j < len(input) && (input[j] == '+' || input[j] == '-') {
+			j++
+		}
+		if j < len(input) && isDigit(input[j]) {
+			i = j
+			for i < len(input) && isDigit(input[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+// scanString reads a quoted string starting at i and returns its unescaped
+// value and the position after the closing quote.
+func scanString(input string, i int) (string, int, error) {
+	quote := input[i]
+	var b strings.Builder
+	for j := i + 1; j < len(input); j++ {
+		c := input[j]
+		switch {
+		case c == quote:
+			return b.String(), j + 1, nil
+		case c == '\\' && j+1 < len(input):
+			j++
+			switch input[j] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(input[j])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, &ParseError{i, "unterminated string"}
+}
+
+// parseDuration accepts Go durations plus the d (day) and w (week) units,
+// e.g. 5m, 1h30m or 7d.
+func parseDuration(s string) (time.Duration, error) {
+	var total float64
+	rest := s
+	for rest != "" {
+		n := 0
+		for n < len(rest) && (isDigit(rest[n]) || rest[n] == '.') {
+			n++
+		}
+		unit := n
+		for unit < len(rest) && !isDigit(rest[unit]) && rest[unit] != '.' {
+			unit++
+		}
+		if n == 0 || unit == n {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		v, err := strconv.ParseFloat(rest[:n], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		seconds, ok := durationUnits[rest[n:unit]]
+		if !ok {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		total += v * seconds
+		rest = rest[unit:]
+	}
+	d := time.Duration(total * float64(time.Second))
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+var durationUnits = map[string]float64{
+	"ms": 0.001,
+	"s":  1,
+	"m":  60,
+	"h":  3600,
+	"d":  86400,
+	"w":  604800,
+}
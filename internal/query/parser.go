@@ -0,0 +1,469 @@
+// Package query implements a small expression language over the stored
+// metrics and their history, e.g.
+//
+//	sum(rate(requests_total{service="api"}[5m])) by (host)
+//	max_over_time(HeapAlloc[1h])
+//	HeapAlloc / HeapSys * 100
+//
+// Queries are parsed into an Expr and evaluated by an Engine at the current
+// time.
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expr is a parsed query expression. String returns it in canonical form.
+type Expr interface {
+	String() string
+}
+
+// NumberLiteral is a constant such as 1024 or 0.5.
+type NumberLiteral struct {
+	Value float64
+}
+
+// VectorSelector selects the series of one metric name whose labels satisfy
+// every matcher. With a Range it selects their samples over that window,
+// which only functions such as rate accept.
+type VectorSelector struct {
+	Name     string
+	Matchers []*Matcher
+	Range    time.Duration
+}
+
+// Matcher compares a label with a value. Op is =, !=, =~ or !~; regular
+// expressions must match the whole value. The pseudo-label __type__ holds
+// the metric type, so PollCount{__type__="counter"} leaves out a gauge of
+// the same name.
+type Matcher struct {
+	Name  string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// Call applies a function to its arguments.
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+// Aggregation combines the series of Expr into one per group. Groups are
+// formed by the Grouping labels, or by every label but those when Without
+// is set; without grouping everything falls into one group.
+type Aggregation struct {
+	Op       string
+	Expr     Expr
+	Grouping []string
+	Without  bool
+}
+
+// BinaryExpr is LHS Op RHS with Op one of + - * /.
+type BinaryExpr struct {
+	Op       string
+	LHS, RHS Expr
+}
+
+// UnaryExpr negates Expr.
+type UnaryExpr struct {
+	Expr Expr
+}
+
+// ParenExpr keeps the parentheses of the query so String reproduces them.
+type ParenExpr struct {
+	Expr Expr
+}
+
+func (n *NumberLiteral) String() string {
+	return strconv.FormatFloat(n.Value, 'g', -1, 64)
+}
+
+func (v *VectorSelector) String() string {
+	var b strings.Builder
+	b.WriteString(v.Name)
+	if len(v.Matchers) > 0 {
+		b.WriteByte('{')
+		for i, m := range v.Matchers {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(m.String())
+		}
+		b.WriteByte('}')
+	}
+	if v.Range > 0 {
+		b.WriteString("[" + formatDuration(v.Range) + "]")
+	}
+	return b.String()
+}
+
+func (m *Matcher) String() string {
+	return m.Name + m.Op + strconv.Quote(m.Value)
+}
+
+func (c *Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		args[i] = a.String()
+	}
+	return c.Func + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (a *Aggregation) String() string {
+	s := a.Op + "(" + a.Expr.String() + ")"
+	if len(a.Grouping) > 0 || a.Without {
+		keyword := "by"
+		if a.Without {
+			keyword = "without"
+		}
+		s += " " + keyword + " (" + strings.Join(a.Grouping, ", ") + ")"
+	}
+	return s
+}
+
+func (b *BinaryExpr) String() string {
+	return b.LHS.String() + " " + b.Op + " " + b.RHS.String()
+}
+
+func (u *UnaryExpr) String() string {
+	return "-" + u.Expr.String()
+}
+
+func (p *ParenExpr) String() string {
+	return "(" + p.Expr.String() + ")"
+}
+
+// formatDuration writes d with the largest units that divide it, e.g. 90m
+// as 1h30m and 86400s as 1d.
+func formatDuration(d time.Duration) string {
+	if d%time.Second != 0 {
+		return d.String()
+	}
+	var b strings.Builder
+	rest := int64(d / time.Second)
+	for _, u := range []struct {
+		unit    string
+		seconds int64
+	}{{"w", 604800}, {"d", 86400}, {"h", 3600}, {"m", 60}, {"s", 1}} {
+		if rest >= u.seconds {
+			b.WriteString(strconv.FormatInt(rest/u.seconds, 10) + u.unit)
+			rest %= u.seconds
+		}
+	}
+	return b.String()
+}
+
+// Aggregation operators.
+var aggregations = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+// Parse parses a query. Errors are *ParseError.
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.unexpected(t)
+	}
+	return expr, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, &ParseError{t.pos, fmt.Sprintf("expected %s, found %s", what, describe(t))}
+	}
+	return t, nil
+}
+
+func (p *parser) unexpected(t token) error {
+	return &ParseError{t.pos, "unexpected " + describe(t)}
+}
+
+func describe(t token) string {
+	if t.kind == tokEOF {
+		return "end of query"
+	}
+	return strconv.Quote(t.text)
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != tokOp {
+		return false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpr parses a sum of terms; * and / bind tighter than + and -.
+func (p *parser) parseExpr() (Expr, error) {
+	lhs, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+", "-") {
+		op := p.next().text
+		rhs, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpr{Op: op, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseTerm() (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*", "/") {
+		op := p.next().text
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpr{Op: op, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.isOp("-") {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := expr.(*NumberLiteral); ok {
+			return &NumberLiteral{Value: -n.Value}, nil
+		}
+		return &UnaryExpr{Expr: expr}, nil
+	}
+	if p.isOp("+") {
+		p.next()
+		return p.parseUnary()
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &ParseError{t.pos, fmt.Sprintf("invalid number %q", t.text)}
+		}
+		return &NumberLiteral{Value: v}, nil
+	case tokLParen:
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, "\")\""); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+	case tokIdent:
+		next := p.peek()
+		if aggregations[t.text] && (next.kind == tokLParen || next.text == "by" || next.text == "without") {
+			return p.parseAggregation(t.text)
+		}
+		if next.kind == tokLParen {
+			return p.parseCall(t)
+		}
+		return p.parseSelector(t.text)
+	}
+	return nil, p.unexpected(t)
+}
+
+// parseAggregation accepts the grouping clause before or after the
+// argument: sum by (host) (x) and sum(x) by (host).
+func (p *parser) parseAggregation(op string) (Expr, error) {
+	agg := &Aggregation{Op: op}
+	grouped := false
+	if t := p.peek(); t.text == "by" || t.text == "without" {
+		if err := p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+		grouped = true
+	}
+
+	if _, err := p.expect(tokLParen, "\"(\""); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokRParen, "\")\""); err != nil {
+		return nil, err
+	}
+	agg.Expr = expr
+
+	if t := p.peek(); !grouped && (t.text == "by" || t.text == "without") {
+		if err := p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+func (p *parser) parseGrouping(agg *Aggregation) error {
+	agg.Without = p.next().text == "without"
+	if _, err := p.expect(tokLParen, "\"(\""); err != nil {
+		return err
+	}
+	agg.Grouping = []string{}
+	for p.peek().kind != tokRParen {
+		label, err := p.expect(tokIdent, "label name")
+		if err != nil {
+			return err
+		}
+		agg.Grouping = append(agg.Grouping, label.text)
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	_, err := p.expect(tokRParen, "\")\"")
+	return err
+}
+
+func (p *parser) parseCall(name token) (Expr, error) {
+	if _, ok := functions[name.text]; !ok {
+		return nil, &ParseError{name.pos, fmt.Sprintf("unknown function %q", name.text)}
+	}
+	call := &Call{Func: name.text}
+	p.next()
+	for p.peek().kind != tokRParen {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(tokRParen, "\")\""); err != nil {
+		return nil, err
+	}
+	if len(call.Args) != 1 {
+		return nil, &ParseError{name.pos, fmt.Sprintf("%s expects 1 argument, got %d", call.Func, len(call.Args))}
+	}
+	return call, nil
+}
+
+func (p *parser) parseSelector(name string) (Expr, error) {
+	sel := &VectorSelector{Name: name}
+	if p.peek().kind == tokLBrace {
+		p.next()
+		for p.peek().kind != tokRBrace {
+			m, err := p.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			sel.Matchers = append(sel.Matchers, m)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect(tokRBrace, "\"}\""); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek().kind == tokLBracket {
+		p.next()
+		t := p.next()
+		d, err := parseDuration(t.text)
+		if err != nil {
+			return nil, &ParseError{t.pos, err.Error()}
+		}
+		sel.Range = d
+		if _, err := p.expect(tokRBracket, "\"]\""); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+func (p *parser) parseMatcher() (*Matcher, error) {
+	label, err := p.expect(tokIdent, "label name")
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if op.kind != tokOp || (op.text != "=" && op.text != "!=" && op.text != "=~" && op.text != "!~") {
+		return nil, &ParseError{op.pos, fmt.Sprintf("expected label matcher, found %s", describe(op))}
+	}
+	value, err := p.expect(tokString, "quoted label value")
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Matcher{Name: label.text, Op: op.text, Value: value.text}
+	if op.text == "=~" || op.text == "!~" {
+		m.re, err = regexp.Compile("^(?:" + value.text + ")$")
+		if err != nil {
+			return nil, &ParseError{value.pos, fmt.Sprintf("invalid regex: %v", err)}
+		}
+	}
+	return m, nil
+}
+
+// Matches reports whether a label value satisfies the matcher.
+func (m *Matcher) Matches(v string) bool {
+	switch m.Op {
+	case "=":
+		return v == m.Value
+	case "!=":
+		return v != m.Value
+	case "=~":
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
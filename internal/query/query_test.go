@@ -0,0 +1,160 @@
+package query
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	for input, want := range map[string]string{
+		`sum(rate(requests_total{service="api"}[5m])) by (host)`: `sum(rate(requests_total{service="api"}[5m])) by (host)`,
+		`sum by (host, region) (x)`:                              `sum(x) by (host, region)`,
+		`avg without(host)(x)`:                                   `avg(x) without (host)`,
+		`max_over_time(HeapAlloc[90m])`:                          `max_over_time(HeapAlloc[1h30m])`,
+		`a + b * 2 - -c / (d - 1)`:                               `a + b * 2 - -c / (d - 1)`,
+		`x{a!="1", b=~"w.*",c!~'z'}[1d]`:                         `x{a!="1",b=~"w.*",c!~"z"}[1d]`,
+		`-1e3 + .5`:                                              `-1000 + 0.5`,
+	} {
+		expr, err := Parse(input)
+		if !assert.NoError(t, err, input) {
+			continue
+		}
+		assert.Equal(t, want, expr.String(), input)
+	}
+
+	expr, _ := Parse(`a + b * c`)
+	assert.Equal(t, "*", expr.(*BinaryExpr).RHS.(*BinaryExpr).Op, "* binds tighter than +")
+
+	for _, bad := range []string{
+		``,
+		`sum(`,
+		`x{a="1"`,
+		`x{a~"1"}`,
+		`x{a="1"}[5q]`,
+		`x[5m`,
+		`foo(x)`,
+		`rate(x[5m], y)`,
+		`x{a=~"("}`,
+		`x y`,
+		`"unterminated`,
+		`x ! y`,
+	} {
+		_, err := Parse(bad)
+		var perr *ParseError
+		assert.ErrorAs(t, err, &perr, bad)
+	}
+}
+
+func newTestEngine() (*Engine, *storage.MemStorage) {
+	s := storage.NewMemStorage()
+	now := time.Now()
+	at := func(d time.Duration) *int64 { v := now.Add(d).UnixMilli(); return &v }
+	gauge := func(v float64) *float64 { return &v }
+	delta := func(v int64) *int64 { return &v }
+
+	var batch []models.Metrics
+	for i, host := range []string{"a", "b"} {
+		id := models.SeriesID("requests_total", map[string]string{"service": "api", "host": host})
+		batch = append(batch,
+			models.Metrics{ID: id, MType: "counter", Delta: delta(100), Timestamp: at(-4 * time.Minute)},
+			models.Metrics{ID: id, MType: "counter", Delta: delta(int64(60 * (i + 1))), Timestamp: at(-3 * time.Minute)},
+		)
+	}
+	batch = append(batch,
+		models.Metrics{ID: `requests_total{host="a",service="web"}`, MType: "counter", Delta: delta(1), Timestamp: at(-time.Minute)},
+		models.Metrics{ID: "HeapAlloc", MType: "gauge", Value: gauge(30), Timestamp: at(-50 * time.Minute)},
+		models.Metrics{ID: "HeapAlloc", MType: "gauge", Value: gauge(90), Timestamp: at(-20 * time.Minute)},
+		models.Metrics{ID: "HeapAlloc", MType: "gauge", Value: gauge(60), Timestamp: at(-time.Minute)},
+		models.Metrics{ID: "HeapSys", MType: "gauge", Value: gauge(120), Timestamp: at(-time.Minute)},
+	)
+	s.UpdateMetricsBatch(batch)
+
+	e := NewEngine(s)
+	e.now = func() time.Time { return now }
+	return e, s
+}
+
+func TestEval(t *testing.T) {
+	e, s := newTestEngine()
+
+	v, err := e.Query(`sum(rate(requests_total{service="api"}[5m])) by (host)`)
+	assert.NoError(t, err)
+	assert.Equal(t, Vector{
+		{Labels: map[string]string{"host": "a"}, Value: 1},
+		{Labels: map[string]string{"host": "b"}, Value: 2},
+	}, v)
+
+	v, err = e.Query(`sum(increase(requests_total[5m]))`)
+	assert.NoError(t, err)
+	assert.Equal(t, Vector{{Labels: map[string]string{}, Value: 180}}, v, "a series with one sample has no increase")
+
+	v, err = e.Query(`count(requests_total) without (service)`)
+	assert.NoError(t, err)
+	assert.Equal(t, Vector{
+		{Labels: map[string]string{"host": "a"}, Value: 2},
+		{Labels: map[string]string{"host": "b"}, Value: 1},
+	}, v)
+
+	for query, want := range map[string]float64{
+		`max_over_time(HeapAlloc[1h])`:   90,
+		`min_over_time(HeapAlloc[30m])`:  60,
+		`avg_over_time(HeapAlloc[1h])`:   60,
+		`count_over_time(HeapAlloc[1h])`: 3,
+		`HeapAlloc / HeapSys * 100`:      50,
+		`-HeapAlloc + 100`:               40,
+	} {
+		v, err := e.Query(query)
+		if !assert.NoError(t, err, query) {
+			continue
+		}
+		vec := v.(Vector)
+		if assert.Len(t, vec, 1, query) {
+			assert.Equal(t, want, vec[0].Value, query)
+			assert.NotContains(t, vec[0].Labels, NameLabel, query)
+		}
+	}
+
+	v, err = e.Query(`(1 + 2) * 3`)
+	assert.NoError(t, err)
+	assert.Equal(t, Scalar(9), v)
+
+	v, err = e.Query(`HeapSys{__type__="counter"}`)
+	assert.NoError(t, err)
+	assert.Empty(t, v)
+
+	v, err = e.Query(`HeapAlloc`)
+	assert.NoError(t, err)
+	assert.Equal(t, Vector{{Labels: map[string]string{NameLabel: "HeapAlloc"}, Value: 60}}, v)
+
+	for _, bad := range []string{
+		`HeapAlloc[5m]`,
+		`rate(HeapAlloc)`,
+		`sum(1)`,
+	} {
+		_, err := e.Query(bad)
+		assert.Error(t, err, bad)
+	}
+
+	s.UpdateCounter("HeapAlloc", 1)
+	_, err = e.Query(`HeapAlloc / HeapSys`)
+	assert.ErrorContains(t, err, "several series on the left")
+	v, err = e.Query(`HeapAlloc{__type__="gauge"} / HeapSys`)
+	assert.NoError(t, err)
+	assert.Len(t, v, 1)
+}
+
+func TestValueJSON(t *testing.T) {
+	b, err := json.Marshal(Vector{{Labels: map[string]string{"host": "a"}, Value: math.Inf(1)}, {Value: 1.5}})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"metric":{"host":"a"},"value":"+Inf"},{"metric":null,"value":1.5}]`, string(b))
+
+	b, err = json.Marshal(Scalar(math.NaN()))
+	assert.NoError(t, err)
+	assert.Equal(t, `"NaN"`, string(b))
+}
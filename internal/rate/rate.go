@@ -0,0 +1,85 @@
+// Package rate turns the recorded running totals of a counter into
+// increases and per-second rates. A total lower than the one before it means
+// the counter was reset, e.g. by an agent restart; the new total then counts
+// as the increase since the reset.
+package rate
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+// Func computes a value from the samples of one counter, oldest first. It
+// reports false when there are too few samples.
+type Func func(samples []models.Sample) (float64, bool)
+
+// Functions are the computations offered by the API, by name.
+var Functions = map[string]Func{
+	"rate":     Rate,
+	"irate":    IRate,
+	"increase": Increase,
+}
+
+// Lookup returns the function registered under name.
+func Lookup(name string) (Func, error) {
+	f, ok := Functions[name]
+	if !ok {
+		names := make([]string, 0, len(Functions))
+		for n := range Functions {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown function %q, expected one of %v", name, names)
+	}
+	return f, nil
+}
+
+// Increase returns how much the counter grew from the first sample to the
+// last.
+func Increase(samples []models.Sample) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	var total float64
+	for i := 1; i < len(samples); i++ {
+		total += delta(samples[i-1].Value, samples[i].Value)
+	}
+	return total, true
+}
+
+// Rate returns the average per-second increase between the first and the
+// last sample. It does not extrapolate to the edges of the window.
+func Rate(samples []models.Sample) (float64, bool) {
+	increase, ok := Increase(samples)
+	if !ok {
+		return 0, false
+	}
+	return perSecond(increase, samples[0], samples[len(samples)-1])
+}
+
+// IRate returns the per-second increase between the last two samples,
+// which follows sudden changes more closely than Rate.
+func IRate(samples []models.Sample) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	prev, last := samples[len(samples)-2], samples[len(samples)-1]
+	return perSecond(delta(prev.Value, last.Value), prev, last)
+}
+
+func delta(prev, cur float64) float64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+func perSecond(increase float64, first, last models.Sample) (float64, bool) {
+	elapsed := last.Timestamp - first.Timestamp
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return increase / (float64(elapsed) / 1000), true
+}
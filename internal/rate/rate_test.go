@@ -0,0 +1,56 @@
+package rate
+
+import (
+	"testing"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFunctions(t *testing.T) {
+	samples := []models.Sample{
+		{Timestamp: 0, Value: 10},
+		{Timestamp: 10_000, Value: 30},
+		{Timestamp: 20_000, Value: 50},
+		// Reset: the counter restarted and counted 5 since.
+		{Timestamp: 30_000, Value: 5},
+		{Timestamp: 40_000, Value: 45},
+	}
+
+	v, ok := Increase(samples)
+	assert.True(t, ok)
+	assert.Equal(t, 20.0+20+5+40, v)
+
+	v, ok = Rate(samples)
+	assert.True(t, ok)
+	assert.InDelta(t, 85.0/40, v, 1e-9)
+
+	v, ok = IRate(samples)
+	assert.True(t, ok)
+	assert.InDelta(t, 4.0, v, 1e-9)
+
+	v, ok = IRate(samples[:4])
+	assert.True(t, ok)
+	assert.InDelta(t, 0.5, v, 1e-9, "the reset counts as an increase of the new total")
+}
+
+func TestTooFewSamples(t *testing.T) {
+	for name, f := range Functions {
+		_, ok := f(nil)
+		assert.False(t, ok, name)
+		_, ok = f([]models.Sample{{Timestamp: 1, Value: 1}})
+		assert.False(t, ok, name)
+	}
+
+	_, ok := Rate([]models.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 1, Value: 2}})
+	assert.False(t, ok, "no time elapsed")
+}
+
+func TestLookup(t *testing.T) {
+	f, err := Lookup("irate")
+	assert.NoError(t, err)
+	assert.NotNil(t, f)
+
+	_, err = Lookup("deriv")
+	assert.ErrorContains(t, err, "[increase irate rate]")
+}
@@ -0,0 +1,76 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/hairutdin/metrics-service/internal/query"
+)
+
+// Rule stores the result of Expr as gauges named Record, one per resulting
+// series, with Labels added to the series' own labels.
+type Rule struct {
+	Record string            `json:"record"`
+	Expr   string            `json:"expr"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	expr query.Expr
+}
+
+// Config is the layout of a rule file.
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+var recordName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// LoadConfig reads and checks rule files. Their rules are evaluated in the
+// order of the files and of the rules within each file.
+func LoadConfig(paths ...string) (*Config, error) {
+	var cfg Config
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var file Config
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&file); err != nil {
+			return nil, fmt.Errorf("invalid rule file %s: %w", path, err)
+		}
+		cfg.Rules = append(cfg.Rules, file.Rules...)
+	}
+	if err := cfg.prepare(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// prepare validates the rules and parses their expressions.
+func (cfg *Config) prepare() error {
+	records := make(map[string]bool, len(cfg.Rules))
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if !recordName.MatchString(r.Record) {
+			return fmt.Errorf("rule %d: invalid record name %q", i, r.Record)
+		}
+		if records[r.Record] {
+			return fmt.Errorf("rule %d: duplicate record %q", i, r.Record)
+		}
+		records[r.Record] = true
+
+		expr, err := query.Parse(r.Expr)
+		if err != nil {
+			return fmt.Errorf("rule %d (%s): %w", i, r.Record, err)
+		}
+		r.expr = expr
+		if _, ok := r.Labels[query.NameLabel]; ok {
+			return fmt.Errorf("rule %d (%s): label %s is reserved", i, r.Record, query.NameLabel)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Package recording evaluates recording rules: named query expressions whose
+// results are written back to storage as gauges, so expensive aggregates are
+// computed once per interval instead of by every reader.
+package recording
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hairutdin/metrics-service/internal/query"
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+)
+
+// Rule health.
+const (
+	HealthUnknown = "unknown"
+	HealthOK      = "ok"
+	HealthError   = "err"
+)
+
+// Metrics written for every rule evaluation, labelled with rule=<record>.
+const (
+	EvaluationsMetric        = "recording_rule_evaluations_total"
+	EvaluationFailuresMetric = "recording_rule_evaluation_failures_total"
+	EvaluationDurationMetric = "recording_rule_evaluation_duration_seconds"
+)
+
+// RuleStatus is the health of a rule as of its last evaluation.
+type RuleStatus struct {
+	Rule
+	Health         string     `json:"health"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastEvaluation *time.Time `json:"last_evaluation,omitempty"`
+	// EvaluationSeconds is how long the last evaluation took.
+	EvaluationSeconds float64 `json:"evaluation_seconds"`
+	// Series is how many gauges the last evaluation wrote.
+	Series int `json:"series"`
+}
+
+// Manager evaluates the rules of a Config.
+type Manager struct {
+	cfg     *Config
+	storage storage.MetricsStorage
+	engine  *query.Engine
+	now     func() time.Time
+
+	mu     sync.Mutex
+	status []RuleStatus
+}
+
+func NewManager(s storage.MetricsStorage, cfg *Config) *Manager {
+	status := make([]RuleStatus, len(cfg.Rules))
+	for i, r := range cfg.Rules {
+		status[i] = RuleStatus{Rule: r, Health: HealthUnknown}
+	}
+	return &Manager{
+		cfg:     cfg,
+		storage: s,
+		engine:  query.NewEngine(s),
+		now:     time.Now,
+		status:  status,
+	}
+}
+
+// Run evaluates the rules every interval until stop is closed.
+func (m *Manager) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.Evaluate()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Evaluate runs every rule once, in order, and stores each rule's result
+// before the next rule runs, so rules can build on earlier ones.
+func (m *Manager) Evaluate() {
+	for i := range m.cfg.Rules {
+		m.evaluate(i)
+	}
+}
+
+func (m *Manager) evaluate(i int) {
+	rule := &m.cfg.Rules[i]
+	start := m.now()
+
+	results, err := m.results(rule)
+	if err == nil {
+		err = m.storage.UpdateMetricsBatch(results)
+		if err != nil {
+			err = fmt.Errorf("failed to store results: %w", err)
+		}
+	}
+	elapsed := m.now().Sub(start)
+
+	m.mu.Lock()
+	status := &m.status[i]
+	status.LastEvaluation = &start
+	status.EvaluationSeconds = elapsed.Seconds()
+	if err != nil {
+		status.Health, status.LastError, status.Series = HealthError, err.Error(), 0
+	} else {
+		status.Health, status.LastError, status.Series = HealthOK, "", len(results)
+	}
+	m.mu.Unlock()
+
+	var failures int64
+	if err != nil {
+		failures = 1
+	}
+	one, seconds := int64(1), elapsed.Seconds()
+	labels := map[string]string{"rule": rule.Record}
+	// Failing to record the evaluation metrics is not the rule's fault,
+	// so it does not affect its health.
+	_ = m.storage.UpdateMetricsBatch([]models.Metrics{
+		{ID: models.SeriesID(EvaluationsMetric, labels), MType: "counter", Delta: &one},
+		{ID: models.SeriesID(EvaluationFailuresMetric, labels), MType: "counter", Delta: &failures},
+		{ID: models.SeriesID(EvaluationDurationMetric, labels), MType: "gauge", Value: &seconds},
+	})
+}
+
+// results evaluates a rule into the gauges to store. Series whose value is
+// NaN or infinite, e.g. after a division by zero, are left out.
+func (m *Manager) results(rule *Rule) ([]models.Metrics, error) {
+	v, err := m.engine.Eval(rule.expr)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples query.Vector
+	switch v := v.(type) {
+	case query.Vector:
+		samples = v
+	case query.Scalar:
+		samples = query.Vector{{Value: float64(v)}}
+	}
+
+	ts := m.now().UnixMilli()
+	results := make([]models.Metrics, 0, len(samples))
+	for _, s := range samples {
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		labels := make(map[string]string, len(s.Labels)+len(rule.Labels))
+		for k, v := range s.Labels {
+			if k != query.NameLabel {
+				labels[k] = v
+			}
+		}
+		for k, v := range rule.Labels {
+			labels[k] = v
+		}
+		value := s.Value
+		results = append(results, models.Metrics{
+			ID:        models.SeriesID(rule.Record, labels),
+			MType:     "gauge",
+			Value:     &value,
+			Timestamp: &ts,
+		})
+	}
+	return results, nil
+}
+
+// Status returns the health of every rule, in evaluation order.
+func (m *Manager) Status() []RuleStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]RuleStatus(nil), m.status...)
+}
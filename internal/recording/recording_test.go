@@ -0,0 +1,76 @@
+package recording
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hairutdin/metrics-service/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluate(t *testing.T) {
+	s := storage.NewMemStorage()
+	s.UpdateGauge(`HeapAlloc{host="a",region="eu"}`, 10)
+	s.UpdateGauge(`HeapAlloc{host="b",region="eu"}`, 20)
+	s.UpdateGauge(`HeapAlloc{host="c",region="us"}`, 40)
+	s.UpdateGauge("Zero", 0)
+
+	cfg := &Config{Rules: []Rule{
+		{Record: "region:heap_alloc:sum", Expr: "sum(HeapAlloc) by (region)"},
+		{Record: "cluster:heap_alloc:sum", Expr: "sum(region:heap_alloc:sum)", Labels: map[string]string{"cluster": "prod"}},
+		{Record: "heap_alloc:ratio", Expr: "sum(HeapAlloc) / sum(Zero)"},
+		{Record: "broken", Expr: "sum(2)"},
+	}}
+	if err := cfg.prepare(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	m := NewManager(s, cfg)
+	assert.Equal(t, HealthUnknown, m.Status()[0].Health)
+
+	m.Evaluate()
+
+	assert.Equal(t, 30.0, s.Gauges()[`region:heap_alloc:sum{region="eu"}`])
+	assert.Equal(t, 40.0, s.Gauges()[`region:heap_alloc:sum{region="us"}`])
+	assert.Equal(t, 70.0, s.Gauges()[`cluster:heap_alloc:sum{cluster="prod"}`], "later rules see earlier results")
+
+	status := m.Status()
+	assert.Equal(t, HealthOK, status[0].Health)
+	assert.Equal(t, 2, status[0].Series)
+	assert.NotNil(t, status[0].LastEvaluation)
+	assert.Equal(t, HealthOK, status[2].Health)
+	assert.Equal(t, 0, status[2].Series, "division by zero is not stored")
+	assert.Equal(t, HealthError, status[3].Health)
+	assert.Contains(t, status[3].LastError, "expects a vector")
+
+	m.Evaluate()
+	assert.Equal(t, int64(2), s.Counters()[`recording_rule_evaluations_total{rule="broken"}`])
+	assert.Equal(t, int64(2), s.Counters()[`recording_rule_evaluation_failures_total{rule="broken"}`])
+	assert.Equal(t, int64(0), s.Counters()[`recording_rule_evaluation_failures_total{rule="cluster:heap_alloc:sum"}`])
+	_, ok := s.Gauges()[`recording_rule_evaluation_duration_seconds{rule="broken"}`]
+	assert.True(t, ok)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.json"), filepath.Join(dir, "second.json")
+	os.WriteFile(first, []byte(`{"rules":[{"record":"cluster:heap:sum","expr":"sum(HeapAlloc)"}]}`), 0o644)
+	os.WriteFile(second, []byte(`{"rules":[{"record":"gc:cpu:avg","expr":"avg(GCCPUFraction)","labels":{"team":"runtime"}}]}`), 0o644)
+
+	cfg, err := LoadConfig(first, second)
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Rules, 2)
+	assert.Equal(t, "avg(GCCPUFraction)", cfg.Rules[1].expr.String())
+
+	for _, bad := range []string{
+		`{"rules":[{"record":"bad name","expr":"x"}]}`,
+		`{"rules":[{"record":"x","expr":"sum("}]}`,
+		`{"rules":[{"record":"x","expr":"y"},{"record":"x","expr":"z"}]}`,
+		`{"rules":[{"record":"x","expr":"y","labels":{"__name__":"z"}}]}`,
+		`{"rules":[{"record":"x","expr":"y","for":"5m"}]}`,
+	} {
+		os.WriteFile(first, []byte(bad), 0o644)
+		_, err := LoadConfig(first)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,394 @@
+// Package relabel rewrites incoming metrics before they are stored, so that
+// agents which name the same things differently end up in the same series.
+// Rules are read from a JSON file and can be reloaded while the server runs.
+package relabel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+// Rule actions.
+const (
+	// ActionRename replaces a matching name with Replacement, in which $1,
+	// ${name} etc. refer to the groups of Match.
+	ActionRename = "rename"
+	// ActionAddPrefix prepends Prefix to matching names that lack it.
+	ActionAddPrefix = "add_prefix"
+	// ActionStripPrefix removes Prefix from matching names.
+	ActionStripPrefix = "strip_prefix"
+	// ActionDrop discards matching metrics.
+	ActionDrop = "drop"
+	// ActionCoerce changes the type of matching metrics to To. Gauge values
+	// become counter deltas rounded to the nearest integer.
+	ActionCoerce = "coerce"
+	// ActionSetLabel sets Label to Value, which may refer to the groups of
+	// Match; an empty Value removes the label.
+	ActionSetLabel = "set_label"
+	// ActionReplaceLabel writes Replacement to Target (Label by default)
+	// when the value of Label matches Regex; an empty result removes
+	// Target.
+	ActionReplaceLabel = "replace_label"
+)
+
+// Rule is one rewrite step as written in the configuration file. Match and
+// Regex are anchored at both ends.
+type Rule struct {
+	Action string `json:"action"`
+	// Match selects metrics by name (the ID without labels); empty
+	// matches every name.
+	Match string `json:"match,omitempty"`
+	// Type restricts the rule to gauges or counters.
+	Type        string `json:"type,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	Prefix      string `json:"prefix,omitempty"`
+	To          string `json:"to,omitempty"`
+	Label       string `json:"label,omitempty"`
+	Value       string `json:"value,omitempty"`
+	Regex       string `json:"regex,omitempty"`
+	Target      string `json:"target,omitempty"`
+}
+
+// Config is the layout of the configuration file.
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+type rule struct {
+	Rule
+	match *regexp.Regexp
+	regex *regexp.Regexp
+}
+
+// Rules is a compiled, immutable rule list.
+type Rules struct {
+	rules []rule
+}
+
+// Parse compiles a configuration file's contents.
+func Parse(data []byte) (*Rules, error) {
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid relabel config: %w", err)
+	}
+	return Compile(cfg.Rules)
+}
+
+// Compile checks and compiles rules.
+func Compile(rules []Rule) (*Rules, error) {
+	compiled := make([]rule, 0, len(rules))
+	for i, r := range rules {
+		c, err := compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i, r.Action, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return &Rules{rules: compiled}, nil
+}
+
+func compile(r Rule) (rule, error) {
+	c := rule{Rule: r}
+	if r.Type != "" && r.Type != "gauge" && r.Type != "counter" {
+		return c, fmt.Errorf("type must be gauge or counter")
+	}
+
+	var err error
+	if r.Match != "" {
+		if c.match, err = regexp.Compile("^(?:" + r.Match + ")$"); err != nil {
+			return c, fmt.Errorf("invalid match: %w", err)
+		}
+	}
+
+	switch r.Action {
+	case ActionRename:
+		if r.Match == "" || r.Replacement == "" {
+			return c, fmt.Errorf("match and replacement are required")
+		}
+	case ActionAddPrefix, ActionStripPrefix:
+		if r.Prefix == "" {
+			return c, fmt.Errorf("prefix is required")
+		}
+	case ActionDrop:
+		if r.Match == "" && r.Type == "" {
+			return c, fmt.Errorf("match or type is required")
+		}
+	case ActionCoerce:
+		if r.To != "gauge" && r.To != "counter" {
+			return c, fmt.Errorf("to must be gauge or counter")
+		}
+	case ActionSetLabel:
+		if r.Label == "" {
+			return c, fmt.Errorf("label is required")
+		}
+	case ActionReplaceLabel:
+		if r.Label == "" {
+			return c, fmt.Errorf("label is required")
+		}
+		if c.Target == "" {
+			c.Target = r.Label
+		}
+		if c.Replacement == "" {
+			c.Replacement = "$1"
+		}
+		regex := r.Regex
+		if regex == "" {
+			regex = "(.*)"
+		}
+		if c.regex, err = regexp.Compile("^(?:" + regex + ")$"); err != nil {
+			return c, fmt.Errorf("invalid regex: %w", err)
+		}
+	default:
+		return c, fmt.Errorf("unknown action")
+	}
+	return c, nil
+}
+
+// List returns the rules as configured.
+func (rs *Rules) List() []Rule {
+	list := make([]Rule, 0, len(rs.rules))
+	for _, r := range rs.rules {
+		list = append(list, r.Rule)
+	}
+	return list
+}
+
+// Step is a rule that changed a metric, with the metric as it left the rule.
+type Step struct {
+	Rule   int    `json:"rule"`
+	Action string `json:"action"`
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+}
+
+// Trace records how a metric went through the rules.
+type Trace struct {
+	Input models.Metrics `json:"input"`
+	// Output is nil when the metric was dropped.
+	Output *models.Metrics `json:"output"`
+	Steps  []Step          `json:"steps"`
+}
+
+// Apply rewrites m and reports whether it is kept.
+func (rs *Rules) Apply(m models.Metrics) (models.Metrics, bool) {
+	return rs.apply(m, nil)
+}
+
+// Explain is Apply that also records the rules that changed m.
+func (rs *Rules) Explain(m models.Metrics) Trace {
+	trace := Trace{Input: m, Steps: []Step{}}
+	if out, ok := rs.apply(m, &trace.Steps); ok {
+		trace.Output = &out
+	}
+	return trace
+}
+
+func (rs *Rules) apply(m models.Metrics, steps *[]Step) (models.Metrics, bool) {
+	if rs == nil || len(rs.rules) == 0 {
+		return m, true
+	}
+
+	name, labels, err := models.ParseSeriesID(m.ID)
+	if err != nil {
+		// Leave malformed IDs to validation.
+		return m, true
+	}
+
+	for i, r := range rs.rules {
+		if r.Type != "" && r.Type != m.MType {
+			continue
+		}
+		var groups []int
+		if r.match != nil {
+			if groups = r.match.FindStringSubmatchIndex(name); groups == nil {
+				continue
+			}
+		}
+
+		before, beforeType := models.SeriesID(name, labels), m.MType
+		switch r.Action {
+		case ActionRename:
+			name = string(r.match.ExpandString(nil, r.Replacement, name, groups))
+		case ActionAddPrefix:
+			if !strings.HasPrefix(name, r.Prefix) {
+				name = r.Prefix + name
+			}
+		case ActionStripPrefix:
+			name = strings.TrimPrefix(name, r.Prefix)
+		case ActionDrop:
+			if steps != nil {
+				*steps = append(*steps, Step{Rule: i, Action: r.Action, ID: before, Type: m.MType})
+			}
+			return models.Metrics{}, false
+		case ActionCoerce:
+			m = coerce(m, r.To)
+		case ActionSetLabel:
+			value := r.Value
+			if r.match != nil {
+				value = string(r.match.ExpandString(nil, r.Value, name, groups))
+			}
+			labels = setLabel(labels, r.Label, value)
+		case ActionReplaceLabel:
+			source, ok := labels[r.Label]
+			if !ok {
+				continue
+			}
+			match := r.regex.FindStringSubmatchIndex(source)
+			if match == nil {
+				continue
+			}
+			labels = setLabel(labels, r.Target, string(r.regex.ExpandString(nil, r.Replacement, source, match)))
+		}
+
+		m.ID = models.SeriesID(name, labels)
+		if steps != nil && (m.ID != before || m.MType != beforeType) {
+			*steps = append(*steps, Step{Rule: i, Action: r.Action, ID: m.ID, Type: m.MType})
+		}
+	}
+	return m, true
+}
+
+func coerce(m models.Metrics, to string) models.Metrics {
+	if m.MType == to {
+		return m
+	}
+	switch to {
+	case "counter":
+		if m.Value != nil {
+			delta := int64(math.Round(*m.Value))
+			m.Delta = &delta
+		}
+		m.Value = nil
+	case "gauge":
+		if m.Delta != nil {
+			value := float64(*m.Delta)
+			m.Value = &value
+		}
+		m.Delta = nil
+	}
+	m.MType = to
+	return m
+}
+
+// setLabel returns labels with name set to value, or removed when value is
+// empty, without modifying the original map.
+func setLabel(labels map[string]string, name, value string) map[string]string {
+	updated := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		updated[k] = v
+	}
+	if value == "" {
+		delete(updated, name)
+	} else {
+		updated[name] = value
+	}
+	return updated
+}
+
+// Engine holds the rules loaded from a file and swaps them atomically on
+// reload, so ingestion never sees a half-loaded rule list. A nil *Engine
+// keeps every metric unchanged.
+type Engine struct {
+	path  string
+	rules atomic.Pointer[Rules]
+
+	mu       sync.Mutex
+	modTime  time.Time
+	loadedAt time.Time
+}
+
+// Load reads the rules in path.
+func Load(path string) (*Engine, error) {
+	e := &Engine{path: path}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload reads the file again. On error the current rules stay in effect.
+func (e *Engine) Reload() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.reload()
+}
+
+// ReloadIfChanged reloads the file when its modification time changed and
+// reports whether it did.
+func (e *Engine) ReloadIfChanged() (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(e.modTime) {
+		return false, nil
+	}
+	return true, e.reload()
+}
+
+// reload must be called with mu held.
+func (e *Engine) reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	// Remember the attempt even if it fails, so a broken file is reported
+	// once rather than on every poll.
+	e.modTime = info.ModTime()
+	rules, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	e.rules.Store(rules)
+	e.loadedAt = time.Now()
+	return nil
+}
+
+// Rules returns the rules in effect.
+func (e *Engine) Rules() *Rules {
+	if e == nil {
+		return nil
+	}
+	return e.rules.Load()
+}
+
+// Apply rewrites m with the rules in effect and reports whether it is kept.
+func (e *Engine) Apply(m models.Metrics) (models.Metrics, bool) {
+	return e.Rules().Apply(m)
+}
+
+// Status describes the loaded rules.
+type Status struct {
+	Path     string     `json:"path,omitempty"`
+	LoadedAt *time.Time `json:"loaded_at,omitempty"`
+	Rules    []Rule     `json:"rules"`
+}
+
+func (e *Engine) Status() Status {
+	if e == nil {
+		return Status{Rules: []Rule{}}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	loadedAt := e.loadedAt
+	return Status{Path: e.path, LoadedAt: &loadedAt, Rules: e.rules.Load().List()}
+}
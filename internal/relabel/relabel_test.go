@@ -0,0 +1,146 @@
+package relabel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func gauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+func mustCompile(t *testing.T, rules ...Rule) *Rules {
+	rs, err := Compile(rules)
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+	return rs
+}
+
+func TestNameRules(t *testing.T) {
+	rs := mustCompile(t,
+		Rule{Action: ActionStripPrefix, Prefix: "legacy_"},
+		Rule{Action: ActionRename, Match: `jvm\.(\w+)\.(\w+)`, Replacement: "jvm_${1}_$2"},
+		Rule{Action: ActionAddPrefix, Match: "jvm_.*", Prefix: "app_"},
+		Rule{Action: ActionDrop, Match: "debug_.*"},
+	)
+
+	m, ok := rs.Apply(gauge(`legacy_jvm.heap.used{host="a"}`, 1))
+	assert.True(t, ok)
+	assert.Equal(t, `app_jvm_heap_used{host="a"}`, m.ID)
+
+	m, ok = rs.Apply(gauge("app_jvm_threads", 1))
+	assert.True(t, ok)
+	assert.Equal(t, "app_jvm_threads", m.ID, "existing prefixes are not doubled")
+
+	_, ok = rs.Apply(gauge("debug_allocs", 1))
+	assert.False(t, ok)
+}
+
+func TestCoerce(t *testing.T) {
+	rs := mustCompile(t,
+		Rule{Action: ActionCoerce, Match: ".*_total", Type: "gauge", To: "counter"},
+		Rule{Action: ActionCoerce, Match: "queue_depth", To: "gauge"},
+	)
+
+	m, _ := rs.Apply(gauge("requests_total", 41.6))
+	assert.Equal(t, "counter", m.MType)
+	assert.Nil(t, m.Value)
+	assert.Equal(t, int64(42), *m.Delta)
+
+	delta := int64(7)
+	m, _ = rs.Apply(models.Metrics{ID: "queue_depth", MType: "counter", Delta: &delta})
+	assert.Equal(t, "gauge", m.MType)
+	assert.Nil(t, m.Delta)
+	assert.Equal(t, 7.0, *m.Value)
+}
+
+func TestLabelRules(t *testing.T) {
+	rs := mustCompile(t,
+		Rule{Action: ActionSetLabel, Label: "env", Value: "prod"},
+		Rule{Action: ActionSetLabel, Match: `(\w+)_requests`, Label: "service", Value: "$1"},
+		Rule{Action: ActionReplaceLabel, Label: "host", Regex: `(.+)\.example\.com`},
+		Rule{Action: ActionReplaceLabel, Label: "pod", Regex: `(.+)-[a-z0-9]{5}`, Target: "deployment"},
+		Rule{Action: ActionSetLabel, Label: "pod"},
+	)
+
+	m, _ := rs.Apply(gauge(`api_requests{host="web1.example.com",pod="api-7f3a2"}`, 1))
+	assert.Equal(t, `api_requests{deployment="api",env="prod",host="web1",service="api"}`, m.ID)
+}
+
+func TestExplain(t *testing.T) {
+	rs := mustCompile(t,
+		Rule{Action: ActionRename, Match: "Alloc", Replacement: "go_alloc_bytes"},
+		Rule{Action: ActionSetLabel, Match: "unrelated", Label: "x", Value: "y"},
+		Rule{Action: ActionDrop, Match: "RandomValue"},
+	)
+
+	trace := rs.Explain(gauge("Alloc", 1))
+	assert.Equal(t, "go_alloc_bytes", trace.Output.ID)
+	assert.Equal(t, []Step{{Rule: 0, Action: ActionRename, ID: "go_alloc_bytes", Type: "gauge"}}, trace.Steps)
+
+	trace = rs.Explain(gauge("RandomValue", 1))
+	assert.Nil(t, trace.Output)
+	assert.Equal(t, ActionDrop, trace.Steps[0].Action)
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, r := range []Rule{
+		{Action: "explode"},
+		{Action: ActionRename, Match: "a"},
+		{Action: ActionAddPrefix},
+		{Action: ActionDrop},
+		{Action: ActionCoerce, To: "histogram"},
+		{Action: ActionSetLabel, Value: "x"},
+		{Action: ActionReplaceLabel, Label: "a", Regex: "("},
+		{Action: ActionDrop, Match: "a", Type: "summary"},
+	} {
+		_, err := Compile([]Rule{r})
+		assert.Error(t, err, "%+v", r)
+	}
+
+	_, err := Parse([]byte(`{"rules":[{"action":"drop","mach":"x"}]}`))
+	assert.Error(t, err)
+}
+
+func TestEngineReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relabel.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"rules":[{"action":"drop","match":"tmp_.*"}]}`), 0o644))
+
+	e, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %v", err)
+	}
+	_, ok := e.Apply(gauge("tmp_a", 1))
+	assert.False(t, ok)
+
+	reloaded, err := e.ReloadIfChanged()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	later := time.Now().Add(time.Second)
+	assert.NoError(t, os.WriteFile(path, []byte(`{"rules":[{"action":"add_prefix","prefix":"x_"}]}`), 0o644))
+	assert.NoError(t, os.Chtimes(path, later, later))
+	reloaded, err = e.ReloadIfChanged()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	m, ok := e.Apply(gauge("tmp_a", 1))
+	assert.True(t, ok)
+	assert.Equal(t, "x_tmp_a", m.ID)
+
+	// A broken file keeps the previous rules.
+	assert.NoError(t, os.WriteFile(path, []byte(`{"rules":[{"action":"rename"}]}`), 0o644))
+	assert.Error(t, e.Reload())
+	m, _ = e.Apply(gauge("tmp_a", 1))
+	assert.Equal(t, "x_tmp_a", m.ID)
+
+	var none *Engine
+	m, ok = none.Apply(gauge("tmp_a", 1))
+	assert.True(t, ok)
+	assert.Equal(t, "tmp_a", m.ID)
+}
@@ -0,0 +1,237 @@
+// Package remotewrite decodes Prometheus remote_write 1.0 requests. The
+// protobuf messages are read with protowire directly so the service does not
+// have to depend on the Prometheus module for three small message types.
+package remotewrite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/hairutdin/metrics-service/models"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MaxDecodedSize bounds the uncompressed size of a single request.
+const MaxDecodedSize = 32 << 20
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Value     float64
+	Timestamp int64 // milliseconds since epoch
+}
+
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+	// Histograms counts native histogram samples, which are not supported.
+	Histograms int
+}
+
+var ErrTooLarge = errors.New("decoded request exceeds size limit")
+
+// Decode unpacks a snappy-compressed WriteRequest.
+func Decode(compressed []byte) ([]TimeSeries, error) {
+	size, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy data: %w", err)
+	}
+	if size > MaxDecodedSize {
+		return nil, ErrTooLarge
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy data: %w", err)
+	}
+	return Unmarshal(data)
+}
+
+// Unmarshal parses an uncompressed WriteRequest.
+func Unmarshal(data []byte) ([]TimeSeries, error) {
+	var series []TimeSeries
+	err := walk(data, func(num protowire.Number, typ protowire.Type, field []byte) error {
+		if num != 1 {
+			return nil
+		}
+		if typ != protowire.BytesType {
+			return fmt.Errorf("timeseries: unexpected wire type %d", typ)
+		}
+		ts, err := unmarshalTimeSeries(field)
+		if err != nil {
+			return err
+		}
+		series = append(series, ts)
+		return nil
+	})
+	return series, err
+}
+
+func unmarshalTimeSeries(data []byte) (TimeSeries, error) {
+	var ts TimeSeries
+	err := walk(data, func(num protowire.Number, typ protowire.Type, field []byte) error {
+		switch num {
+		case 1:
+			if typ != protowire.BytesType {
+				return fmt.Errorf("label: unexpected wire type %d", typ)
+			}
+			l, err := unmarshalLabel(field)
+			if err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, l)
+		case 2:
+			if typ != protowire.BytesType {
+				return fmt.Errorf("sample: unexpected wire type %d", typ)
+			}
+			s, err := unmarshalSample(field)
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		case 4:
+			ts.Histograms++
+		}
+		return nil
+	})
+	return ts, err
+}
+
+func unmarshalLabel(data []byte) (Label, error) {
+	var l Label
+	err := walk(data, func(num protowire.Number, typ protowire.Type, field []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			l.Name = string(field)
+		case 2:
+			l.Value = string(field)
+		}
+		return nil
+	})
+	return l, err
+}
+
+func unmarshalSample(data []byte) (Sample, error) {
+	var s Sample
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return s, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			if n < 0 {
+				return s, protowire.ParseError(n)
+			}
+			s.Value = math.Float64frombits(v)
+			data = data[n:]
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return s, protowire.ParseError(n)
+			}
+			s.Timestamp = int64(v)
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return s, protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return s, nil
+}
+
+// walk calls fn for every field of a message. Length-delimited fields are
+// passed with their payload, all other fields with a nil slice.
+func walk(data []byte, fn func(num protowire.Number, typ protowire.Type, field []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var field []byte
+		if typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			field = v
+			data = data[n:]
+		} else {
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+
+		if err := fn(num, typ, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ToMetrics converts decoded series to gauges named after __name__ with the
+// remaining labels folded into the ID. remote_write carries no metric types,
+// so every series is stored as a gauge holding its latest sample and that
+// sample's timestamp; counters therefore keep Prometheus' cumulative value.
+// NaN samples (including staleness markers) are ignored; series left without
+// a name or a sample are skipped and counted in the second return value.
+func ToMetrics(series []TimeSeries) ([]models.Metrics, int) {
+	metrics := make([]models.Metrics, 0, len(series))
+	skipped := 0
+
+	for _, ts := range series {
+		var name string
+		labels := make(map[string]string, len(ts.Labels))
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				name = l.Value
+				continue
+			}
+			labels[l.Name] = l.Value
+		}
+
+		latest := -1
+		for i, s := range ts.Samples {
+			if math.IsNaN(s.Value) {
+				continue
+			}
+			if latest < 0 || s.Timestamp >= ts.Samples[latest].Timestamp {
+				latest = i
+			}
+		}
+
+		if name == "" || latest < 0 {
+			skipped++
+			continue
+		}
+
+		value, timestamp := ts.Samples[latest].Value, ts.Samples[latest].Timestamp
+		metrics = append(metrics, models.Metrics{
+			ID:        models.SeriesID(name, labels),
+			MType:     "gauge",
+			Value:     &value,
+			Timestamp: &timestamp,
+		})
+	}
+
+	return metrics, skipped
+}
@@ -0,0 +1,68 @@
+package remotewrite
+
+import (
+	"math"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func encodeSeries(labels []Label, samples []Sample) []byte {
+	var ts []byte
+	for _, l := range labels {
+		var lb []byte
+		lb = appendMessage(lb, 1, []byte(l.Name))
+		lb = appendMessage(lb, 2, []byte(l.Value))
+		ts = appendMessage(ts, 1, lb)
+	}
+	for _, s := range samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.Timestamp))
+		ts = appendMessage(ts, 2, sb)
+	}
+	return ts
+}
+
+func TestDecodeAndConvert(t *testing.T) {
+	var req []byte
+	req = appendMessage(req, 1, encodeSeries(
+		[]Label{{"__name__", "up"}, {"job", "node"}},
+		[]Sample{{Value: 0, Timestamp: 1000}, {Value: 1, Timestamp: 2000}},
+	))
+	req = appendMessage(req, 1, encodeSeries(
+		[]Label{{"job", "nameless"}},
+		[]Sample{{Value: 5, Timestamp: 1000}},
+	))
+
+	series, err := Decode(snappy.Encode(nil, req))
+	assert.NoError(t, err)
+	assert.Len(t, series, 2)
+	assert.Equal(t, Label{"__name__", "up"}, series[0].Labels[0])
+	assert.Equal(t, int64(2000), series[0].Samples[1].Timestamp)
+
+	metrics, skipped := ToMetrics(series)
+	assert.Equal(t, 1, skipped)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, `up{job="node"}`, metrics[0].ID)
+	assert.Equal(t, "gauge", metrics[0].MType)
+	assert.Equal(t, 1.0, *metrics[0].Value)
+	assert.Equal(t, int64(2000), *metrics[0].Timestamp)
+}
+
+func TestDecodeRejectsInvalidData(t *testing.T) {
+	_, err := Decode([]byte("not snappy"))
+	assert.Error(t, err)
+
+	_, err = Decode(snappy.Encode(nil, []byte{0x0a, 0xff}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,172 @@
+// Package stream fans out metric changes to live subscribers such as the
+// server-sent events endpoint.
+package stream
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+const (
+	KindUpdate = "update"
+	KindDelete = "delete"
+)
+
+// Event describes one change. For updates Metric holds the value after the
+// change, i.e. the running total for counters.
+type Event struct {
+	Kind   string
+	Metric models.Metrics
+}
+
+// Filter restricts a subscription to metrics with the given ID prefix and
+// type; empty fields match everything.
+type Filter struct {
+	Prefix string
+	Type   string
+}
+
+func (f Filter) matches(m models.Metrics) bool {
+	return strings.HasPrefix(m.ID, f.Prefix) && (f.Type == "" || f.Type == m.MType)
+}
+
+type Subscription struct {
+	events  chan Event
+	filter  Filter
+	dropped bool
+}
+
+// Events is closed when the subscription ends, either through Unsubscribe
+// or because the subscriber fell too far behind.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Hub delivers events to subscribers through bounded buffers. Publish never
+// blocks: a subscriber whose buffer is full is disconnected instead of
+// slowing down ingestion.
+type Hub struct {
+	mu         sync.Mutex
+	subs       map[*Subscription]struct{}
+	bufferSize int
+
+	// recent holds the last values of each series when KeepRecent is on.
+	recent     map[string][]float64
+	recentSize int
+}
+
+func NewHub(bufferSize int) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+	return &Hub{
+		subs:       make(map[*Subscription]struct{}),
+		bufferSize: bufferSize,
+	}
+}
+
+func (h *Hub) Subscribe(f Filter) *Subscription {
+	s := &Subscription{events: make(chan Event, h.bufferSize), filter: f}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[s] = struct{}{}
+	return s
+}
+
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.events)
+	}
+}
+
+// Dropped reports whether the hub disconnected the subscription because its
+// buffer overflowed. It is only meaningful once Events has been closed.
+func (h *Hub) Dropped(s *Subscription) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return s.dropped
+}
+
+// KeepRecent makes the hub remember the last n values published for each
+// series, e.g. for sparklines. n <= 0 turns it off.
+func (h *Hub) KeepRecent(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n <= 0 {
+		h.recent, h.recentSize = nil, 0
+		return
+	}
+	h.recent = make(map[string][]float64)
+	h.recentSize = n
+}
+
+// Recent returns the remembered values of a series, oldest first.
+func (h *Hub) Recent(metricType, id string) []float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	values := h.recent[metricType+"/"+id]
+	if len(values) == 0 {
+		return nil
+	}
+	return append([]float64(nil), values...)
+}
+
+// Active reports whether anyone is subscribed or recent values are kept, so
+// publishers can skip work needed only to build events.
+func (h *Hub) Active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0 || h.recent != nil
+}
+
+func (h *Hub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.recent != nil {
+		h.record(e)
+	}
+
+	for s := range h.subs {
+		if !s.filter.matches(e.Metric) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			s.dropped = true
+			delete(h.subs, s)
+			close(s.events)
+		}
+	}
+}
+
+func (h *Hub) record(e Event) {
+	key := e.Metric.MType + "/" + e.Metric.ID
+	if e.Kind == KindDelete {
+		delete(h.recent, key)
+		return
+	}
+
+	var v float64
+	switch {
+	case e.Metric.Value != nil:
+		v = *e.Metric.Value
+	case e.Metric.Delta != nil:
+		v = float64(*e.Metric.Delta)
+	default:
+		return
+	}
+
+	values := append(h.recent[key], v)
+	if len(values) > h.recentSize {
+		values = values[len(values)-h.recentSize:]
+	}
+	h.recent[key] = values
+}
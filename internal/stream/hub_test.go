@@ -0,0 +1,80 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func gaugeEvent(id string, v float64) Event {
+	return Event{Kind: KindUpdate, Metric: models.Metrics{ID: id, MType: "gauge", Value: &v}}
+}
+
+func TestHubFiltersEvents(t *testing.T) {
+	hub := NewHub(4)
+	sub := hub.Subscribe(Filter{Prefix: "Heap", Type: "gauge"})
+
+	hub.Publish(gaugeEvent("Alloc", 1))
+	hub.Publish(gaugeEvent("HeapAlloc", 2))
+
+	event := <-sub.Events()
+	assert.Equal(t, "HeapAlloc", event.Metric.ID)
+	assert.Len(t, sub.Events(), 0)
+}
+
+func TestHubDisconnectsSlowSubscriber(t *testing.T) {
+	hub := NewHub(2)
+	slow := hub.Subscribe(Filter{})
+
+	for i := 0; i < 3; i++ {
+		hub.Publish(gaugeEvent("Alloc", float64(i)))
+	}
+
+	received := 0
+	for range slow.Events() {
+		received++
+	}
+	assert.Equal(t, 2, received)
+	assert.True(t, hub.Dropped(slow))
+	assert.False(t, hub.Active())
+
+	// Unsubscribing after the hub dropped the subscription is harmless.
+	hub.Unsubscribe(slow)
+}
+
+func TestHubKeepsRecentValues(t *testing.T) {
+	hub := NewHub(1)
+	hub.KeepRecent(3)
+	assert.True(t, hub.Active())
+
+	for i := 1; i <= 4; i++ {
+		hub.Publish(gaugeEvent("Alloc", float64(i)))
+	}
+	assert.Equal(t, []float64{2, 3, 4}, hub.Recent("gauge", "Alloc"))
+	assert.Nil(t, hub.Recent("counter", "Alloc"))
+
+	hub.Publish(Event{Kind: KindDelete, Metric: models.Metrics{ID: "Alloc", MType: "gauge"}})
+	assert.Nil(t, hub.Recent("gauge", "Alloc"))
+}
+
+func TestObservedStoragePublishesCounterTotals(t *testing.T) {
+	hub := NewHub(8)
+	sub := hub.Subscribe(Filter{Type: "counter"})
+	s := WrapStorage(storage.NewMemStorage(), hub)
+
+	s.UpdateCounter("PollCount", 2)
+	delta := int64(3)
+	err := s.UpdateMetricsBatch([]models.Metrics{{ID: "PollCount", MType: "counter", Delta: &delta}})
+	assert.NoError(t, err)
+
+	first := <-sub.Events()
+	second := <-sub.Events()
+	assert.Equal(t, int64(2), *first.Metric.Delta)
+	assert.Equal(t, int64(5), *second.Metric.Delta)
+
+	assert.NoError(t, s.DeleteMetric("counter", "PollCount"))
+	deleted := <-sub.Events()
+	assert.Equal(t, KindDelete, deleted.Kind)
+}
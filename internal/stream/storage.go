@@ -0,0 +1,167 @@
+package stream
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/hairutdin/metrics-service/storage"
+)
+
+// ObservedStorage publishes every change applied through it to a Hub. Reads
+// are passed straight to the wrapped storage.
+type ObservedStorage struct {
+	storage.MetricsStorage
+	hub *Hub
+}
+
+var _ storage.MetricsStorage = (*ObservedStorage)(nil)
+
+func WrapStorage(s storage.MetricsStorage, hub *Hub) *ObservedStorage {
+	return &ObservedStorage{MetricsStorage: s, hub: hub}
+}
+
+func (s *ObservedStorage) UpdateGauge(name string, value float64) {
+	s.MetricsStorage.UpdateGauge(name, value)
+	if s.hub.Active() {
+		s.hub.Publish(Event{Kind: KindUpdate, Metric: models.Metrics{ID: name, MType: "gauge", Value: &value}})
+	}
+}
+
+func (s *ObservedStorage) UpdateCounter(name string, value int64) {
+	s.MetricsStorage.UpdateCounter(name, value)
+	if s.hub.Active() {
+		s.publishCounter(name)
+	}
+}
+
+func (s *ObservedStorage) UpdateMetricsBatch(metrics []models.Metrics) error {
+	if err := s.MetricsStorage.UpdateMetricsBatch(metrics); err != nil {
+		return err
+	}
+	s.publishBatch(metrics)
+	return nil
+}
+
+func (s *ObservedStorage) UpdateMetricsBatchOnce(key string, metrics []models.Metrics, ttl time.Duration) (bool, error) {
+	applied, err := s.MetricsStorage.UpdateMetricsBatchOnce(key, metrics, ttl)
+	if err != nil || !applied {
+		return applied, err
+	}
+	s.publishBatch(metrics)
+	return true, nil
+}
+
+// publishBatch reads back the stored values of the metrics in a batch, so
+// that gauges dropped as out of order and counter increments are reported
+// as the current state rather than as sent.
+func (s *ObservedStorage) publishBatch(metrics []models.Metrics) {
+	if !s.hub.Active() {
+		return
+	}
+
+	type key struct{ id, mtype string }
+	seen := make(map[key]bool, len(metrics))
+	keys := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		if (m.MType == "gauge" && m.Value == nil) || (m.MType == "counter" && m.Delta == nil) {
+			continue
+		}
+		if k := (key{m.ID, m.MType}); !seen[k] {
+			seen[k] = true
+			keys = append(keys, models.Metrics{ID: m.ID, MType: m.MType})
+		}
+	}
+
+	current, err := s.MetricsStorage.GetMetrics(keys)
+	if err != nil {
+		return
+	}
+	for _, m := range current {
+		s.hub.Publish(Event{Kind: KindUpdate, Metric: m})
+	}
+}
+
+func (s *ObservedStorage) DeleteMetric(metricType string, name string) error {
+	if err := s.MetricsStorage.DeleteMetric(metricType, name); err != nil {
+		return err
+	}
+	s.hub.Publish(Event{Kind: KindDelete, Metric: models.Metrics{ID: name, MType: metricType}})
+	return nil
+}
+
+func (s *ObservedStorage) DeleteMatching(metricType string, pattern string) ([]models.Metrics, error) {
+	deleted, err := s.MetricsStorage.DeleteMatching(metricType, pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range deleted {
+		s.hub.Publish(Event{Kind: KindDelete, Metric: m})
+	}
+	return deleted, nil
+}
+
+func (s *ObservedStorage) DeleteStaleGauges(before time.Time) ([]models.Metrics, error) {
+	deleted, err := s.MetricsStorage.DeleteStaleGauges(before)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range deleted {
+		s.hub.Publish(Event{Kind: KindDelete, Metric: m})
+	}
+	return deleted, nil
+}
+
+func (s *ObservedStorage) ResetCounter(name string) error {
+	if err := s.MetricsStorage.ResetCounter(name); err != nil {
+		return err
+	}
+	var zero int64
+	s.hub.Publish(Event{Kind: KindUpdate, Metric: models.Metrics{ID: name, MType: "counter", Delta: &zero}})
+	return nil
+}
+
+func (s *ObservedStorage) RenameMetric(metricType string, oldName string, newName string) error {
+	if err := s.MetricsStorage.RenameMetric(metricType, oldName, newName); err != nil {
+		return err
+	}
+	s.hub.Publish(Event{Kind: KindDelete, Metric: models.Metrics{ID: oldName, MType: metricType}})
+	if !s.hub.Active() {
+		return nil
+	}
+
+	value, err := s.MetricsStorage.GetMetric(metricType, newName)
+	if err != nil {
+		return nil
+	}
+	m := models.Metrics{ID: newName, MType: metricType}
+	if metricType == "counter" {
+		total, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil
+		}
+		m.Delta = &total
+	} else {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil
+		}
+		m.Value = &v
+	}
+	s.hub.Publish(Event{Kind: KindUpdate, Metric: m})
+	return nil
+}
+
+// publishCounter reads back the counter total, since updates only carry the
+// increment.
+func (s *ObservedStorage) publishCounter(name string) {
+	value, err := s.MetricsStorage.GetMetric("counter", name)
+	if err != nil {
+		return
+	}
+	total, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return
+	}
+	s.hub.Publish(Event{Kind: KindUpdate, Metric: models.Metrics{ID: name, MType: "counter", Delta: &total}})
+}
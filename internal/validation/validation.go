@@ -0,0 +1,125 @@
+// Package validation checks incoming metrics before they reach storage.
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+const DefaultMaxNameLength = 255
+
+// DefaultMaxFutureSkew bounds how far ahead of the server clock a timestamp
+// may be. Gauges only accept samples at least as new as the stored one, so
+// an unbounded skew would let a single far-future sample freeze a gauge.
+const DefaultMaxFutureSkew = 5 * time.Minute
+
+var (
+	ErrMissingID    = errors.New("metric id is required")
+	ErrInvalidType  = errors.New("metric type must be gauge or counter")
+	ErrMissingValue = errors.New("metric value is required")
+	ErrNonFinite    = errors.New("NaN and infinite values are not allowed")
+	ErrNameTooLong  = errors.New("metric id is too long")
+	ErrTooOld       = errors.New("metric timestamp is too old")
+	ErrInFuture     = errors.New("metric timestamp is too far in the future")
+)
+
+// Policy describes which metrics are accepted.
+type Policy struct {
+	// MaxNameLength limits the ID length in characters; 0 means no limit.
+	MaxNameLength int
+	// AllowNonFinite lets gauges carry NaN and ±Inf.
+	AllowNonFinite bool
+	// Strict rejects a whole batch when any item in it is invalid instead
+	// of applying the valid ones.
+	Strict bool
+	// MaxAge and MaxFuture bound client timestamps relative to the server
+	// clock; 0 means no limit. Metrics without a timestamp always pass.
+	MaxAge    time.Duration
+	MaxFuture time.Duration
+	// Now returns the server clock, time.Now when nil.
+	Now func() time.Time
+}
+
+func DefaultPolicy() Policy {
+	return Policy{MaxNameLength: DefaultMaxNameLength, MaxFuture: DefaultMaxFutureSkew}
+}
+
+// Rejection reports why the item at Index of a batch was not applied. Line
+// is set for line-oriented input such as NDJSON.
+type Rejection struct {
+	Index  int    `json:"index"`
+	Line   int    `json:"line,omitempty"`
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// Check returns nil if m may be stored, or an error wrapping one of the Err
+// values above.
+func (p Policy) Check(m models.Metrics) error {
+	if m.ID == "" {
+		return ErrMissingID
+	}
+	if p.MaxNameLength > 0 && utf8.RuneCountInString(m.ID) > p.MaxNameLength {
+		return fmt.Errorf("%w: %d characters, limit is %d", ErrNameTooLong, utf8.RuneCountInString(m.ID), p.MaxNameLength)
+	}
+
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return fmt.Errorf("%w: gauge needs \"value\"", ErrMissingValue)
+		}
+		if !p.AllowNonFinite && (math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0)) {
+			return ErrNonFinite
+		}
+	case "counter":
+		if m.Delta == nil {
+			return fmt.Errorf("%w: counter needs \"delta\"", ErrMissingValue)
+		}
+	default:
+		return ErrInvalidType
+	}
+	return p.checkTimestamp(m)
+}
+
+func (p Policy) checkTimestamp(m models.Metrics) error {
+	if m.Timestamp == nil || (p.MaxAge <= 0 && p.MaxFuture <= 0) {
+		return nil
+	}
+	now := time.Now
+	if p.Now != nil {
+		now = p.Now
+	}
+	offset := time.UnixMilli(*m.Timestamp).Sub(now())
+	if p.MaxAge > 0 && -offset > p.MaxAge {
+		return fmt.Errorf("%w: %s old, limit is %s", ErrTooOld, (-offset).Truncate(time.Millisecond), p.MaxAge)
+	}
+	if p.MaxFuture > 0 && offset > p.MaxFuture {
+		return fmt.Errorf("%w: %s ahead, limit is %s", ErrInFuture, offset.Truncate(time.Millisecond), p.MaxFuture)
+	}
+	return nil
+}
+
+// Split separates a batch into the metrics that pass Check and rejections
+// for the rest. Under a strict policy nothing is accepted once any item is
+// rejected.
+func (p Policy) Split(metrics []models.Metrics) ([]models.Metrics, []Rejection) {
+	accepted := make([]models.Metrics, 0, len(metrics))
+	var rejected []Rejection
+	for i, m := range metrics {
+		if err := p.Check(m); err != nil {
+			rejected = append(rejected, Rejection{Index: i, ID: m.ID, Type: m.MType, Reason: err.Error()})
+			continue
+		}
+		accepted = append(accepted, m)
+	}
+	if p.Strict && len(rejected) > 0 {
+		return nil, rejected
+	}
+	return accepted, rejected
+}
@@ -0,0 +1,65 @@
+package validation
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func gauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+func TestCheck(t *testing.T) {
+	p := DefaultPolicy()
+	delta := int64(1)
+
+	assert.NoError(t, p.Check(gauge("Alloc", 1)))
+	assert.NoError(t, p.Check(models.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}))
+	assert.ErrorIs(t, p.Check(gauge("", 1)), ErrMissingID)
+	assert.ErrorIs(t, p.Check(models.Metrics{ID: "Alloc", MType: "gauge"}), ErrMissingValue)
+	assert.ErrorIs(t, p.Check(models.Metrics{ID: "PollCount", MType: "counter"}), ErrMissingValue)
+	assert.ErrorIs(t, p.Check(models.Metrics{ID: "x", MType: "histogram"}), ErrInvalidType)
+	assert.ErrorIs(t, p.Check(gauge("Alloc", math.NaN())), ErrNonFinite)
+	assert.ErrorIs(t, p.Check(gauge(strings.Repeat("a", 256), 1)), ErrNameTooLong)
+
+	p.AllowNonFinite = true
+	assert.NoError(t, p.Check(gauge("Alloc", math.Inf(1))))
+}
+
+func TestSplit(t *testing.T) {
+	batch := []models.Metrics{gauge("Alloc", 1), {ID: "Sys", MType: "gauge"}, gauge("HeapAlloc", 2)}
+
+	accepted, rejected := DefaultPolicy().Split(batch)
+	assert.Len(t, accepted, 2)
+	assert.Equal(t, []Rejection{{Index: 1, ID: "Sys", Type: "gauge", Reason: `metric value is required: gauge needs "value"`}}, rejected)
+
+	strict := DefaultPolicy()
+	strict.Strict = true
+	accepted, rejected = strict.Split(batch)
+	assert.Empty(t, accepted)
+	assert.Len(t, rejected, 1)
+}
+
+func TestCheckTimestampWindow(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	p := Policy{MaxAge: time.Hour, MaxFuture: time.Minute, Now: func() time.Time { return now }}
+	at := func(d time.Duration) models.Metrics {
+		m := gauge("Alloc", 1)
+		ts := now.Add(d).UnixMilli()
+		m.Timestamp = &ts
+		return m
+	}
+
+	assert.NoError(t, p.Check(gauge("Alloc", 1)))
+	assert.NoError(t, p.Check(at(-30*time.Minute)))
+	assert.NoError(t, p.Check(at(30*time.Second)))
+	assert.ErrorIs(t, p.Check(at(-2*time.Hour)), ErrTooOld)
+	assert.ErrorIs(t, p.Check(at(2*time.Minute)), ErrInFuture)
+
+	assert.NoError(t, Policy{}.Check(at(-24*time.Hour)))
+}
@@ -0,0 +1,45 @@
+package models
+
+// Metadata describes a metric family. It is kept per metric name and type,
+// so every labelled series of a family shares it.
+type Metadata struct {
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+}
+
+// MetricMetadata is a registry entry: the metadata of one name and type.
+type MetricMetadata struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Metadata
+}
+
+// IsZero reports whether no field is set.
+func (m Metadata) IsZero() bool {
+	return m == Metadata{}
+}
+
+// Merge returns m with every non-empty field of update applied, which is how
+// metadata sent inline with metrics refines what is already registered.
+func (m Metadata) Merge(update Metadata) Metadata {
+	if update.Unit != "" {
+		m.Unit = update.Unit
+	}
+	if update.Description != "" {
+		m.Description = update.Description
+	}
+	if update.Owner != "" {
+		m.Owner = update.Owner
+	}
+	return m
+}
+
+// MetadataName returns the name a metric's metadata is registered under:
+// its ID without labels.
+func MetadataName(id string) string {
+	if name, _, err := ParseSeriesID(id); err == nil {
+		return name
+	}
+	return id
+}
@@ -1,8 +1,78 @@
 package models
 
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
 type Metrics struct {
 	ID    string   `json:"id"`
 	MType string   `json:"type"` // "gauge" or "counter"
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
+	// Timestamp is the sample time in Unix milliseconds. On updates it
+	// defaults to the time the server receives the metric; on reads it is
+	// the time of the last applied update.
+	Timestamp *int64 `json:"timestamp,omitempty"`
+	// Meta is optional metadata sent along with an update and merged into
+	// the registry entry for the metric's name. Listings and the exposition
+	// fill it in from the registry.
+	Meta *Metadata `json:"meta,omitempty"`
+	// Stale is set on reads of gauges that have not been updated within
+	// the server's staleness TTL.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// MarshalJSON encodes non-finite gauge values, which JSON numbers cannot
+// hold, as the strings "NaN", "+Inf" and "-Inf".
+func (m Metrics) MarshalJSON() ([]byte, error) {
+	type plain Metrics
+	if m.Value == nil || !math.IsNaN(*m.Value) && !math.IsInf(*m.Value, 0) {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		Value string `json:"value"`
+	}{plain(m), strconv.FormatFloat(*m.Value, 'g', -1, 64)})
+}
+
+// UnmarshalJSON accepts the strings MarshalJSON writes for non-finite values
+// as well as numbers.
+func (m *Metrics) UnmarshalJSON(data []byte) error {
+	type plain Metrics
+	aux := struct {
+		*plain
+		Value json.RawMessage `json:"value"`
+	}{plain: (*plain)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	m.Value = nil
+	if len(aux.Value) == 0 || string(aux.Value) == "null" {
+		return nil
+	}
+	var value float64
+	if aux.Value[0] == '"' {
+		var s string
+		if err := json.Unmarshal(aux.Value, &s); err != nil {
+			return err
+		}
+		switch s {
+		case "NaN":
+			value = math.NaN()
+		case "+Inf", "Inf":
+			value = math.Inf(1)
+		case "-Inf":
+			value = math.Inf(-1)
+		default:
+			return fmt.Errorf("invalid value %q", s)
+		}
+	} else if err := json.Unmarshal(aux.Value, &value); err != nil {
+		return err
+	}
+	m.Value = &value
+	return nil
 }
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsJSONNonFiniteValues(t *testing.T) {
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1.5} {
+		value := v
+		data, err := json.Marshal(Metrics{ID: "temp", MType: "gauge", Value: &value})
+		if err != nil {
+			t.Fatalf("Marshal(%v) failed: %v", v, err)
+		}
+
+		var decoded Metrics
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Unmarshal(%s) failed: %v", data, err)
+		}
+		assert.Equal(t, "temp", decoded.ID)
+		if math.IsNaN(v) {
+			assert.JSONEq(t, `{"id":"temp","type":"gauge","value":"NaN"}`, string(data))
+			assert.True(t, math.IsNaN(*decoded.Value))
+		} else {
+			assert.Equal(t, v, *decoded.Value)
+		}
+	}
+
+	var m Metrics
+	assert.Error(t, json.Unmarshal([]byte(`{"id":"temp","type":"gauge","value":"hot"}`), &m))
+}
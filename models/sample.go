@@ -0,0 +1,40 @@
+package models
+
+// Sample is the value of a series at a Unix millisecond timestamp. Counter
+// samples hold the running total rather than the increment.
+type Sample struct {
+	Timestamp int64   `json:"t"`
+	Value     float64 `json:"v"`
+}
+
+// Rollup summarises the samples of a series that fall into one bucket,
+// which starts at Timestamp and is as long as the rollup's resolution.
+type Rollup struct {
+	Timestamp int64   `json:"t"`
+	Min       float64 `json:"min"`
+	Max       float64 `json:"max"`
+	Sum       float64 `json:"sum"`
+	Count     int64   `json:"count"`
+}
+
+// Avg returns the mean of the summarised samples.
+func (r Rollup) Avg() float64 {
+	return r.Sum / float64(r.Count)
+}
+
+// Add includes a value in the rollup.
+func (r *Rollup) Add(v float64) {
+	r.Merge(Rollup{Min: v, Max: v, Sum: v, Count: 1})
+}
+
+// Merge includes the samples summarised by another rollup.
+func (r *Rollup) Merge(o Rollup) {
+	if r.Count == 0 || o.Min < r.Min {
+		r.Min = o.Min
+	}
+	if r.Count == 0 || o.Max > r.Max {
+		r.Max = o.Max
+	}
+	r.Sum += o.Sum
+	r.Count += o.Count
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SeriesID builds the metric ID used for labelled series, e.g.
+// http_requests_total{method="GET",path="/"}. Labels are sorted by name so the
+// same label set always produces the same ID. Without labels the name is
+// returned unchanged, which keeps plain agent metrics such as "Alloc" intact.
+func SeriesID(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// ParseSeriesID splits an ID built by SeriesID into the metric name and its
+// labels. IDs without a label block yield an empty (nil) label map.
+func ParseSeriesID(id string) (string, map[string]string, error) {
+	open := strings.IndexByte(id, '{')
+	if open < 0 {
+		return id, nil, nil
+	}
+	if !strings.HasSuffix(id, "}") {
+		return "", nil, fmt.Errorf("unterminated label set in %q", id)
+	}
+
+	name := id[:open]
+	body := id[open+1 : len(id)-1]
+	labels := make(map[string]string)
+
+	for len(body) > 0 {
+		eq := strings.IndexByte(body, '=')
+		if eq <= 0 || eq+1 >= len(body) || body[eq+1] != '"' {
+			return "", nil, fmt.Errorf("malformed label in %q", id)
+		}
+		key := strings.TrimSpace(body[:eq])
+
+		var value strings.Builder
+		i := eq + 2
+		closed := false
+		for ; i < len(body); i++ {
+			c := body[i]
+			if c == '\\' && i+1 < len(body) {
+				i++
+				switch body[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(body[i])
+				}
+				continue
+			}
+			if c == '"' {
+				closed = true
+				break
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return "", nil, fmt.Errorf("unterminated label value in %q", id)
+		}
+		labels[key] = value.String()
+
+		body = body[i+1:]
+		if strings.HasPrefix(body, ",") {
+			body = body[1:]
+		} else if len(body) > 0 {
+			return "", nil, fmt.Errorf("malformed label set in %q", id)
+		}
+	}
+
+	return name, labels, nil
+}
+
+// SanitizeName replaces every character that is not allowed in a Prometheus
+// style metric or label name with an underscore, so names such as
+// "http.server.duration" become "http_server_duration".
+func SanitizeName(name string) string {
+	if name == "" {
+		return "_"
+	}
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || c == ':' ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9' && i > 0)
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func escapeLabelValue(v string) string {
+	if !strings.ContainsAny(v, "\\\"\n") {
+		return v
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return r.Replace(v)
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesIDRoundTrip(t *testing.T) {
+	labels := map[string]string{"path": `/a"b`, "method": "GET"}
+
+	id := SeriesID("http_requests_total", labels)
+	assert.Equal(t, `http_requests_total{method="GET",path="/a\"b"}`, id)
+
+	name, parsed, err := ParseSeriesID(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "http_requests_total", name)
+	assert.Equal(t, labels, parsed)
+}
+
+func TestSeriesIDWithoutLabels(t *testing.T) {
+	assert.Equal(t, "Alloc", SeriesID("Alloc", nil))
+
+	name, labels, err := ParseSeriesID("Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, "Alloc", name)
+	assert.Nil(t, labels)
+}
+
+func TestSanitizeName(t *testing.T) {
+	assert.Equal(t, "http_server_duration", SanitizeName("http.server.duration"))
+	assert.Equal(t, "_xx", SanitizeName("9xx"))
+}
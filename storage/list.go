@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+const (
+	SortByName  = "name"
+	SortByValue = "value"
+
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+var ErrInvalidQuery = errors.New("invalid list query")
+
+// ListQuery selects a page of metrics. Metrics are ordered by name or by
+// value, with name and type breaking ties so the order is total and pages
+// can be continued from a cursor.
+type ListQuery struct {
+	Type   string // "gauge", "counter" or empty for both
+	Prefix string
+	Regex  string // matched against the metric ID
+	SortBy string // SortByName (default) or SortByValue
+	Desc   bool
+	Limit  int
+	Cursor string // NextCursor of the previous page
+}
+
+type ListResult struct {
+	Metrics []models.Metrics
+	// Total is the number of metrics matching the filters across all pages.
+	Total      int
+	NextCursor string
+}
+
+type listCursor struct {
+	SortBy string `json:"s"`
+	Name   string `json:"n"`
+	Type   string `json:"t"`
+	Value  string `json:"v,omitempty"` // formatted so NaN and Inf survive JSON
+}
+
+// normalize validates q, fills in defaults and decodes its cursor.
+func (q *ListQuery) normalize() (*regexp.Regexp, *listCursor, error) {
+	switch q.Type {
+	case "", "gauge", "counter":
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown type %q", ErrInvalidQuery, q.Type)
+	}
+
+	switch q.SortBy {
+	case "":
+		q.SortBy = SortByName
+	case SortByName, SortByValue:
+	default:
+		return nil, nil, fmt.Errorf("%w: cannot sort by %q", ErrInvalidQuery, q.SortBy)
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = DefaultListLimit
+	}
+	if q.Limit > MaxListLimit {
+		q.Limit = MaxListLimit
+	}
+
+	var re *regexp.Regexp
+	if q.Regex != "" {
+		var err error
+		re, err = regexp.Compile(q.Regex)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+		}
+	}
+
+	if q.Cursor == "" {
+		return re, nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	var c listCursor
+	if err := json.Unmarshal(raw, &c); err != nil || c.SortBy != q.SortBy {
+		return nil, nil, fmt.Errorf("%w: cursor does not match query", ErrInvalidQuery)
+	}
+	if c.SortBy == SortByValue {
+		if _, err := strconv.ParseFloat(c.Value, 64); err != nil {
+			return nil, nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+		}
+	}
+	return re, &c, nil
+}
+
+func (c *listCursor) value() float64 {
+	v, _ := strconv.ParseFloat(c.Value, 64)
+	return v
+}
+
+// metric returns a stand-in for the last metric of the previous page, to be
+// compared against stored metrics.
+func (c *listCursor) metric() models.Metrics {
+	v := c.value()
+	return models.Metrics{ID: c.Name, MType: c.Type, Value: &v}
+}
+
+func encodeCursor(sortBy string, m models.Metrics) string {
+	c := listCursor{SortBy: sortBy, Name: m.ID, Type: m.MType}
+	if sortBy == SortByValue {
+		c.Value = strconv.FormatFloat(sortValue(m), 'g', -1, 64)
+	}
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// sortValue is the value a metric is ordered by; counters compare by their
+// total.
+func sortValue(m models.Metrics) float64 {
+	if m.Delta != nil {
+		return float64(*m.Delta)
+	}
+	if m.Value != nil {
+		return *m.Value
+	}
+	return math.NaN()
+}
+
+// listLess orders metrics the way ListMetrics pages through them. NaN values
+// sort after all numbers, matching PostgreSQL.
+func listLess(sortBy string, desc bool, a, b models.Metrics) bool {
+	if desc {
+		a, b = b, a
+	}
+	if sortBy == SortByValue {
+		av, bv := sortValue(a), sortValue(b)
+		switch {
+		case math.IsNaN(av) && !math.IsNaN(bv):
+			return false
+		case !math.IsNaN(av) && math.IsNaN(bv):
+			return true
+		case av != bv && !math.IsNaN(av):
+			return av < bv
+		}
+	}
+	if a.ID != b.ID {
+		return a.ID < b.ID
+	}
+	return a.MType < b.MType
+}
@@ -3,131 +3,828 @@ package storage
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/hairutdin/metrics-service/models"
+	"math"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/hairutdin/metrics-service/internal/chunk"
+	"github.com/hairutdin/metrics-service/models"
 )
 
+// DefaultShards is the number of shards NewMemStorage spreads series over.
+const DefaultShards = 64
+
+// MemStorage keeps metrics in memory, hash-partitioned by name into shards
+// with a lock each, so updates of different series rarely wait for each
+// other.
 type MemStorage struct {
+	shards []*memShard
+
+	// mu guards the state that is not sharded.
+	mu       sync.RWMutex
+	metadata map[metadataKey]models.Metadata
+	// idempotencyKeys maps keys of applied batches to their expiry.
+	idempotencyKeys map[string]time.Time
+	lastKeySweep    time.Time
+
+	// compactMu serialises compactions. watermarks holds how far each
+	// rollup step has been built.
+	compactMu  sync.Mutex
+	watermarks map[time.Duration]int64
+}
+
+// memShard holds the series whose names hash to it. Updates of existing
+// series only need the read lock; adding and removing series takes the
+// write lock.
+type memShard struct {
 	sync.RWMutex
-	Gauges   map[string]float64
-	Counters map[string]int64
+	gauges   map[string]*memSeries
+	counters map[string]*memSeries
+}
+
+// memSeries is one gauge or counter. value holds the float64 bits of a
+// gauge or the total of a counter and ts the Unix millisecond timestamp of
+// the last applied update; both are read without locks. mu orders updates
+// with the samples they record in history, compressed, and guards rollups,
+// its summaries by step.
+type memSeries struct {
+	value atomic.Uint64
+	ts    atomic.Int64
+
+	mu      sync.Mutex
+	history chunk.Series
+	rollups map[time.Duration][]models.Rollup
+}
+
+func (m *memSeries) gauge() float64 { return math.Float64frombits(m.value.Load()) }
+func (m *memSeries) counter() int64 { return int64(m.value.Load()) }
+
+// idempotencySweepInterval bounds how often expired idempotency keys are
+// swept out of memory.
+const idempotencySweepInterval = time.Minute
+
+type metadataKey struct {
+	mtype string
+	name  string
+}
+
+type seriesKey struct {
+	mtype string
+	id    string
 }
 
 func NewMemStorage() *MemStorage {
-	return &MemStorage{
-		Gauges:   make(map[string]float64),
-		Counters: make(map[string]int64),
+	return NewShardedMemStorage(DefaultShards)
+}
+
+// NewShardedMemStorage returns a MemStorage with n shards, at least one.
+func NewShardedMemStorage(n int) *MemStorage {
+	s := &MemStorage{
+		shards:     make([]*memShard, max(n, 1)),
+		metadata:   make(map[metadataKey]models.Metadata),
+		watermarks: make(map[time.Duration]int64),
+	}
+	for i := range s.shards {
+		s.shards[i] = newMemShard()
 	}
+	return s
+}
+
+func newMemShard() *memShard {
+	return &memShard{gauges: make(map[string]*memSeries), counters: make(map[string]*memSeries)}
 }
 
 var _ MetricsStorage = (*MemStorage)(nil)
 
+// shardIndex hashes a metric name with FNV-1a.
+func (s *MemStorage) shardIndex(name string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(s.shards)))
+}
+
+func (s *MemStorage) shard(name string) *memShard {
+	return s.shards[s.shardIndex(name)]
+}
+
+func (sh *memShard) series(metricType string) map[string]*memSeries {
+	switch metricType {
+	case "gauge":
+		return sh.gauges
+	case "counter":
+		return sh.counters
+	}
+	return nil
+}
+
+// acquire locks the series of the given type and name, creating it if
+// needed. It reports whether the series was created and whether the shard
+// is held exclusively, which release needs.
+func (sh *memShard) acquire(series map[string]*memSeries, name string) (m *memSeries, created, exclusive bool) {
+	sh.RLock()
+	if m, ok := series[name]; ok {
+		m.mu.Lock()
+		return m, false, false
+	}
+	sh.RUnlock()
+
+	sh.Lock()
+	m, ok := series[name]
+	if !ok {
+		m = &memSeries{}
+		series[name] = m
+	}
+	m.mu.Lock()
+	return m, !ok, true
+}
+
+func (sh *memShard) release(m *memSeries, exclusive bool) {
+	m.mu.Unlock()
+	if exclusive {
+		sh.Unlock()
+	} else {
+		sh.RUnlock()
+	}
+}
+
+// lookup returns a series under the shard's read lock, which the caller
+// releases.
+func (s *MemStorage) lookup(metricType, name string) (*memShard, *memSeries) {
+	sh := s.shard(name)
+	sh.RLock()
+	return sh, sh.series(metricType)[name]
+}
+
 func (s *MemStorage) UpdateGauge(name string, value float64) {
-	s.Lock()
-	defer s.Unlock()
-	s.Gauges[name] = value
+	s.setGauge(name, value, time.Now().UnixMilli())
 }
 
 func (ms *MemStorage) UpdateMetricsBatch(metrics []models.Metrics) error {
-	ms.Lock()
-	defer ms.Unlock()
+	ms.applyBatch(metrics)
+	return nil
+}
+
+func (ms *MemStorage) UpdateMetricsBatchOnce(key string, metrics []models.Metrics, ttl time.Duration) (bool, error) {
+	ms.mu.Lock()
+	now := time.Now()
+	if now.Sub(ms.lastKeySweep) >= idempotencySweepInterval {
+		for k, expiry := range ms.idempotencyKeys {
+			if !now.Before(expiry) {
+				delete(ms.idempotencyKeys, k)
+			}
+		}
+		ms.lastKeySweep = now
+	}
+
+	if expiry, seen := ms.idempotencyKeys[key]; seen && now.Before(expiry) {
+		ms.mu.Unlock()
+		return false, nil
+	}
+	if ms.idempotencyKeys == nil {
+		ms.idempotencyKeys = make(map[string]time.Time)
+	}
+	ms.idempotencyKeys[key] = now.Add(ttl)
+	ms.mu.Unlock()
+
+	ms.applyBatch(metrics)
+	return true, nil
+}
+
+// applyBatch applies every metric under the lock of its own series, so a
+// concurrent reader may see part of a batch.
+func (ms *MemStorage) applyBatch(metrics []models.Metrics) {
+	now := time.Now().UnixMilli()
 	for _, metric := range metrics {
-		if metric.MType == "gauge" {
-			ms.Gauges[metric.ID] = *metric.Value
-		} else if metric.MType == "counter" {
-			ms.Counters[metric.ID] += *metric.Delta
+		ts := now
+		if metric.Timestamp != nil {
+			ts = *metric.Timestamp
+		}
+		switch {
+		case metric.MType == "gauge" && metric.Value != nil:
+			ms.setGauge(metric.ID, *metric.Value, ts)
+		case metric.MType == "counter" && metric.Delta != nil:
+			ms.addCounter(metric.ID, *metric.Delta, ts)
+		default:
+			continue
+		}
+		if metric.Meta != nil && !metric.Meta.IsZero() {
+			key := metadataKey{metric.MType, models.MetadataName(metric.ID)}
+			ms.mu.Lock()
+			if ms.metadata == nil {
+				ms.metadata = make(map[metadataKey]models.Metadata)
+			}
+			ms.metadata[key] = ms.metadata[key].Merge(*metric.Meta)
+			ms.mu.Unlock()
+		}
+	}
+}
+
+// setGauge applies last-write-wins: a sample older than the stored one is
+// ignored.
+func (s *MemStorage) setGauge(name string, value float64, ts int64) {
+	sh := s.shard(name)
+	m, created, exclusive := sh.acquire(sh.gauges, name)
+	defer sh.release(m, exclusive)
+
+	if !created && ts < m.ts.Load() {
+		return
+	}
+	m.value.Store(math.Float64bits(value))
+	m.ts.Store(ts)
+	m.history.Append(ts, value)
+}
+
+// addCounter applies every increment and keeps the latest timestamp seen.
+func (s *MemStorage) addCounter(name string, delta int64, ts int64) {
+	sh := s.shard(name)
+	m, created, exclusive := sh.acquire(sh.counters, name)
+	defer sh.release(m, exclusive)
+
+	total := int64(m.value.Add(uint64(delta)))
+	if created || ts > m.ts.Load() {
+		m.ts.Store(ts)
+	}
+	m.history.Append(m.ts.Load(), float64(total))
+}
+
+func (s *MemStorage) History(metricType string, id string, from, to time.Time) ([]models.Sample, error) {
+	sh, m := s.lookup(metricType, id)
+	defer sh.RUnlock()
+	if m == nil {
+		return nil, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var samples []models.Sample
+	it := m.history.Iterator(from.UnixMilli(), to.UnixMilli())
+	for it.Next() {
+		ts, value := it.At()
+		samples = append(samples, models.Sample{Timestamp: ts, Value: value})
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to decode history: %w", err)
+	}
+	return samples, nil
+}
+
+func (s *MemStorage) Rollups(metricType string, id string, step time.Duration, from, to time.Time) ([]models.Rollup, error) {
+	sh, m := s.lookup(metricType, id)
+	defer sh.RUnlock()
+	if m == nil {
+		return nil, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rollups := m.rollups[step]
+	start := sort.Search(len(rollups), func(i int) bool { return rollups[i].Timestamp >= from.UnixMilli() })
+	end := sort.Search(len(rollups), func(i int) bool { return rollups[i].Timestamp > to.UnixMilli() })
+	if start >= end {
+		return nil, nil
+	}
+	return append([]models.Rollup(nil), rollups[start:end]...), nil
+}
+
+// Compact builds the first rollup level from raw samples and every further
+// level from the one before it, then expires old samples and rollups. It
+// works one series at a time, so updates of other series go on meanwhile.
+func (s *MemStorage) Compact(policy RetentionPolicy, now time.Time) (CompactResult, error) {
+	if err := policy.Validate(); err != nil {
+		return CompactResult{}, err
+	}
+
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	if s.watermarks == nil {
+		s.watermarks = make(map[time.Duration]int64)
+	}
+
+	// The window of every level and the watermarks it leaves behind.
+	from, to := make([]int64, len(policy)), make([]int64, len(policy))
+	watermarks := make(map[time.Duration]int64, len(s.watermarks))
+	for step, ts := range s.watermarks {
+		watermarks[step] = ts
+	}
+	for level := 1; level < len(policy); level++ {
+		step := policy[level].Step
+		from[level], to[level] = compactionWindow(s.watermarks[step], step, now)
+		if to[level] > from[level] {
+			watermarks[step] = to[level]
+		}
+	}
+	cutoffs := make([]int64, len(policy))
+	for level := range policy {
+		cutoffs[level] = expiryCutoff(policy, level, watermarks, now)
+	}
+
+	var result CompactResult
+	for _, sh := range s.shards {
+		sh.RLock()
+		for _, series := range []map[string]*memSeries{sh.gauges, sh.counters} {
+			for _, m := range series {
+				m.mu.Lock()
+				err := m.compact(policy, from, to, cutoffs, &result)
+				m.mu.Unlock()
+				if err != nil {
+					sh.RUnlock()
+					return result, err
+				}
+			}
+		}
+		sh.RUnlock()
+	}
+	s.watermarks = watermarks
+	return result, nil
+}
+
+// compact builds the rollups of a series in the windows [from, to) of each
+// level and then deletes what is older than the cutoffs. Callers hold mu.
+func (m *memSeries) compact(policy RetentionPolicy, from, to, cutoffs []int64, result *CompactResult) error {
+	for level := 1; level < len(policy); level++ {
+		if to[level] <= from[level] {
+			continue
+		}
+		step, finer := policy[level].Step, policy[level-1].Step
+		var points []models.Rollup
+		if finer == 0 {
+			it := m.history.Iterator(from[level], to[level]-1)
+			for it.Next() {
+				ts, value := it.At()
+				point := models.Rollup{Timestamp: ts}
+				point.Add(value)
+				points = append(points, point)
+			}
+			if err := it.Err(); err != nil {
+				return fmt.Errorf("failed to decode history: %w", err)
+			}
+		} else {
+			points = m.rollups[finer]
+		}
+		if len(points) == 0 {
+			continue
+		}
+		if m.rollups == nil {
+			m.rollups = make(map[time.Duration][]models.Rollup)
+		}
+		before := len(m.rollups[step])
+		m.rollups[step] = appendRollups(m.rollups[step], step, from[level], to[level], points)
+		result.Rollups += len(m.rollups[step]) - before
+	}
+
+	result.Expired += m.history.DropBefore(cutoffs[0])
+	for level := 1; level < len(policy); level++ {
+		step := policy[level].Step
+		rollups := m.rollups[step]
+		expired := sort.Search(len(rollups), func(i int) bool { return rollups[i].Timestamp >= cutoffs[level] })
+		result.Expired += expired
+		if expired == len(rollups) {
+			delete(m.rollups, step)
+		} else if expired > 0 {
+			m.rollups[step] = append([]models.Rollup(nil), rollups[expired:]...)
 		}
 	}
 	return nil
 }
 
+func gaugeMetric(name string, m *memSeries) models.Metrics {
+	value, ts := m.gauge(), m.ts.Load()
+	return models.Metrics{ID: name, MType: "gauge", Value: &value, Timestamp: &ts}
+}
+
+func counterMetric(name string, m *memSeries) models.Metrics {
+	value, ts := m.counter(), m.ts.Load()
+	return models.Metrics{ID: name, MType: "counter", Delta: &value, Timestamp: &ts}
+}
+
 func (s *MemStorage) UpdateCounter(name string, value int64) {
-	s.Lock()
-	defer s.Unlock()
-	s.Counters[name] += value
+	s.addCounter(name, value, time.Now().UnixMilli())
 }
 
-func (s *MemStorage) GetMetric(metricType string, name string) (string, error) {
-	s.RLock()
-	defer s.RUnlock()
+// Gauges returns a copy of the value of every gauge by name.
+func (s *MemStorage) Gauges() map[string]float64 {
+	gauges := make(map[string]float64)
+	for _, sh := range s.shards {
+		sh.RLock()
+		for name, m := range sh.gauges {
+			gauges[name] = m.gauge()
+		}
+		sh.RUnlock()
+	}
+	return gauges
+}
 
-	switch metricType {
-	case "gauge":
-		if value, exists := s.Gauges[name]; exists {
-			return fmt.Sprintf("%f", value), nil
+// Counters returns a copy of the total of every counter by name.
+func (s *MemStorage) Counters() map[string]int64 {
+	counters := make(map[string]int64)
+	for _, sh := range s.shards {
+		sh.RLock()
+		for name, m := range sh.counters {
+			counters[name] = m.counter()
 		}
-	case "counter":
-		if value, exists := s.Counters[name]; exists {
-			return fmt.Sprintf("%d", value), nil
+		sh.RUnlock()
+	}
+	return counters
+}
+
+func (s *MemStorage) GetMetric(metricType string, name string) (string, error) {
+	sh, m := s.lookup(metricType, name)
+	defer sh.RUnlock()
+
+	switch {
+	case m == nil:
+	case metricType == "gauge":
+		return fmt.Sprintf("%f", m.gauge()), nil
+	case metricType == "counter":
+		return fmt.Sprintf("%d", m.counter()), nil
+	}
+	return "", ErrMetricNotFound
+}
+
+func (s *MemStorage) GetMetrics(keys []models.Metrics) ([]models.Metrics, error) {
+	found := make([]models.Metrics, 0, len(keys))
+	for _, key := range keys {
+		sh, m := s.lookup(key.MType, key.ID)
+		switch {
+		case m == nil:
+		case key.MType == "gauge":
+			found = append(found, gaugeMetric(key.ID, m))
+		case key.MType == "counter":
+			found = append(found, counterMetric(key.ID, m))
 		}
+		sh.RUnlock()
 	}
-	return "", fmt.Errorf("metric not found")
+	return found, nil
 }
 
 func (s *MemStorage) GetAllMetrics() map[string]string {
-	s.RLock()
-	defer s.RUnlock()
-
 	metrics := make(map[string]string)
-	for name, value := range s.Gauges {
+	for name, value := range s.Gauges() {
 		metrics[name] = fmt.Sprintf("gauge: %f", value)
 	}
-	for name, value := range s.Counters {
+	for name, value := range s.Counters() {
 		metrics[name] = fmt.Sprintf("counter: %d", value)
 	}
 	return metrics
 }
 
-func (s *MemStorage) SaveMetricsToFile(filePath string) error {
-	s.RLock()
-	defer s.RUnlock()
+// collect returns the metrics for which keep, if not nil, reports true.
+// Each shard is read under its own lock.
+func (s *MemStorage) collect(keep func(name, metricType string) bool) []models.Metrics {
+	var metrics []models.Metrics
+	for _, sh := range s.shards {
+		sh.RLock()
+		for name, m := range sh.gauges {
+			if keep == nil || keep(name, "gauge") {
+				metrics = append(metrics, gaugeMetric(name, m))
+			}
+		}
+		for name, m := range sh.counters {
+			if keep == nil || keep(name, "counter") {
+				metrics = append(metrics, counterMetric(name, m))
+			}
+		}
+		sh.RUnlock()
+	}
+	return metrics
+}
 
-	data := struct {
-		Gauges   map[string]float64 `json:"gauges"`
-		Counters map[string]int64   `json:"counters"`
-	}{
-		Gauges:   s.Gauges,
-		Counters: s.Counters,
+func (s *MemStorage) Snapshot() ([]models.Metrics, error) {
+	metrics := s.collect(nil)
+	if metrics == nil {
+		metrics = []models.Metrics{}
 	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		return metrics[i].MType < metrics[j].MType
+	})
+	return metrics, nil
+}
 
-	file, err := os.Create(filePath)
+func (s *MemStorage) ListMetrics(query ListQuery) (ListResult, error) {
+	re, cursor, err := query.normalize()
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	metrics := s.collect(func(name, metricType string) bool {
+		if query.Type != "" && query.Type != metricType {
+			return false
+		}
+		if !strings.HasPrefix(name, query.Prefix) {
+			return false
+		}
+		return re == nil || re.MatchString(name)
+	})
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return listLess(query.SortBy, query.Desc, metrics[i], metrics[j])
+	})
+
+	start := 0
+	if cursor != nil {
+		last := cursor.metric()
+		start = sort.Search(len(metrics), func(i int) bool {
+			return listLess(query.SortBy, query.Desc, last, metrics[i])
+		})
+	}
+	end := start + query.Limit
+	if end > len(metrics) {
+		end = len(metrics)
+	}
+
+	result := ListResult{Metrics: metrics[start:end], Total: len(metrics)}
+	if end < len(metrics) {
+		result.NextCursor = encodeCursor(query.SortBy, metrics[end-1])
+	}
+	return result, nil
+}
+
+func (s *MemStorage) DeleteMetric(metricType string, name string) error {
+	sh := s.shard(name)
+	sh.Lock()
+	defer sh.Unlock()
+
+	series := sh.series(metricType)
+	if _, exists := series[name]; !exists {
+		return ErrMetricNotFound
+	}
+	delete(series, name)
+	return nil
+}
+
+func (s *MemStorage) DeleteMatching(metricType string, pattern string) ([]models.Metrics, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+
+	var deleted []models.Metrics
+	for _, sh := range s.shards {
+		sh.Lock()
+		for _, mtype := range []string{"gauge", "counter"} {
+			if metricType != "" && metricType != mtype {
+				continue
+			}
+			series := sh.series(mtype)
+			for name := range series {
+				if re.MatchString(name) {
+					delete(series, name)
+					deleted = append(deleted, models.Metrics{ID: name, MType: mtype})
+				}
+			}
+		}
+		sh.Unlock()
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		if deleted[i].ID != deleted[j].ID {
+			return deleted[i].ID < deleted[j].ID
+		}
+		return deleted[i].MType < deleted[j].MType
+	})
+	return deleted, nil
+}
+
+func (s *MemStorage) CountSeries() (int, error) {
+	count := 0
+	for _, sh := range s.shards {
+		sh.RLock()
+		count += len(sh.gauges) + len(sh.counters)
+		sh.RUnlock()
+	}
+	return count, nil
+}
+
+func (s *MemStorage) DeleteStaleGauges(before time.Time) ([]models.Metrics, error) {
+	cutoff := before.UnixMilli()
+
+	var deleted []models.Metrics
+	for _, sh := range s.shards {
+		sh.Lock()
+		for name, m := range sh.gauges {
+			if m.ts.Load() < cutoff {
+				delete(sh.gauges, name)
+				deleted = append(deleted, models.Metrics{ID: name, MType: "gauge"})
+			}
+		}
+		sh.Unlock()
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].ID < deleted[j].ID })
+	return deleted, nil
+}
+
+func (s *MemStorage) ResetCounter(name string) error {
+	sh, m := s.lookup("counter", name)
+	defer sh.RUnlock()
+	if m == nil {
+		return ErrMetricNotFound
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UnixMilli()
+	m.value.Store(0)
+	m.ts.Store(now)
+	m.history.Append(now, 0)
+	return nil
+}
+
+func (s *MemStorage) RenameMetric(metricType string, oldName string, newName string) error {
+	if metricType != "gauge" && metricType != "counter" {
+		return ErrMetricNotFound
+	}
+
+	// Both shards are locked in index order so that concurrent renames
+	// cannot deadlock.
+	i, j := s.shardIndex(oldName), s.shardIndex(newName)
+	if i > j {
+		i, j = j, i
+	}
+	s.shards[i].Lock()
+	defer s.shards[i].Unlock()
+	if j != i {
+		s.shards[j].Lock()
+		defer s.shards[j].Unlock()
+	}
+
+	from, to := s.shard(oldName).series(metricType), s.shard(newName).series(metricType)
+	m, exists := from[oldName]
+	if !exists {
+		return ErrMetricNotFound
+	}
+	if _, taken := to[newName]; taken {
+		return ErrMetricExists
+	}
+	delete(from, oldName)
+	to[newName] = m
+	return nil
+}
+
+func (s *MemStorage) SetMetadata(metricType string, name string, md models.Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.metadata == nil {
+		s.metadata = make(map[metadataKey]models.Metadata)
+	}
+	s.metadata[metadataKey{metricType, name}] = md
+	return nil
+}
+
+func (s *MemStorage) DeleteMetadata(metricType string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := metadataKey{metricType, name}
+	if _, exists := s.metadata[key]; !exists {
+		return ErrMetricNotFound
+	}
+	delete(s.metadata, key)
+	return nil
+}
+
+func (s *MemStorage) ListMetadata() ([]models.MetricMetadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.metadataList(), nil
+}
+
+// metadataList must be called with mu held.
+func (s *MemStorage) metadataList() []models.MetricMetadata {
+	list := make([]models.MetricMetadata, 0, len(s.metadata))
+	for key, md := range s.metadata {
+		list = append(list, models.MetricMetadata{Name: key.name, Type: key.mtype, Metadata: md})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Type < list[j].Type
+	})
+	return list
+}
+
+// metricsFile is the on-disk format of SaveMetricsToFile. Files written
+// before timestamps were tracked simply lack the *_timestamps fields.
+type metricsFile struct {
+	Gauges       map[string]float64      `json:"gauges"`
+	Counters     map[string]int64        `json:"counters"`
+	GaugeTimes   map[string]int64        `json:"gauge_timestamps,omitempty"`
+	CounterTimes map[string]int64        `json:"counter_timestamps,omitempty"`
+	Metadata     []models.MetricMetadata `json:"metadata,omitempty"`
+}
+
+// SaveMetricsToFile copies the metrics one shard at a time and writes the
+// copy without holding any lock, so ingestion goes on while it encodes.
+func (s *MemStorage) SaveMetricsToFile(filePath string) error {
+	data := metricsFile{
+		Gauges:       make(map[string]float64),
+		Counters:     make(map[string]int64),
+		GaugeTimes:   make(map[string]int64),
+		CounterTimes: make(map[string]int64),
+	}
+	for _, sh := range s.shards {
+		sh.RLock()
+		for name, m := range sh.gauges {
+			data.Gauges[name], data.GaugeTimes[name] = m.gauge(), m.ts.Load()
+		}
+		for name, m := range sh.counters {
+			data.Counters[name], data.CounterTimes[name] = m.counter(), m.ts.Load()
+		}
+		sh.RUnlock()
+	}
+	s.mu.RLock()
+	data.Metadata = s.metadataList()
+	s.mu.RUnlock()
+
+	// The snapshot is written next to the old one and renamed over it, so
+	// a failed save leaves the previous snapshot intact.
+	file, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".tmp*")
 	if err != nil {
 		return fmt.Errorf("error creating file: %v", err)
 	}
+	defer os.Remove(file.Name())
 	defer file.Close()
 
 	encoder := json.NewEncoder(file)
 	if err := encoder.Encode(data); err != nil {
 		return fmt.Errorf("error encoding metrics to file: %v", err)
 	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return fmt.Errorf("error replacing file: %v", err)
+	}
 
 	return nil
 }
 
 func (s *MemStorage) RestoreMetricsFromFile(filePath string) error {
-	s.Lock()
-	defer s.Unlock()
-
 	file, err := os.Open(filePath)
 	if err != nil {
 		return fmt.Errorf("error opening file: %v", err)
 	}
 	defer file.Close()
 
-	data := struct {
-		Gauges   map[string]float64 `json:"gauges"`
-		Counters map[string]int64   `json:"counters"`
-	}{}
+	var data metricsFile
 
 	decoder := json.NewDecoder(file)
 	if err := decoder.Decode(&data); err != nil {
 		return fmt.Errorf("error decoding metrics from file: %v", err)
 	}
 
-	s.Gauges = data.Gauges
-	s.Counters = data.Counters
+	shards := make([]*memShard, len(s.shards))
+	for i := range shards {
+		shards[i] = newMemShard()
+	}
+	// Metrics saved before timestamps were tracked start their clock now,
+	// which for gauges is the staleness clock.
+	now := time.Now().UnixMilli()
+	for name, value := range data.Gauges {
+		m := &memSeries{}
+		m.value.Store(math.Float64bits(value))
+		if ts, exists := data.GaugeTimes[name]; exists {
+			m.ts.Store(ts)
+		} else {
+			m.ts.Store(now)
+		}
+		shards[s.shardIndex(name)].gauges[name] = m
+	}
+	for name, value := range data.Counters {
+		m := &memSeries{}
+		m.value.Store(uint64(value))
+		if ts, exists := data.CounterTimes[name]; exists {
+			m.ts.Store(ts)
+		} else {
+			m.ts.Store(now)
+		}
+		shards[s.shardIndex(name)].counters[name] = m
+	}
+	for i, sh := range s.shards {
+		sh.Lock()
+		sh.gauges, sh.counters = shards[i].gauges, shards[i].counters
+		sh.Unlock()
+	}
+
+	s.mu.Lock()
+	s.metadata = make(map[metadataKey]models.Metadata, len(data.Metadata))
+	for _, md := range data.Metadata {
+		s.metadata[metadataKey{md.Type, md.Name}] = md.Metadata
+	}
+	s.mu.Unlock()
 
 	return nil
 }
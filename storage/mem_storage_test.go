@@ -1,24 +1,33 @@
 package storage
 
 import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
 )
 
 func TestMemStorage(t *testing.T) {
 	storage := NewMemStorage()
 
 	storage.UpdateGauge("testGauge", 10.5)
-	if val, ok := storage.Gauges["testGauge"]; !ok || val != 10.5 {
+	if val, ok := storage.Gauges()["testGauge"]; !ok || val != 10.5 {
 		t.Errorf("Expected gauge value 10.5, got %v", val)
 	}
 
 	storage.UpdateCounter("testCounter", 5)
-	if val, ok := storage.Counters["testCounter"]; !ok || val != 5 {
+	if val, ok := storage.Counters()["testCounter"]; !ok || val != 5 {
 		t.Errorf("Expected counter value 5, got %v", val)
 	}
 
 	storage.UpdateCounter("testCounter", 3)
-	if val, ok := storage.Counters["testCounter"]; !ok || val != 8 {
+	if val, ok := storage.Counters()["testCounter"]; !ok || val != 8 {
 		t.Errorf("Expected counter value 8, got %v", val)
 	}
 
@@ -54,3 +63,473 @@ func TestMemStorage(t *testing.T) {
 		}
 	}
 }
+
+func TestMemStorageDeleteMetric(t *testing.T) {
+	storage := NewMemStorage()
+	storage.UpdateGauge("testGauge", 1)
+
+	if err := storage.DeleteMetric("gauge", "testGauge"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if _, err := storage.GetMetric("gauge", "testGauge"); err == nil {
+		t.Errorf("Expected deleted gauge to be gone")
+	}
+	if err := storage.DeleteMetric("gauge", "testGauge"); err != ErrMetricNotFound {
+		t.Errorf("Expected ErrMetricNotFound, got %v", err)
+	}
+}
+
+func TestMemStorageListMetrics(t *testing.T) {
+	storage := NewMemStorage()
+	storage.UpdateGauge("HeapAlloc", 30)
+	storage.UpdateGauge("HeapIdle", 10)
+	storage.UpdateGauge("Alloc", 20)
+	storage.UpdateCounter("HeapCount", 5)
+
+	result, err := storage.ListMetrics(ListQuery{Prefix: "Heap", SortBy: SortByValue, Limit: 2})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Total != 3 || len(result.Metrics) != 2 || result.NextCursor == "" {
+		t.Fatalf("Unexpected first page: %+v", result)
+	}
+	if result.Metrics[0].ID != "HeapCount" || result.Metrics[1].ID != "HeapIdle" {
+		t.Errorf("Expected HeapCount, HeapIdle, got %s, %s", result.Metrics[0].ID, result.Metrics[1].ID)
+	}
+
+	result, err = storage.ListMetrics(ListQuery{Prefix: "Heap", SortBy: SortByValue, Limit: 2, Cursor: result.NextCursor})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Metrics) != 1 || result.Metrics[0].ID != "HeapAlloc" || result.NextCursor != "" {
+		t.Errorf("Unexpected second page: %+v", result)
+	}
+
+	result, _ = storage.ListMetrics(ListQuery{Type: "gauge", Regex: "^(Alloc|HeapIdle)$", Desc: true})
+	if len(result.Metrics) != 2 || result.Metrics[0].ID != "HeapIdle" {
+		t.Errorf("Unexpected filtered result: %+v", result)
+	}
+
+	if _, err := storage.ListMetrics(ListQuery{Regex: "("}); err == nil {
+		t.Errorf("Expected error for invalid regex")
+	}
+}
+
+func TestMemStorageAdminOperations(t *testing.T) {
+	storage := NewMemStorage()
+	storage.UpdateGauge("HeapAlloc", 1)
+	storage.UpdateGauge("HeapIdle", 2)
+	storage.UpdateGauge("Alloc", 3)
+	storage.UpdateCounter("HeapCount", 4)
+
+	deleted, err := storage.DeleteMatching("gauge", "^Heap")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(deleted) != 2 || deleted[0].ID != "HeapAlloc" || deleted[1].ID != "HeapIdle" {
+		t.Errorf("Expected HeapAlloc and HeapIdle to be deleted, got %v", deleted)
+	}
+	if _, ok := storage.Counters()["HeapCount"]; !ok {
+		t.Errorf("Expected counter to survive a gauge-only deletion")
+	}
+	if _, err := storage.DeleteMatching("", "("); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+
+	if err := storage.ResetCounter("HeapCount"); err != nil || storage.Counters()["HeapCount"] != 0 {
+		t.Errorf("Expected counter to be reset, got %v (%v)", storage.Counters()["HeapCount"], err)
+	}
+	if err := storage.ResetCounter("Missing"); err != ErrMetricNotFound {
+		t.Errorf("Expected ErrMetricNotFound, got %v", err)
+	}
+
+	storage.UpdateGauge("Sys", 5)
+	if err := storage.RenameMetric("gauge", "Alloc", "Sys"); err != ErrMetricExists {
+		t.Errorf("Expected ErrMetricExists, got %v", err)
+	}
+	if err := storage.RenameMetric("gauge", "Alloc", "AllocBytes"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if val, ok := storage.Gauges()["AllocBytes"]; !ok || val != 3 {
+		t.Errorf("Expected renamed gauge with value 3, got %v", val)
+	}
+	if _, ok := storage.Gauges()["Alloc"]; ok {
+		t.Errorf("Expected old name to be gone")
+	}
+}
+
+func TestMemStorageGetMetrics(t *testing.T) {
+	storage := NewMemStorage()
+	storage.UpdateGauge("Alloc", 1.5)
+	storage.UpdateCounter("PollCount", 3)
+
+	found, _ := storage.GetMetrics([]models.Metrics{
+		{ID: "PollCount", MType: "counter"},
+		{ID: "Alloc", MType: "counter"},
+		{ID: "Alloc", MType: "gauge"},
+	})
+	if len(found) != 2 || found[0].ID != "PollCount" || *found[0].Delta != 3 || found[1].ID != "Alloc" || *found[1].Value != 1.5 {
+		t.Errorf("Unexpected lookup result: %v", found)
+	}
+}
+
+func TestMemStorageBatchSkipsMissingValues(t *testing.T) {
+	storage := NewMemStorage()
+	err := storage.UpdateMetricsBatch([]models.Metrics{{ID: "Alloc", MType: "gauge"}, {ID: "PollCount", MType: "counter"}})
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if len(storage.Gauges()) != 0 || len(storage.Counters()) != 0 {
+		t.Errorf("Expected metrics without values to be skipped, got %v %v", storage.Gauges(), storage.Counters())
+	}
+}
+
+func TestMemStorageUpdateMetricsBatchOnce(t *testing.T) {
+	storage := NewMemStorage()
+	delta := int64(2)
+	batch := []models.Metrics{{ID: "PollCount", MType: "counter", Delta: &delta}}
+
+	if applied, err := storage.UpdateMetricsBatchOnce("k", batch, time.Hour); !applied || err != nil {
+		t.Fatalf("Expected first batch to be applied, got %v (%v)", applied, err)
+	}
+	if applied, _ := storage.UpdateMetricsBatchOnce("k", batch, time.Hour); applied {
+		t.Errorf("Expected replayed batch to be skipped")
+	}
+	if storage.Counters()["PollCount"] != 2 {
+		t.Errorf("Expected counter 2, got %d", storage.Counters()["PollCount"])
+	}
+
+	storage.idempotencyKeys["k"] = time.Now().Add(-time.Second)
+	if applied, _ := storage.UpdateMetricsBatchOnce("k", batch, time.Hour); !applied {
+		t.Errorf("Expected batch with an expired key to be applied")
+	}
+}
+
+func TestMemStorageTimestamps(t *testing.T) {
+	storage := NewMemStorage()
+	ts := func(v int64) *int64 { return &v }
+	newer, older, delta := 2.0, 1.0, int64(1)
+
+	storage.UpdateMetricsBatch([]models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &newer, Timestamp: ts(2000)},
+		{ID: "Alloc", MType: "gauge", Value: &older, Timestamp: ts(1000)},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Timestamp: ts(2000)},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Timestamp: ts(1000)},
+	})
+	if storage.Gauges()["Alloc"] != 2 {
+		t.Errorf("Expected the newer gauge value 2 to win, got %v", storage.Gauges()["Alloc"])
+	}
+	if storage.Counters()["PollCount"] != 2 {
+		t.Errorf("Expected both counter increments to apply, got %d", storage.Counters()["PollCount"])
+	}
+
+	found, _ := storage.GetMetrics([]models.Metrics{{ID: "Alloc", MType: "gauge"}, {ID: "PollCount", MType: "counter"}})
+	if len(found) != 2 || *found[0].Timestamp != 2000 || *found[1].Timestamp != 2000 {
+		t.Errorf("Expected latest timestamps 2000, got %v", found)
+	}
+
+	storage.UpdateGauge("Alloc", 3)
+	if storage.Gauges()["Alloc"] != 3 {
+		t.Errorf("Expected an update without timestamp to use the server clock, got %v", storage.Gauges()["Alloc"])
+	}
+}
+
+func TestMemStorageMetadata(t *testing.T) {
+	storage := NewMemStorage()
+	storage.SetMetadata("gauge", "Alloc", models.Metadata{Unit: "bytes", Owner: "runtime"})
+
+	value := 1.0
+	storage.UpdateMetricsBatch([]models.Metrics{
+		{ID: `Alloc{host="a"}`, MType: "gauge", Value: &value, Meta: &models.Metadata{Description: "Heap bytes"}},
+		{ID: "Sys", MType: "gauge", Meta: &models.Metadata{Description: "skipped without a value"}},
+	})
+
+	list, _ := storage.ListMetadata()
+	want := models.Metadata{Unit: "bytes", Description: "Heap bytes", Owner: "runtime"}
+	if len(list) != 1 || list[0].Name != "Alloc" || list[0].Type != "gauge" || list[0].Metadata != want {
+		t.Errorf("Expected inline metadata to merge into the Alloc entry, got %+v", list)
+	}
+
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if err := storage.SaveMetricsToFile(path); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	restored := NewMemStorage()
+	if err := restored.RestoreMetricsFromFile(path); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if list, _ := restored.ListMetadata(); len(list) != 1 || list[0].Metadata != want {
+		t.Errorf("Expected metadata to survive a restart, got %+v", list)
+	}
+
+	if err := storage.DeleteMetadata("gauge", "Alloc"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if err := storage.DeleteMetadata("gauge", "Alloc"); err != ErrMetricNotFound {
+		t.Errorf("Expected ErrMetricNotFound, got %v", err)
+	}
+}
+
+func TestMemStorageFailedSaveKeepsSnapshot(t *testing.T) {
+	storage := NewMemStorage()
+	storage.UpdateGauge("Alloc", 1)
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if err := storage.SaveMetricsToFile(path); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	storage.UpdateGauge("Ratio", math.Inf(1))
+	if err := storage.SaveMetricsToFile(path); err == nil {
+		t.Errorf("Expected an infinite gauge to fail the save")
+	}
+
+	restored := NewMemStorage()
+	if err := restored.RestoreMetricsFromFile(path); err != nil {
+		t.Fatalf("Expected the previous snapshot to survive, got %v", err)
+	}
+	if val := restored.Gauges()["Alloc"]; val != 1 {
+		t.Errorf("Expected gauge value 1, got %v", val)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Expected no leftover temporary files, got %d entries", len(entries))
+	}
+}
+
+func TestMemStorageDeleteStaleGauges(t *testing.T) {
+	storage := NewMemStorage()
+	old, recent, delta := time.Now().Add(-time.Hour).UnixMilli(), time.Now().UnixMilli(), int64(1)
+	value := 1.0
+	storage.UpdateMetricsBatch([]models.Metrics{
+		{ID: "Decommissioned", MType: "gauge", Value: &value, Timestamp: &old},
+		{ID: "Alive", MType: "gauge", Value: &value, Timestamp: &recent},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Timestamp: &old},
+	})
+
+	deleted, err := storage.DeleteStaleGauges(time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(deleted) != 1 || deleted[0].ID != "Decommissioned" {
+		t.Errorf("Expected only Decommissioned to be deleted, got %v", deleted)
+	}
+	if _, ok := storage.Gauges()["Alive"]; !ok {
+		t.Errorf("Expected a recently updated gauge to survive")
+	}
+	if _, ok := storage.Counters()["PollCount"]; !ok {
+		t.Errorf("Expected counters to be left alone")
+	}
+}
+
+func TestMemStorageCountSeries(t *testing.T) {
+	storage := NewMemStorage()
+	storage.UpdateGauge("Alloc", 1)
+	storage.UpdateGauge("PollCount", 1)
+	storage.UpdateCounter("PollCount", 1)
+
+	count, err := storage.CountSeries()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 series, got %d", count)
+	}
+}
+
+func TestMemStorageHistory(t *testing.T) {
+	storage := NewMemStorage()
+	ts := func(v int64) *int64 { return &v }
+	value, delta := 1.0, int64(5)
+	hour := time.Hour.Milliseconds()
+
+	storage.UpdateMetricsBatch([]models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value, Timestamp: ts(1000)},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Timestamp: ts(1000)},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Timestamp: ts(2000)},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Timestamp: ts(2000)},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Timestamp: ts(1500)},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Timestamp: ts(hour + 1500)},
+	})
+
+	samples, err := storage.History("counter", "PollCount", time.UnixMilli(0), time.UnixMilli(2*hour))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := []models.Sample{{Timestamp: 1000, Value: 5}, {Timestamp: 2000, Value: 20}, {Timestamp: hour + 1500, Value: 25}}
+	if fmt.Sprint(samples) != fmt.Sprint(want) {
+		t.Errorf("Expected running totals %v, got %v", want, samples)
+	}
+	if samples, _ := storage.History("counter", "PollCount", time.UnixMilli(1000), time.UnixMilli(hour)); len(samples) != 2 {
+		t.Errorf("Expected the range to be inclusive and bounded, got %v", samples)
+	}
+	if samples, _ := storage.History("gauge", "PollCount", time.UnixMilli(0), time.UnixMilli(2*hour)); len(samples) != 0 {
+		t.Errorf("Expected no gauge history, got %v", samples)
+	}
+
+	if err := storage.ResetCounter("PollCount"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	samples, _ = storage.History("counter", "PollCount", time.UnixMilli(0), time.Now())
+	if last := samples[len(samples)-1]; last.Value != 0 {
+		t.Errorf("Expected a reset to record 0, got %v", last)
+	}
+
+	storage.RenameMetric("gauge", "Alloc", "HeapAlloc")
+	if samples, _ := storage.History("gauge", "HeapAlloc", time.UnixMilli(0), time.UnixMilli(1000)); len(samples) != 1 {
+		t.Errorf("Expected history to follow a rename, got %v", samples)
+	}
+	storage.DeleteMetric("gauge", "HeapAlloc")
+	storage.UpdateMetricsBatch([]models.Metrics{{ID: "HeapAlloc", MType: "gauge", Value: &value, Timestamp: ts(3000)}})
+	if samples, _ := storage.History("gauge", "HeapAlloc", time.UnixMilli(0), time.UnixMilli(5000)); len(samples) != 1 {
+		t.Errorf("Expected a deleted metric to start a new history, got %v", samples)
+	}
+}
+
+func TestMemStorageCompact(t *testing.T) {
+	storage := NewMemStorage()
+	policy, err := ParseRetentionPolicy("raw=2m,1m=10m,5m=1h")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, s := range []models.Sample{{Timestamp: 0, Value: 10}, {Timestamp: 30000, Value: 20}, {Timestamp: 61000, Value: 30}, {Timestamp: 130000, Value: 40}, {Timestamp: 301000, Value: 50}} {
+		ts, value := s.Timestamp, s.Value
+		storage.UpdateMetricsBatch([]models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value, Timestamp: &ts}})
+	}
+
+	result, err := storage.Compact(policy, time.UnixMilli(360000))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result != (CompactResult{Rollups: 5, Expired: 4}) {
+		t.Errorf("Expected 5 rollups and 4 expired samples, got %+v", result)
+	}
+	rollups, _ := storage.Rollups("gauge", "Alloc", time.Minute, time.UnixMilli(0), time.UnixMilli(360000))
+	want := []models.Rollup{
+		{Timestamp: 0, Min: 10, Max: 20, Sum: 30, Count: 2},
+		{Timestamp: 60000, Min: 30, Max: 30, Sum: 30, Count: 1},
+		{Timestamp: 120000, Min: 40, Max: 40, Sum: 40, Count: 1},
+		{Timestamp: 300000, Min: 50, Max: 50, Sum: 50, Count: 1},
+	}
+	if fmt.Sprint(rollups) != fmt.Sprint(want) {
+		t.Errorf("Expected 1m rollups %v, got %v", want, rollups)
+	}
+	if samples, _ := storage.History("gauge", "Alloc", time.UnixMilli(0), time.UnixMilli(360000)); len(samples) != 1 {
+		t.Errorf("Expected only samples within the raw retention, got %v", samples)
+	}
+	if result, _ := storage.Compact(policy, time.UnixMilli(360000)); result != (CompactResult{}) {
+		t.Errorf("Expected a repeated compaction to do nothing, got %+v", result)
+	}
+
+	result, _ = storage.Compact(policy, time.UnixMilli(900000))
+	if result != (CompactResult{Rollups: 1, Expired: 4}) {
+		t.Errorf("Expected 1 rollup and 4 expired, got %+v", result)
+	}
+	rollups, _ = storage.Rollups("gauge", "Alloc", 5*time.Minute, time.UnixMilli(0), time.UnixMilli(900000))
+	want = []models.Rollup{
+		{Timestamp: 0, Min: 10, Max: 40, Sum: 100, Count: 4},
+		{Timestamp: 300000, Min: 50, Max: 50, Sum: 50, Count: 1},
+	}
+	if fmt.Sprint(rollups) != fmt.Sprint(want) {
+		t.Errorf("Expected 5m rollups %v, got %v", want, rollups)
+	}
+
+	storage.RenameMetric("gauge", "Alloc", "HeapAlloc")
+	if rollups, _ := storage.Rollups("gauge", "HeapAlloc", 5*time.Minute, time.UnixMilli(0), time.UnixMilli(900000)); len(rollups) != 2 {
+		t.Errorf("Expected rollups to follow a rename, got %v", rollups)
+	}
+	storage.DeleteMetric("gauge", "HeapAlloc")
+	if rollups, _ := storage.Rollups("gauge", "HeapAlloc", 5*time.Minute, time.UnixMilli(0), time.UnixMilli(900000)); len(rollups) != 0 {
+		t.Errorf("Expected rollups to be deleted with the metric, got %v", rollups)
+	}
+}
+
+func TestMemStorageConcurrentUpdates(t *testing.T) {
+	storage := NewShardedMemStorage(4)
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				storage.UpdateCounter(fmt.Sprintf("counter_%d", i%10), 1)
+				storage.UpdateGauge(fmt.Sprintf("gauge_%d", w), float64(i))
+				if i%100 == 0 {
+					storage.History("counter", "counter_0", time.UnixMilli(0), time.Now())
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			if err := storage.SaveMetricsToFile(path); err != nil {
+				t.Errorf("Expected no error saving, got %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	counters := storage.Counters()
+	for i := 0; i < 10; i++ {
+		if got := counters[fmt.Sprintf("counter_%d", i)]; got != 400 {
+			t.Errorf("Expected counter_%d to be 400, got %d", i, got)
+		}
+	}
+	if count, _ := storage.CountSeries(); count != 18 {
+		t.Errorf("Expected 18 series, got %d", count)
+	}
+
+	if err := storage.RenameMetric("gauge", "gauge_0", "gauge_renamed"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := storage.RenameMetric("gauge", "gauge_1", "gauge_renamed"); err != ErrMetricExists {
+		t.Errorf("Expected ErrMetricExists, got %v", err)
+	}
+	if value, err := storage.GetMetric("gauge", "gauge_renamed"); err != nil || value != "499.000000" {
+		t.Errorf("Expected the renamed gauge to keep its value, got %v (%v)", value, err)
+	}
+}
+
+func benchmarkMemStorageParallel(b *testing.B, update func(s *MemStorage, name string)) {
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("metric_%d", i)
+	}
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			storage := NewShardedMemStorage(shards)
+			var worker atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(worker.Add(1)) * 7919
+				for pb.Next() {
+					update(storage, names[i%len(names)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemStorageUpdateGauge(b *testing.B) {
+	benchmarkMemStorageParallel(b, func(s *MemStorage, name string) { s.UpdateGauge(name, 1) })
+}
+
+func BenchmarkMemStorageUpdateCounter(b *testing.B) {
+	benchmarkMemStorageParallel(b, func(s *MemStorage, name string) { s.UpdateCounter(name, 1) })
+}
+
+// BenchmarkMemStorageUpdateWhileSaving measures ingestion while the metrics
+// are saved to a file over and over.
+func BenchmarkMemStorageUpdateWhileSaving(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "metrics.json")
+	benchmarkMemStorageParallel(b, func(s *MemStorage, name string) {
+		if name == "metric_0" {
+			s.SaveMetricsToFile(path)
+			return
+		}
+		s.UpdateGauge(name, 1)
+	})
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBatchConn is a PostgresStorageConn that records the statements of
+// batch writes and waits latency on every round trip.
+type fakeBatchConn struct {
+	latency    time.Duration
+	roundTrips int
+	statements []fakeStatement
+}
+
+type fakeStatement struct {
+	query string
+	args  []interface{}
+}
+
+func (c *fakeBatchConn) roundTrip() {
+	c.roundTrips++
+	if c.latency > 0 {
+		time.Sleep(c.latency)
+	}
+}
+
+func (c *fakeBatchConn) Exec(ctx context.Context, query string, args ...interface{}) (pgconn.CommandTag, error) {
+	c.roundTrip()
+	c.statements = append(c.statements, fakeStatement{query, args})
+	return pgconn.CommandTag{}, nil
+}
+
+func (c *fakeBatchConn) Begin(ctx context.Context) (pgx.Tx, error) {
+	c.roundTrip()
+	return &fakeBatchTx{conn: c}, nil
+}
+
+func (c *fakeBatchConn) QueryRow(ctx context.Context, query string, args ...interface{}) pgx.Row {
+	return nil
+}
+
+func (c *fakeBatchConn) Query(ctx context.Context, query string, args ...interface{}) (pgx.Rows, error) {
+	return nil, nil
+}
+
+// fakeBatchTx sends the statements of a transaction to its fakeBatchConn.
+type fakeBatchTx struct {
+	MockTx
+	conn *fakeBatchConn
+}
+
+func (tx *fakeBatchTx) Exec(ctx context.Context, query string, args ...interface{}) (pgconn.CommandTag, error) {
+	return tx.conn.Exec(ctx, query, args...)
+}
+
+func (tx *fakeBatchTx) Commit(ctx context.Context) error {
+	tx.conn.roundTrip()
+	return nil
+}
+
+func TestAggregateBatch(t *testing.T) {
+	ts := func(v int64) *int64 { return &v }
+	value := func(v float64) *float64 { return &v }
+	delta := func(v int64) *int64 { return &v }
+
+	cols := aggregateBatch([]models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: value(2), Timestamp: ts(2000)},
+		{ID: "Alloc", MType: "gauge", Value: value(1), Timestamp: ts(1000)},
+		{ID: "Alloc", MType: "gauge", Value: value(3), Timestamp: ts(2000)},
+		{ID: "PollCount", MType: "counter", Delta: delta(5), Timestamp: ts(3000)},
+		{ID: "PollCount", MType: "counter", Delta: delta(7), Timestamp: ts(1000)},
+		{ID: `Heap{host="a"}`, MType: "gauge", Value: value(1), Timestamp: ts(1000), Meta: &models.Metadata{Unit: "bytes"}},
+		{ID: `Heap{host="b"}`, MType: "gauge", Value: value(1), Timestamp: ts(1000), Meta: &models.Metadata{Owner: "runtime"}},
+		{ID: "Empty", MType: "gauge", Meta: &models.Metadata{Unit: "ignored"}},
+		{ID: "Summary", MType: "summary", Value: value(1)},
+	})
+
+	assert.Equal(t, []string{"Alloc", `Heap{host="a"}`, `Heap{host="b"}`}, cols.gaugeNames)
+	assert.Equal(t, []float64{3, 1, 1}, cols.gaugeValues, "the later of equally new gauge samples wins")
+	assert.Equal(t, []int64{2000, 1000, 1000}, cols.gaugeTimes)
+	assert.Equal(t, []string{"PollCount"}, cols.counterNames)
+	assert.Equal(t, []int64{12}, cols.counterDeltas)
+	assert.Equal(t, []int64{3000}, cols.counterTimes)
+	assert.Equal(t, []string{"Heap"}, cols.metaNames)
+	assert.Equal(t, []string{"bytes"}, cols.metaUnits)
+	assert.Equal(t, []string{"runtime"}, cols.metaOwners)
+}
+
+func TestUpdateMetricsBatchRoundTrips(t *testing.T) {
+	conn := &fakeBatchConn{}
+	storage := NewPostgresStorage(conn)
+
+	assert.NoError(t, storage.UpdateMetricsBatch(benchmarkBatch(1000)))
+	assert.Equal(t, 4, conn.roundTrips, "begin, gauges, counters and commit")
+	if assert.Len(t, conn.statements, 2) {
+		assert.Contains(t, conn.statements[0].query, "INSERT INTO gauge_metrics")
+		assert.Len(t, conn.statements[0].args[0], 250, "one row per gauge")
+		assert.Contains(t, conn.statements[1].query, "INSERT INTO counter_metrics")
+		assert.Len(t, conn.statements[1].args[0], 250, "one row per counter")
+	}
+
+	conn.statements = nil
+	assert.NoError(t, storage.UpdateMetricsBatch([]models.Metrics{{ID: "Empty", MType: "gauge"}}))
+	assert.Empty(t, conn.statements, "nothing to write")
+}
+
+// benchmarkBatch returns n metrics, half gauges and half counters, with
+// every series reported twice.
+func benchmarkBatch(n int) []models.Metrics {
+	metrics := make([]models.Metrics, n)
+	for i := range metrics {
+		value, delta := float64(i), int64(1)
+		if i%2 == 0 {
+			metrics[i] = models.Metrics{ID: fmt.Sprintf("gauge_%d", i/4), MType: "gauge", Value: &value}
+		} else {
+			metrics[i] = models.Metrics{ID: fmt.Sprintf("counter_%d", i/4), MType: "counter", Delta: &delta}
+		}
+	}
+	return metrics
+}
+
+// BenchmarkUpdateMetricsBatch writes batches over a connection with a
+// simulated network latency, where the number of round trips dominates.
+func BenchmarkUpdateMetricsBatch(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("metrics=%d", n), func(b *testing.B) {
+			conn := &fakeBatchConn{latency: 100 * time.Microsecond}
+			storage := NewPostgresStorage(conn)
+			metrics := benchmarkBatch(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn.statements = conn.statements[:0]
+				if err := storage.UpdateMetricsBatch(metrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(conn.roundTrips)/float64(b.N), "round-trips/op")
+		})
+	}
+}
+
+func BenchmarkAggregateBatch(b *testing.B) {
+	metrics := benchmarkBatch(1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cols := aggregateBatch(metrics)
+		if len(cols.gaugeNames) == 0 || strings.HasPrefix(cols.gaugeNames[0], "counter") {
+			b.Fatal("unexpected aggregation")
+		}
+	}
+}
+
+func TestUpdateCounterAddsDelta(t *testing.T) {
+	conn := &fakeBatchConn{}
+	NewPostgresStorage(conn).UpdateCounter("PollCount", 3)
+
+	if assert.Len(t, conn.statements, 1) {
+		assert.Equal(t, addCountersQuery, conn.statements[0].query, "counters add to the stored total")
+		assert.Equal(t, []string{"PollCount"}, conn.statements[0].args[0])
+		assert.Equal(t, []int64{3}, conn.statements[0].args[1])
+	}
+}
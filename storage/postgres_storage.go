@@ -3,6 +3,10 @@ package storage
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/hairutdin/metrics-service/internal/middleware"
 	"github.com/hairutdin/metrics-service/models"
@@ -27,26 +31,16 @@ func NewPostgresStorage(conn PostgresStorageConn) *PostgresStorage {
 }
 
 func (s *PostgresStorage) UpdateGauge(name string, value float64) {
-	query := `
-		INSERT INTO gauge_metrics (name, value)
-		VALUES ($1, $2)
-		ON CONFLICT (name)
-		DO UPDATE SET value = EXCLUDED.value;
-	`
-
-	_, err := s.DB.Exec(context.Background(), query, name, value)
+	_, err := s.DB.Exec(context.Background(), upsertGaugesQuery,
+		[]string{name}, []float64{value}, []int64{time.Now().UnixMilli()})
 	if err != nil {
 		fmt.Printf("Error updating gauge metric: %v\n", err)
 	}
 }
 
 func (s *PostgresStorage) UpdateCounter(name string, delta int64) {
-	query := `
-		INSERT INTO counter_metrics (name, value)
-		VALUES ($1, $2)
-		ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value;
-	`
-	_, err := s.DB.Exec(context.Background(), query, name, delta)
+	_, err := s.DB.Exec(context.Background(), addCountersQuery,
+		[]string{name}, []int64{delta}, []int64{time.Now().UnixMilli()})
 	if err != nil {
 		fmt.Printf("Error updating counter metric: %v\n", err)
 	}
@@ -60,30 +54,230 @@ func (s *PostgresStorage) UpdateMetricsBatch(metrics []models.Metrics) error {
 		}
 		defer tx.Rollback(context.Background())
 
-		for _, metric := range metrics {
-			if metric.MType == "gauge" && metric.Value != nil {
-				_, err := tx.Exec(context.Background(),
-					`INSERT INTO gauge_metrics (name, value) VALUES ($1, $2)
-					ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value`, metric.ID, *metric.Value)
-				if err != nil {
-					return err
-				}
-			} else if metric.MType == "counter" && metric.Delta != nil {
-				_, err := tx.Exec(context.Background(),
-					`INSERT INTO counter_metrics (name, value) VALUES ($1, $2)
-					ON CONFLICT (name) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value`, metric.ID, *metric.Delta)
-				if err != nil {
-					return err
-				}
-			}
+		if err := applyBatch(tx, metrics); err != nil {
+			return err
 		}
-
 		return tx.Commit(context.Background())
 	}
 
 	return middleware.RetryOperation(operation)
 }
 
+// UpdateMetricsBatchOnce records the key in the same transaction as the
+// metrics, so either both are stored or neither is. Expired keys are purged
+// along the way.
+func (s *PostgresStorage) UpdateMetricsBatchOnce(key string, metrics []models.Metrics, ttl time.Duration) (bool, error) {
+	var applied bool
+	operation := func() error {
+		tx, err := s.DB.Begin(context.Background())
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(context.Background())
+
+		_, err = tx.Exec(context.Background(), "DELETE FROM idempotency_keys WHERE expires_at < now()")
+		if err != nil {
+			return err
+		}
+		tag, err := tx.Exec(context.Background(),
+			`INSERT INTO idempotency_keys (key, expires_at) VALUES ($1, now() + make_interval(secs => $2))
+			ON CONFLICT (key) DO NOTHING`, key, ttl.Seconds())
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			applied = false
+			return nil
+		}
+
+		if err := applyBatch(tx, metrics); err != nil {
+			return err
+		}
+		if err := tx.Commit(context.Background()); err != nil {
+			return err
+		}
+		applied = true
+		return nil
+	}
+
+	err := middleware.RetryOperation(operation)
+	return applied, err
+}
+
+// sampleConflictClause ends the inserts into metric_samples: a sample with
+// the timestamp of an existing one replaces it.
+const sampleConflictClause = `
+	ON CONFLICT (type, name, ts) DO UPDATE SET value = EXCLUDED.value`
+
+// upsertGaugesQuery implements last-write-wins for the gauges given as
+// arrays of names, values and timestamps: an existing gauge is only
+// overwritten by a sample that is at least as new. Names must be unique.
+// Applied updates are recorded in metric_samples.
+const upsertGaugesQuery = `
+	WITH stored AS (
+		INSERT INTO gauge_metrics (name, value, ts)
+		SELECT * FROM UNNEST($1::TEXT[], $2::DOUBLE PRECISION[], $3::BIGINT[])
+		ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value, ts = EXCLUDED.ts
+		WHERE gauge_metrics.ts IS NULL OR gauge_metrics.ts <= EXCLUDED.ts
+		RETURNING name, value, ts)
+	INSERT INTO metric_samples (type, name, ts, value) SELECT 'gauge', name, ts, value FROM stored` +
+	sampleConflictClause
+
+// addCountersQuery applies the increments given as arrays of names, deltas
+// and timestamps and keeps the latest timestamp. Names must be unique. The
+// new running totals are recorded in metric_samples.
+const addCountersQuery = `
+	WITH stored AS (
+		INSERT INTO counter_metrics (name, value, ts)
+		SELECT * FROM UNNEST($1::TEXT[], $2::BIGINT[], $3::BIGINT[])
+		ON CONFLICT (name) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value,
+			ts = GREATEST(counter_metrics.ts, EXCLUDED.ts)
+		RETURNING name, value, ts)
+	INSERT INTO metric_samples (type, name, ts, value) SELECT 'counter', name, ts, value FROM stored` +
+	sampleConflictClause
+
+// mergeMetadataQuery applies the non-empty fields of inline metadata, given
+// as arrays of names, types, units, descriptions and owners, and skips the
+// writes that would change nothing. Name and type pairs must be unique.
+const mergeMetadataQuery = `
+	INSERT INTO metric_metadata (name, type, unit, description, owner)
+	SELECT * FROM UNNEST($1::TEXT[], $2::TEXT[], $3::TEXT[], $4::TEXT[], $5::TEXT[])
+	ON CONFLICT (name, type) DO UPDATE SET
+		unit = COALESCE(NULLIF(EXCLUDED.unit, ''), metric_metadata.unit),
+		description = COALESCE(NULLIF(EXCLUDED.description, ''), metric_metadata.description),
+		owner = COALESCE(NULLIF(EXCLUDED.owner, ''), metric_metadata.owner)
+	WHERE (metric_metadata.unit, metric_metadata.description, metric_metadata.owner) IS DISTINCT FROM
+		(COALESCE(NULLIF(EXCLUDED.unit, ''), metric_metadata.unit),
+		COALESCE(NULLIF(EXCLUDED.description, ''), metric_metadata.description),
+		COALESCE(NULLIF(EXCLUDED.owner, ''), metric_metadata.owner))`
+
+// batchColumns is a batch reduced to one row per series, as the columns of
+// the array parameters of the upsert queries. Rows are sorted by name so
+// that concurrent batches lock rows in the same order.
+type batchColumns struct {
+	gaugeNames  []string
+	gaugeValues []float64
+	gaugeTimes  []int64
+
+	counterNames  []string
+	counterDeltas []int64
+	counterTimes  []int64
+
+	metaNames, metaTypes                    []string
+	metaUnits, metaDescriptions, metaOwners []string
+}
+
+// aggregateBatch pre-aggregates a batch: of several samples of a gauge the
+// newest wins, and the later one of equally new samples; the increments of
+// a counter are summed and stamped with their latest timestamp; inline
+// metadata of a name is merged in order. Metrics without a value are
+// skipped.
+func aggregateBatch(metrics []models.Metrics) batchColumns {
+	type gauge struct {
+		value float64
+		ts    int64
+	}
+	type counter struct {
+		delta, ts int64
+	}
+	gauges := make(map[string]gauge)
+	counters := make(map[string]counter)
+	metadata := make(map[metadataKey]models.Metadata)
+
+	now := time.Now().UnixMilli()
+	for _, metric := range metrics {
+		ts := now
+		if metric.Timestamp != nil {
+			ts = *metric.Timestamp
+		}
+		switch {
+		case metric.MType == "gauge" && metric.Value != nil:
+			if last, exists := gauges[metric.ID]; !exists || ts >= last.ts {
+				gauges[metric.ID] = gauge{*metric.Value, ts}
+			}
+		case metric.MType == "counter" && metric.Delta != nil:
+			c, exists := counters[metric.ID]
+			c.delta += *metric.Delta
+			if !exists || ts > c.ts {
+				c.ts = ts
+			}
+			counters[metric.ID] = c
+		default:
+			continue
+		}
+		if metric.Meta != nil && !metric.Meta.IsZero() {
+			key := metadataKey{metric.MType, models.MetadataName(metric.ID)}
+			metadata[key] = metadata[key].Merge(*metric.Meta)
+		}
+	}
+
+	var cols batchColumns
+	for _, name := range sortedKeys(gauges) {
+		cols.gaugeNames = append(cols.gaugeNames, name)
+		cols.gaugeValues = append(cols.gaugeValues, gauges[name].value)
+		cols.gaugeTimes = append(cols.gaugeTimes, gauges[name].ts)
+	}
+	for _, name := range sortedKeys(counters) {
+		cols.counterNames = append(cols.counterNames, name)
+		cols.counterDeltas = append(cols.counterDeltas, counters[name].delta)
+		cols.counterTimes = append(cols.counterTimes, counters[name].ts)
+	}
+	keys := make([]metadataKey, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].mtype < keys[j].mtype
+	})
+	for _, key := range keys {
+		md := metadata[key]
+		cols.metaNames = append(cols.metaNames, key.name)
+		cols.metaTypes = append(cols.metaTypes, key.mtype)
+		cols.metaUnits = append(cols.metaUnits, md.Unit)
+		cols.metaDescriptions = append(cols.metaDescriptions, md.Description)
+		cols.metaOwners = append(cols.metaOwners, md.Owner)
+	}
+	return cols
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// applyBatch writes a pre-aggregated batch with at most three statements,
+// one each for gauges, counters and metadata, however large the batch is.
+func applyBatch(tx pgx.Tx, metrics []models.Metrics) error {
+	cols := aggregateBatch(metrics)
+	if len(cols.gaugeNames) > 0 {
+		_, err := tx.Exec(context.Background(), upsertGaugesQuery, cols.gaugeNames, cols.gaugeValues, cols.gaugeTimes)
+		if err != nil {
+			return err
+		}
+	}
+	if len(cols.counterNames) > 0 {
+		_, err := tx.Exec(context.Background(), addCountersQuery, cols.counterNames, cols.counterDeltas, cols.counterTimes)
+		if err != nil {
+			return err
+		}
+	}
+	if len(cols.metaNames) > 0 {
+		_, err := tx.Exec(context.Background(), mergeMetadataQuery,
+			cols.metaNames, cols.metaTypes, cols.metaUnits, cols.metaDescriptions, cols.metaOwners)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *PostgresStorage) GetMetric(metricType, name string) (string, error) {
 	var query string
 	var result string
@@ -105,6 +299,554 @@ func (s *PostgresStorage) GetMetric(metricType, name string) (string, error) {
 	return result, nil
 }
 
+// GetMetrics runs one query per metric type and returns the results in the
+// order of keys.
+func (s *PostgresStorage) GetMetrics(keys []models.Metrics) ([]models.Metrics, error) {
+	var gaugeNames, counterNames []string
+	for _, key := range keys {
+		switch key.MType {
+		case "gauge":
+			gaugeNames = append(gaugeNames, key.ID)
+		case "counter":
+			counterNames = append(counterNames, key.ID)
+		}
+	}
+
+	gauges := make(map[string]models.Metrics)
+	if len(gaugeNames) > 0 {
+		rows, err := s.DB.Query(context.Background(),
+			"SELECT name, value, ts FROM gauge_metrics WHERE name = ANY($1)", gaugeNames)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query gauges: %w", err)
+		}
+		for rows.Next() {
+			m := models.Metrics{MType: "gauge"}
+			if err := rows.Scan(&m.ID, &m.Value, &m.Timestamp); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan gauge: %w", err)
+			}
+			gauges[m.ID] = m
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to query gauges: %w", err)
+		}
+	}
+
+	counters := make(map[string]models.Metrics)
+	if len(counterNames) > 0 {
+		rows, err := s.DB.Query(context.Background(),
+			"SELECT name, value, ts FROM counter_metrics WHERE name = ANY($1)", counterNames)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query counters: %w", err)
+		}
+		for rows.Next() {
+			m := models.Metrics{MType: "counter"}
+			if err := rows.Scan(&m.ID, &m.Delta, &m.Timestamp); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan counter: %w", err)
+			}
+			counters[m.ID] = m
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to query counters: %w", err)
+		}
+	}
+
+	found := make([]models.Metrics, 0, len(gauges)+len(counters))
+	for _, key := range keys {
+		switch key.MType {
+		case "gauge":
+			if m, exists := gauges[key.ID]; exists {
+				found = append(found, m)
+			}
+		case "counter":
+			if m, exists := counters[key.ID]; exists {
+				found = append(found, m)
+			}
+		}
+	}
+	return found, nil
+}
+
+func (s *PostgresStorage) Snapshot() ([]models.Metrics, error) {
+	rows, err := s.DB.Query(context.Background(), `
+		SELECT name, 'gauge', value, NULL::BIGINT, ts FROM gauge_metrics
+		UNION ALL
+		SELECT name, 'counter', NULL::DOUBLE PRECISION, value, ts FROM counter_metrics
+		ORDER BY 1, 2`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metrics: %w", err)
+	}
+	defer rows.Close()
+
+	var metrics []models.Metrics
+	for rows.Next() {
+		var m models.Metrics
+		if err := rows.Scan(&m.ID, &m.MType, &m.Value, &m.Delta, &m.Timestamp); err != nil {
+			return nil, fmt.Errorf("failed to scan metric: %w", err)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, rows.Err()
+}
+
+// ListMetrics filters, orders and pages in SQL so only the requested page
+// leaves the database. Regex filters use PostgreSQL's ~ operator, which
+// agrees with Go's RE2 syntax for ordinary patterns.
+func (s *PostgresStorage) ListMetrics(query ListQuery) (ListResult, error) {
+	_, cursor, err := query.normalize()
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	var sources []string
+	if query.Type == "" || query.Type == "gauge" {
+		sources = append(sources, `SELECT name, 'gauge' AS mtype, value AS fvalue, NULL::BIGINT AS ivalue, ts FROM gauge_metrics`)
+	}
+	if query.Type == "" || query.Type == "counter" {
+		sources = append(sources, `SELECT name, 'counter', value::DOUBLE PRECISION, value, ts FROM counter_metrics`)
+	}
+	from := "(" + strings.Join(sources, " UNION ALL ") + ") m"
+
+	var where []string
+	var args []interface{}
+	if query.Prefix != "" {
+		args = append(args, escapeLike(query.Prefix)+"%")
+		where = append(where, fmt.Sprintf("name LIKE $%d", len(args)))
+	}
+	if query.Regex != "" {
+		args = append(args, query.Regex)
+		where = append(where, fmt.Sprintf("name ~ $%d", len(args)))
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var result ListResult
+	err = s.DB.QueryRow(context.Background(), "SELECT COUNT(*) FROM "+from+filter, args...).Scan(&result.Total)
+	if err != nil {
+		return ListResult{}, fmt.Errorf("failed to count metrics: %w", err)
+	}
+
+	dir, op := "ASC", ">"
+	if query.Desc {
+		dir, op = "DESC", "<"
+	}
+	order := fmt.Sprintf("name %[1]s, mtype %[1]s", dir)
+	if query.SortBy == SortByValue {
+		order = fmt.Sprintf("fvalue %[1]s, name %[1]s, mtype %[1]s", dir)
+	}
+
+	if cursor != nil {
+		if query.SortBy == SortByValue {
+			args = append(args, cursor.value(), cursor.Name, cursor.Type)
+			where = append(where, fmt.Sprintf("(fvalue, name, mtype) %s ($%d, $%d, $%d)", op, len(args)-2, len(args)-1, len(args)))
+		} else {
+			args = append(args, cursor.Name, cursor.Type)
+			where = append(where, fmt.Sprintf("(name, mtype) %s ($%d, $%d)", op, len(args)-1, len(args)))
+		}
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	// One extra row tells whether another page follows.
+	args = append(args, query.Limit+1)
+	rows, err := s.DB.Query(context.Background(), fmt.Sprintf(
+		"SELECT name, mtype, fvalue, ivalue, ts FROM %s%s ORDER BY %s LIMIT $%d", from, filter, order, len(args)), args...)
+	if err != nil {
+		return ListResult{}, fmt.Errorf("failed to list metrics: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m models.Metrics
+		var fvalue *float64
+		if err := rows.Scan(&m.ID, &m.MType, &fvalue, &m.Delta, &m.Timestamp); err != nil {
+			return ListResult{}, fmt.Errorf("failed to scan metric: %w", err)
+		}
+		if m.MType == "gauge" {
+			m.Value = fvalue
+		}
+		result.Metrics = append(result.Metrics, m)
+	}
+	if err := rows.Err(); err != nil {
+		return ListResult{}, fmt.Errorf("failed to list metrics: %w", err)
+	}
+
+	if len(result.Metrics) > query.Limit {
+		result.Metrics = result.Metrics[:query.Limit]
+		result.NextCursor = encodeCursor(query.SortBy, result.Metrics[query.Limit-1])
+	}
+	return result, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (s *PostgresStorage) DeleteMetric(metricType, name string) error {
+	var table string
+	switch metricType {
+	case "gauge":
+		table = "gauge_metrics"
+	case "counter":
+		table = "counter_metrics"
+	default:
+		return fmt.Errorf("invalid metric type: %s", metricType)
+	}
+
+	var deleted int
+	err := s.DB.QueryRow(context.Background(), `
+		WITH deleted AS (DELETE FROM `+table+` WHERE name = $1 RETURNING name),
+		samples AS (DELETE FROM metric_samples WHERE type = $2 AND name IN (SELECT name FROM deleted)),
+		rollups AS (DELETE FROM metric_rollups WHERE type = $2 AND name IN (SELECT name FROM deleted))
+		SELECT count(*) FROM deleted`, name, metricType).Scan(&deleted)
+	if err != nil {
+		return fmt.Errorf("failed to delete metric: %w", err)
+	}
+	if deleted == 0 {
+		return ErrMetricNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) CountSeries() (int, error) {
+	var count int
+	err := s.DB.QueryRow(context.Background(),
+		"SELECT (SELECT count(*) FROM gauge_metrics) + (SELECT count(*) FROM counter_metrics)").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count series: %w", err)
+	}
+	return count, nil
+}
+
+func (s *PostgresStorage) DeleteStaleGauges(before time.Time) ([]models.Metrics, error) {
+	rows, err := s.DB.Query(context.Background(), `
+		WITH deleted AS (DELETE FROM gauge_metrics WHERE ts < $1 RETURNING name),
+		samples AS (DELETE FROM metric_samples WHERE type = 'gauge' AND name IN (SELECT name FROM deleted)),
+		rollups AS (DELETE FROM metric_rollups WHERE type = 'gauge' AND name IN (SELECT name FROM deleted))
+		SELECT name FROM deleted`, before.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete stale gauges: %w", err)
+	}
+	defer rows.Close()
+
+	var deleted []models.Metrics
+	for rows.Next() {
+		m := models.Metrics{MType: "gauge"}
+		if err := rows.Scan(&m.ID); err != nil {
+			return nil, fmt.Errorf("failed to scan gauge: %w", err)
+		}
+		deleted = append(deleted, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to delete stale gauges: %w", err)
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].ID < deleted[j].ID })
+	return deleted, nil
+}
+
+func (s *PostgresStorage) SetMetadata(metricType string, name string, md models.Metadata) error {
+	_, err := s.DB.Exec(context.Background(), `
+		INSERT INTO metric_metadata (name, type, unit, description, owner) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (name, type) DO UPDATE SET
+			unit = EXCLUDED.unit, description = EXCLUDED.description, owner = EXCLUDED.owner`,
+		name, metricType, md.Unit, md.Description, md.Owner)
+	if err != nil {
+		return fmt.Errorf("failed to set metadata: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) DeleteMetadata(metricType string, name string) error {
+	tag, err := s.DB.Exec(context.Background(),
+		"DELETE FROM metric_metadata WHERE name = $1 AND type = $2", name, metricType)
+	if err != nil {
+		return fmt.Errorf("failed to delete metadata: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrMetricNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) ListMetadata() ([]models.MetricMetadata, error) {
+	rows, err := s.DB.Query(context.Background(),
+		"SELECT name, type, unit, description, owner FROM metric_metadata ORDER BY name, type")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metadata: %w", err)
+	}
+	defer rows.Close()
+
+	list := []models.MetricMetadata{}
+	for rows.Next() {
+		var md models.MetricMetadata
+		if err := rows.Scan(&md.Name, &md.Type, &md.Unit, &md.Description, &md.Owner); err != nil {
+			return nil, fmt.Errorf("failed to scan metadata: %w", err)
+		}
+		list = append(list, md)
+	}
+	return list, rows.Err()
+}
+
+// DeleteMatching matches with PostgreSQL's ~ operator, like ListMetrics.
+func (s *PostgresStorage) DeleteMatching(metricType string, pattern string) ([]models.Metrics, error) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+
+	tx, err := s.DB.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	var deleted []models.Metrics
+	for _, t := range []struct{ mtype, table string }{
+		{"gauge", "gauge_metrics"},
+		{"counter", "counter_metrics"},
+	} {
+		if metricType != "" && metricType != t.mtype {
+			continue
+		}
+		rows, err := tx.Query(context.Background(), `
+			WITH deleted AS (DELETE FROM `+t.table+` WHERE name ~ $1 RETURNING name),
+			samples AS (DELETE FROM metric_samples WHERE type = $2 AND name IN (SELECT name FROM deleted)),
+			rollups AS (DELETE FROM metric_rollups WHERE type = $2 AND name IN (SELECT name FROM deleted))
+			SELECT name FROM deleted`, pattern, t.mtype)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete metrics: %w", err)
+		}
+		for rows.Next() {
+			m := models.Metrics{MType: t.mtype}
+			if err := rows.Scan(&m.ID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan metric: %w", err)
+			}
+			deleted = append(deleted, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to delete metrics: %w", err)
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to commit deletion: %w", err)
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		if deleted[i].ID != deleted[j].ID {
+			return deleted[i].ID < deleted[j].ID
+		}
+		return deleted[i].MType < deleted[j].MType
+	})
+	return deleted, nil
+}
+
+func (s *PostgresStorage) ResetCounter(name string) error {
+	tag, err := s.DB.Exec(context.Background(), `
+		WITH stored AS (UPDATE counter_metrics SET value = 0, ts = $2 WHERE name = $1 RETURNING name, ts)
+		INSERT INTO metric_samples (type, name, ts, value) SELECT 'counter', name, ts, 0 FROM stored`+
+		sampleConflictClause, name, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to reset counter: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrMetricNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) RenameMetric(metricType string, oldName string, newName string) error {
+	var table string
+	switch metricType {
+	case "gauge":
+		table = "gauge_metrics"
+	case "counter":
+		table = "counter_metrics"
+	default:
+		return ErrMetricNotFound
+	}
+
+	tx, err := s.DB.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	var taken bool
+	err = tx.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM "+table+" WHERE name = $1)", newName).Scan(&taken)
+	if err != nil {
+		return fmt.Errorf("failed to rename metric: %w", err)
+	}
+	if taken {
+		return ErrMetricExists
+	}
+
+	tag, err := tx.Exec(context.Background(), "UPDATE "+table+" SET name = $2 WHERE name = $1", oldName, newName)
+	if err != nil {
+		return fmt.Errorf("failed to rename metric: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrMetricNotFound
+	}
+	for _, history := range []string{"metric_samples", "metric_rollups"} {
+		_, err = tx.Exec(context.Background(),
+			"UPDATE "+history+" SET name = $2 WHERE type = $3 AND name = $1", oldName, newName, metricType)
+		if err != nil {
+			return fmt.Errorf("failed to rename metric history: %w", err)
+		}
+	}
+	return tx.Commit(context.Background())
+}
+
+func (s *PostgresStorage) History(metricType string, id string, from, to time.Time) ([]models.Sample, error) {
+	rows, err := s.DB.Query(context.Background(), `
+		SELECT ts, value FROM metric_samples
+		WHERE type = $1 AND name = $2 AND ts BETWEEN $3 AND $4 ORDER BY ts`,
+		metricType, id, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %w", err)
+	}
+	defer rows.Close()
+
+	var samples []models.Sample
+	for rows.Next() {
+		var sample models.Sample
+		if err := rows.Scan(&sample.Timestamp, &sample.Value); err != nil {
+			return nil, fmt.Errorf("failed to scan sample: %w", err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, rows.Err()
+}
+
+func (s *PostgresStorage) Rollups(metricType string, id string, step time.Duration, from, to time.Time) ([]models.Rollup, error) {
+	rows, err := s.DB.Query(context.Background(), `
+		SELECT ts, min, max, sum, count FROM metric_rollups
+		WHERE type = $1 AND name = $2 AND step = $3 AND ts BETWEEN $4 AND $5 ORDER BY ts`,
+		metricType, id, step.Milliseconds(), from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rollups: %w", err)
+	}
+	defer rows.Close()
+
+	var rollups []models.Rollup
+	for rows.Next() {
+		var r models.Rollup
+		if err := rows.Scan(&r.Timestamp, &r.Min, &r.Max, &r.Sum, &r.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan rollup: %w", err)
+		}
+		rollups = append(rollups, r)
+	}
+	return rollups, rows.Err()
+}
+
+// rollupSamplesQuery builds the rollups of step $1 from the raw samples in
+// [$2, $3), and rollupRollupsQuery builds them from the rollups of the finer
+// step $4. Both replace buckets that already exist.
+const (
+	rollupSamplesQuery = `
+		INSERT INTO metric_rollups (type, name, step, ts, min, max, sum, count)
+		SELECT type, name, $1, bucket, min(value), max(value), sum(value), count(*)
+		FROM (SELECT type, name, ts - ts % $1::BIGINT AS bucket, value FROM metric_samples
+			WHERE ts >= $2 AND ts < $3) AS samples
+		GROUP BY type, name, bucket` + rollupConflictClause
+	rollupRollupsQuery = `
+		INSERT INTO metric_rollups (type, name, step, ts, min, max, sum, count)
+		SELECT type, name, $1, bucket, min(min), max(max), sum(sum), sum(count)::BIGINT
+		FROM (SELECT type, name, ts - ts % $1::BIGINT AS bucket, min, max, sum, count FROM metric_rollups
+			WHERE step = $4 AND ts >= $2 AND ts < $3) AS rollups
+		GROUP BY type, name, bucket` + rollupConflictClause
+	rollupConflictClause = `
+		ON CONFLICT (type, name, step, ts) DO UPDATE SET
+			min = EXCLUDED.min, max = EXCLUDED.max, sum = EXCLUDED.sum, count = EXCLUDED.count`
+)
+
+// Compact builds every rollup level in one transaction, the first from raw
+// samples and every further level from the one before it. The watermark of
+// each level is kept in rollup_watermarks.
+func (s *PostgresStorage) Compact(policy RetentionPolicy, now time.Time) (CompactResult, error) {
+	if err := policy.Validate(); err != nil {
+		return CompactResult{}, err
+	}
+
+	tx, err := s.DB.Begin(context.Background())
+	if err != nil {
+		return CompactResult{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	watermarks := make(map[time.Duration]int64)
+	rows, err := tx.Query(context.Background(), "SELECT step, ts FROM rollup_watermarks")
+	if err != nil {
+		return CompactResult{}, fmt.Errorf("failed to read watermarks: %w", err)
+	}
+	for rows.Next() {
+		var step, ts int64
+		if err := rows.Scan(&step, &ts); err != nil {
+			rows.Close()
+			return CompactResult{}, fmt.Errorf("failed to scan watermark: %w", err)
+		}
+		watermarks[time.Duration(step)*time.Millisecond] = ts
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return CompactResult{}, fmt.Errorf("failed to read watermarks: %w", err)
+	}
+
+	var result CompactResult
+	for level := 1; level < len(policy); level++ {
+		step, finer := policy[level].Step, policy[level-1].Step
+		from, to := compactionWindow(watermarks[step], step, now)
+		if to <= from {
+			continue
+		}
+		var tag pgconn.CommandTag
+		if finer == 0 {
+			tag, err = tx.Exec(context.Background(), rollupSamplesQuery, step.Milliseconds(), from, to)
+		} else {
+			tag, err = tx.Exec(context.Background(), rollupRollupsQuery, step.Milliseconds(), from, to, finer.Milliseconds())
+		}
+		if err != nil {
+			return CompactResult{}, fmt.Errorf("failed to build %s rollups: %w", policy[level].Name(), err)
+		}
+		result.Rollups += int(tag.RowsAffected())
+
+		_, err = tx.Exec(context.Background(), `
+			INSERT INTO rollup_watermarks (step, ts) VALUES ($1, $2)
+			ON CONFLICT (step) DO UPDATE SET ts = EXCLUDED.ts`, step.Milliseconds(), to)
+		if err != nil {
+			return CompactResult{}, fmt.Errorf("failed to update watermark: %w", err)
+		}
+		watermarks[step] = to
+	}
+
+	tag, err := tx.Exec(context.Background(), "DELETE FROM metric_samples WHERE ts < $1",
+		expiryCutoff(policy, 0, watermarks, now))
+	if err != nil {
+		return CompactResult{}, fmt.Errorf("failed to expire samples: %w", err)
+	}
+	result.Expired += int(tag.RowsAffected())
+	for level := 1; level < len(policy); level++ {
+		tag, err := tx.Exec(context.Background(), "DELETE FROM metric_rollups WHERE step = $1 AND ts < $2",
+			policy[level].Step.Milliseconds(), expiryCutoff(policy, level, watermarks, now))
+		if err != nil {
+			return CompactResult{}, fmt.Errorf("failed to expire rollups: %w", err)
+		}
+		result.Expired += int(tag.RowsAffected())
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return CompactResult{}, fmt.Errorf("failed to commit compaction: %w", err)
+	}
+	return result, nil
+}
+
 func (s *PostgresStorage) GetAllMetrics() map[string]string {
 	metrics := make(map[string]string)
 
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+// Resolution is one level of stored history: raw samples when Step is zero,
+// otherwise rollups of Step-long buckets. Data older than Retention is
+// deleted by compaction.
+type Resolution struct {
+	Step      time.Duration
+	Retention time.Duration
+}
+
+// Name is "raw" for raw samples and the step, e.g. "1m", for rollups.
+func (r Resolution) Name() string {
+	if r.Step == 0 {
+		return "raw"
+	}
+	return formatRetentionDuration(r.Step)
+}
+
+// RetentionPolicy lists the resolutions of stored history from raw samples
+// to the coarsest rollups. Each level is built from the one before it, so
+// every step must be a multiple of the previous step.
+type RetentionPolicy []Resolution
+
+// DefaultRetentionPolicy keeps raw samples for a day, 1-minute rollups for
+// 30 days and 1-hour rollups for a year.
+func DefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{
+		{Step: 0, Retention: 24 * time.Hour},
+		{Step: time.Minute, Retention: 30 * 24 * time.Hour},
+		{Step: time.Hour, Retention: 365 * 24 * time.Hour},
+	}
+}
+
+// ParseRetentionPolicy reads a policy written as comma-separated
+// resolution=retention pairs, e.g. "raw=24h,1m=30d,1h=365d". Durations
+// accept the d (day) unit in addition to Go's.
+func ParseRetentionPolicy(s string) (RetentionPolicy, error) {
+	var policy RetentionPolicy
+	for _, part := range strings.Split(s, ",") {
+		name, retention, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid retention %q, expected resolution=duration", part)
+		}
+		var r Resolution
+		var err error
+		if name != "raw" {
+			if r.Step, err = parseRetentionDuration(name); err != nil {
+				return nil, err
+			}
+		}
+		if r.Retention, err = parseRetentionDuration(retention); err != nil {
+			return nil, err
+		}
+		policy = append(policy, r)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks that the policy starts with raw samples and that every
+// rollup step is a whole number of milliseconds and a multiple of the
+// previous one.
+func (p RetentionPolicy) Validate() error {
+	if len(p) == 0 || p[0].Step != 0 {
+		return fmt.Errorf("a retention policy starts with raw samples")
+	}
+	for i, r := range p {
+		if r.Retention <= 0 {
+			return fmt.Errorf("retention of %s must be positive", r.Name())
+		}
+		if i == 0 {
+			continue
+		}
+		if r.Step <= 0 || r.Step%time.Millisecond != 0 {
+			return fmt.Errorf("invalid rollup step %s", r.Step)
+		}
+		if prev := p[i-1].Step; prev > 0 && (r.Step <= prev || r.Step%prev != 0) {
+			return fmt.Errorf("rollup step %s is not a multiple of %s", r.Name(), p[i-1].Name())
+		}
+	}
+	return nil
+}
+
+// Pick returns the finest resolution whose retention still covers from.
+// When none does, the coarsest resolution is returned.
+func (p RetentionPolicy) Pick(from, now time.Time) Resolution {
+	for _, r := range p {
+		if !from.Before(now.Add(-r.Retention)) {
+			return r
+		}
+	}
+	return p[len(p)-1]
+}
+
+// Lookup returns the resolution with the given name.
+func (p RetentionPolicy) Lookup(name string) (Resolution, bool) {
+	for _, r := range p {
+		if r.Name() == name {
+			return r, true
+		}
+	}
+	return Resolution{}, false
+}
+
+// CompactResult counts what a compaction did.
+type CompactResult struct {
+	// Rollups is the number of rollup buckets written.
+	Rollups int
+	// Expired is the number of raw samples and rollups deleted.
+	Expired int
+}
+
+// QueryRange returns the history of a series between from and to at
+// resolution r, with raw samples as rollups of one sample each.
+func QueryRange(s MetricsStorage, r Resolution, metricType, id string, from, to time.Time) ([]models.Rollup, error) {
+	if r.Step > 0 {
+		return s.Rollups(metricType, id, r.Step, from, to)
+	}
+	samples, err := s.History(metricType, id, from, to)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]models.Rollup, len(samples))
+	for i, sample := range samples {
+		points[i] = models.Rollup{Timestamp: sample.Timestamp}
+		points[i].Add(sample.Value)
+	}
+	return points, nil
+}
+
+// compactionWindow returns the buckets of step that the level can build:
+// from its watermark up to the last bucket that has ended by now.
+func compactionWindow(watermark int64, step time.Duration, now time.Time) (int64, int64) {
+	ms := step.Milliseconds()
+	return watermark, now.UnixMilli() / ms * ms
+}
+
+// expiryCutoff is the time before which a level's data may be deleted: its
+// retention, but never data the next level has not been built from yet.
+func expiryCutoff(p RetentionPolicy, level int, watermarks map[time.Duration]int64, now time.Time) int64 {
+	cutoff := now.Add(-p[level].Retention).UnixMilli()
+	if level+1 < len(p) {
+		if built := watermarks[p[level+1].Step]; built < cutoff {
+			cutoff = built
+		}
+	}
+	return cutoff
+}
+
+// appendRollups summarises the points in [from, to) into buckets of step
+// and appends them to dst. Points must be sorted by timestamp.
+func appendRollups(dst []models.Rollup, step time.Duration, from, to int64, points []models.Rollup) []models.Rollup {
+	ms := step.Milliseconds()
+	var current models.Rollup
+	for _, p := range points {
+		if p.Timestamp < from || p.Timestamp >= to {
+			continue
+		}
+		bucket := p.Timestamp - p.Timestamp%ms
+		if current.Count > 0 && bucket != current.Timestamp {
+			dst = append(dst, current)
+			current = models.Rollup{}
+		}
+		current.Timestamp = bucket
+		current.Merge(p)
+	}
+	if current.Count > 0 {
+		dst = append(dst, current)
+	}
+	return dst
+}
+
+func parseRetentionDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func formatRetentionDuration(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	case d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	}
+	return d.String()
+}
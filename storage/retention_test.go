@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	policy, err := ParseRetentionPolicy("raw=24h, 1m=30d, 1h=365d")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(policy) != 3 || policy[1] != (Resolution{Step: time.Minute, Retention: 30 * 24 * time.Hour}) {
+		t.Errorf("Expected the default policy, got %v", policy)
+	}
+	for i, r := range DefaultRetentionPolicy() {
+		if policy[i] != r {
+			t.Errorf("Expected level %d to be %v, got %v", i, r, policy[i])
+		}
+	}
+
+	for _, bad := range []string{"", "1m=30d", "raw=24h,1m", "raw=24h,1m=0d", "raw=24h,1h=30d,1m=1d", "raw=24h,1m=30d,90s=1d", "raw=1x"} {
+		if _, err := ParseRetentionPolicy(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestRetentionPolicyPick(t *testing.T) {
+	policy := DefaultRetentionPolicy()
+	now := time.Now()
+	for from, want := range map[time.Duration]string{
+		time.Hour:            "raw",
+		24 * time.Hour:       "raw",
+		7 * 24 * time.Hour:   "1m",
+		90 * 24 * time.Hour:  "1h",
+		800 * 24 * time.Hour: "1h",
+	} {
+		if got := policy.Pick(now.Add(-from), now).Name(); got != want {
+			t.Errorf("Expected %s back to use %s, got %s", from, want, got)
+		}
+	}
+	if r, ok := policy.Lookup("1h"); !ok || r.Step != time.Hour {
+		t.Errorf("Expected to find the 1h level, got %v", r)
+	}
+	if _, ok := policy.Lookup("5m"); ok {
+		t.Errorf("Expected no 5m level")
+	}
+}
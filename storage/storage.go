@@ -1,11 +1,74 @@
 package storage
 
-import "github.com/hairutdin/metrics-service/models"
+import (
+	"errors"
+	"time"
+
+	"github.com/hairutdin/metrics-service/models"
+)
+
+// DefaultIdempotencyTTL is how long batch idempotency keys are remembered
+// unless configured otherwise.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+var (
+	ErrMetricNotFound = errors.New("metric not found")
+	ErrMetricExists   = errors.New("metric already exists")
+)
 
 type MetricsStorage interface {
 	UpdateGauge(name string, value float64)
 	UpdateCounter(name string, value int64)
 	UpdateMetricsBatch(metrics []models.Metrics) error
+	// UpdateMetricsBatchOnce applies metrics like UpdateMetricsBatch and
+	// records key for ttl. If key was already recorded and has not expired
+	// the batch is skipped and false is returned, so a retried request does
+	// not count twice.
+	UpdateMetricsBatchOnce(key string, metrics []models.Metrics, ttl time.Duration) (bool, error)
 	GetMetric(metricType string, name string) (string, error)
+	// GetMetrics looks up several metrics at once by ID and type and
+	// returns those that exist, with their values. Missing metrics are
+	// left out rather than reported as errors.
+	GetMetrics(keys []models.Metrics) ([]models.Metrics, error)
 	GetAllMetrics() map[string]string
+	// CountSeries returns the number of stored gauges and counters.
+	CountSeries() (int, error)
+	// Snapshot returns every stored metric with its current value.
+	Snapshot() ([]models.Metrics, error)
+	// ListMetrics returns one page of the metrics matching the query.
+	ListMetrics(query ListQuery) (ListResult, error)
+	// DeleteMetric removes a metric and returns ErrMetricNotFound if it
+	// does not exist.
+	DeleteMetric(metricType string, name string) error
+	// DeleteMatching removes every metric of the given type (both types
+	// when empty) whose ID matches the regular expression, and returns the
+	// removed metrics without values.
+	DeleteMatching(metricType string, pattern string) ([]models.Metrics, error)
+	// ResetCounter sets a counter back to zero.
+	ResetCounter(name string) error
+	// RenameMetric moves a metric's value to a new ID. It fails with
+	// ErrMetricExists rather than overwrite another metric.
+	RenameMetric(metricType string, oldName string, newName string) error
+	// DeleteStaleGauges removes every gauge last updated before the given
+	// time and returns the removed gauges without values, sorted by ID.
+	DeleteStaleGauges(before time.Time) ([]models.Metrics, error)
+	// SetMetadata replaces the metadata registered for a metric name. Batch
+	// updates merge the non-empty fields of each metric's Meta instead.
+	SetMetadata(metricType string, name string, md models.Metadata) error
+	// DeleteMetadata removes a registry entry and returns ErrMetricNotFound
+	// if there is none.
+	DeleteMetadata(metricType string, name string) error
+	// ListMetadata returns every registry entry sorted by name and type.
+	ListMetadata() ([]models.MetricMetadata, error)
+	// History returns the recorded raw samples of a series with timestamps
+	// in [from, to], oldest first. Every applied update records one sample;
+	// for counters it holds the running total.
+	History(metricType string, id string, from, to time.Time) ([]models.Sample, error)
+	// Rollups returns the rollups of a series at the given step whose
+	// buckets start in [from, to], oldest first.
+	Rollups(metricType string, id string, step time.Duration, from, to time.Time) ([]models.Rollup, error)
+	// Compact builds the rollups of the policy for every bucket that has
+	// ended by now and deletes history older than the retention of its
+	// resolution.
+	Compact(policy RetentionPolicy, now time.Time) (CompactResult, error)
 }